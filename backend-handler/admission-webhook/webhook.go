@@ -0,0 +1,256 @@
+package webhook
+
+import (
+	"backend-handler/notebook"
+	switcher "backend-handler/notebook-switcher"
+	"backend-handler/tracing"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var tracer = otel.Tracer("backend-handler/admission-webhook")
+
+// OptInLabel must be set to "enabled" on a namespace for the webhook to act on
+// it; the webhook configurations select namespaces with it.
+const OptInLabel = "gpu-switcher/admission"
+
+// Server answers AdmissionReview requests for Kubeflow Notebooks so that GPU
+// resources can only be obtained through the switcher. Notebooks carrying
+// switcher.ManagedByAnnotation are left alone; all others either get rejected
+// (/validate) or have their GPU resources stripped (/mutate).
+type Server struct {
+	Clientset kubernetes.Interface
+	// TrustedUsers are the only users (e.g. the switcher's service account)
+	// whose Notebooks are trusted by their managed-by annotation. Anyone can
+	// set the annotation, so without TrustedUsers no Notebook is trusted.
+	TrustedUsers []string
+	// GPUKeys are the GPU resource keys the operator always enforces. The
+	// keys of the namespace's profiles are added to them: the namespace's
+	// ConfigMap is the tenant's, so it cannot take keys away.
+	GPUKeys []string
+}
+
+// Handler returns the HTTP handler serving /validate and /mutate.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/validate", tracing.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serve(w, r, false)
+	}), "admission validate"))
+	mux.Handle("/mutate", tracing.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serve(w, r, true)
+	}), "admission mutate"))
+	return mux
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, mutate bool) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		log.Printf("Admission webhook: invalid AdmissionReview: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid AdmissionReview payload"))
+		return
+	}
+
+	resp, err := s.review(r.Context(), review.Request, mutate)
+	if err != nil {
+		// Internal errors are reported to the API server, which applies the
+		// failurePolicy of the webhook configuration.
+		log.Printf("Admission webhook: %s %s/%s: %v", review.Request.Operation, review.Request.Namespace, review.Request.Name, err)
+		resp = &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result:  &metav1.Status{Code: http.StatusInternalServerError, Message: err.Error()},
+		}
+	}
+	resp.UID = review.Request.UID
+	review.Response = resp
+	review.Request = nil
+
+	out, err := json.Marshal(review)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// review decides on a single admission request.
+func (s *Server) review(ctx context.Context, req *admissionv1.AdmissionRequest, mutate bool) (*admissionv1.AdmissionResponse, error) {
+	ctx, span := tracer.Start(ctx, "review notebook")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("notebook.namespace", req.Namespace),
+		attribute.String("notebook.name", req.Name),
+		attribute.String("admission.operation", string(req.Operation)),
+		attribute.String("admission.user", req.UserInfo.Username),
+	)
+
+	allow := &admissionv1.AdmissionResponse{Allowed: true}
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return allow, nil
+	}
+
+	obj := &notebook.Notebook{}
+	if err := json.Unmarshal(req.Object.Raw, obj); err != nil {
+		return nil, fmt.Errorf("decode notebook: %w", err)
+	}
+	if s.trusted(obj, req.UserInfo.Username) {
+		return allow, nil
+	}
+
+	keys := s.resourceKeys(ctx, req.Namespace)
+	gpus := gpuResources(obj, keys)
+	if len(gpus) == 0 {
+		return allow, nil
+	}
+
+	// Updates that keep the GPU resources as they are (e.g. stopping a notebook
+	// from the UI) are not a bypass.
+	if req.Operation == admissionv1.Update && len(req.OldObject.Raw) > 0 {
+		old := &notebook.Notebook{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			return nil, fmt.Errorf("decode old notebook: %w", err)
+		}
+		if reflect.DeepEqual(gpuResources(old, keys), gpus) {
+			return allow, nil
+		}
+	}
+
+	if !mutate {
+		span.SetAttributes(attribute.String("admission.decision", "rejected"))
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Code:    http.StatusForbidden,
+				Reason:  metav1.StatusReasonForbidden,
+				Message: fmt.Sprintf("GPU resources (%s) on Notebooks in namespace %q can only be requested through the GPU switcher (Migrate button); create the notebook without GPUs", strings.Join(keys, ", "), req.Namespace),
+			},
+		}, nil
+	}
+
+	patch, err := json.Marshal(stripPatch(gpus))
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("admission.decision", "stripped"))
+	pt := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patch,
+		PatchType: &pt,
+		Warnings:  []string{"GPU resources were removed: use the GPU switcher (Migrate button) to move this notebook to a GPU"},
+	}, nil
+}
+
+// resourceKeys returns GPUKeys and the GPU resource keys of the profiles of
+// namespace. A namespace configuration that cannot be read leaves GPUKeys.
+func (s *Server) resourceKeys(ctx context.Context, namespace string) []string {
+	keys := slices.Clone(s.GPUKeys)
+	nsCfg, err := switcher.LoadConfig(ctx, s.Clientset, namespace)
+	if err != nil {
+		log.Printf("Admission webhook: namespace %s: %v; enforcing %s only", namespace, err, strings.Join(s.GPUKeys, ", "))
+		return keys
+	}
+	for _, k := range nsCfg.ResourceKeys() {
+		if !slices.Contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// trusted reports whether the Notebook was created by the switcher.
+func (s *Server) trusted(obj *notebook.Notebook, user string) bool {
+	if obj.GetAnnotations()[switcher.ManagedByAnnotation] != switcher.ManagedByValue {
+		return false
+	}
+	for _, u := range s.TrustedUsers {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// gpuResource is one GPU entry found in a container's resources.
+type gpuResource struct {
+	// Path is the JSON pointer of the container, e.g. /spec/template/spec/containers/0
+	Path  string
+	Field string // "limits" or "requests"
+	Key   string
+	Value string
+}
+
+// gpuResources lists GPU resource entries of all (init) containers of the pod template.
+func gpuResources(obj *notebook.Notebook, keys []string) []gpuResource {
+	var out []gpuResource
+	lists := map[string][]corev1.Container{
+		"containers":     obj.PodSpec().Containers,
+		"initContainers": obj.PodSpec().InitContainers,
+	}
+	for _, list := range []string{"containers", "initContainers"} {
+		for i, c := range lists[list] {
+			for _, field := range []string{"limits", "requests"} {
+				res := c.Resources.Limits
+				if field == "requests" {
+					res = c.Resources.Requests
+				}
+				for _, key := range keys {
+					if v, ok := res[corev1.ResourceName(key)]; ok {
+						out = append(out, gpuResource{
+							Path:  fmt.Sprintf("/spec/template/spec/%s/%d", list, i),
+							Field: field,
+							Key:   key,
+							Value: v.String(),
+						})
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+type patchOp struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+}
+
+// stripPatch builds a JSON patch removing the given GPU entries.
+func stripPatch(gpus []gpuResource) []patchOp {
+	ops := make([]patchOp, 0, len(gpus))
+	for _, g := range gpus {
+		ops = append(ops, patchOp{Op: "remove", Path: g.Path + "/resources/" + g.Field + "/" + escapePointer(g.Key)})
+	}
+	return ops
+}
+
+// escapePointer escapes a JSON pointer token (RFC 6901).
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
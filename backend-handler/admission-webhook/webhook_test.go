@@ -0,0 +1,52 @@
+package webhook
+
+import (
+	switcher "backend-handler/notebook-switcher"
+	"context"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestResourceKeys(t *testing.T) {
+	ctx := context.Background()
+	operator := []string{"nvidia.com/gpu"}
+
+	tests := []struct {
+		name string
+		data map[string]string
+		want []string
+	}{
+		{name: "no ConfigMap", want: []string{"nvidia.com/gpu"}},
+		// The tenant's ConfigMap cannot take the operator's key away
+		{
+			name: "other keys",
+			data: map[string]string{"gpuResourceKey": "amd.com/gpu", "numGpuResource": "1", "profiles": `{"mig": {"resourceKey": "nvidia.com/mig-1g.5gb"}}`},
+			want: []string{"amd.com/gpu", "nvidia.com/gpu", "nvidia.com/mig-1g.5gb"},
+		},
+		{name: "invalid ConfigMap", data: map[string]string{"profiles": `{`}, want: []string{"nvidia.com/gpu"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := fake.NewSimpleClientset()
+			if tt.data != nil {
+				cs = fake.NewSimpleClientset(&corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "team", Name: switcher.ConfigMapName},
+					Data:       tt.data,
+				})
+			}
+			s := &Server{Clientset: cs, GPUKeys: operator}
+			got := s.resourceKeys(ctx, "team")
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("resourceKeys = %v, want %v", got, tt.want)
+			}
+			if !slices.Equal(operator, []string{"nvidia.com/gpu"}) {
+				t.Errorf("GPUKeys modified: %v", operator)
+			}
+		})
+	}
+}
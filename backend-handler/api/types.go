@@ -0,0 +1,357 @@
+// Package api holds the JSON types of the backend-handler HTTP API. The server
+// and package client both use them, so the contract is defined in one place.
+package api
+
+import (
+	"backend-handler/policy"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Message is the payload of POST /messages sent by the front-end extensions.
+type Message struct {
+	NotifyGPUNeeded   string `json:"NotifyGPUNeeded"`
+	NotifyGPUReleased string `json:"NotifyGPUReleased"`
+	PodName           string `json:"PodName"`
+	PodNamespace      string `json:"PodNamespace"`
+	// Profile names the GPU profile to migrate to; empty selects "default".
+	Profile string `json:"Profile,omitempty"`
+	// NotebookName names the Notebook directly (e.g. from the CLI) instead of
+	// deriving it from PodName.
+	NotebookName string `json:"NotebookName,omitempty"`
+	// DocumentPath is the document the user has open, relative to the server
+	// root; the returned URL opens it in the new notebook.
+	DocumentPath string `json:"DocumentPath,omitempty"`
+}
+
+// MessageResponse answers POST /messages.
+type MessageResponse struct {
+	Status       string `json:"status"` // "received", "queued", "accepted" or "denied"
+	PodNamespace string `json:"podNamespace"`
+	NewNBName    string `json:"newNBName,omitempty"`
+	NewURL       string `json:"newURL,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Code         string `json:"code,omitempty"`
+	// MigrationID, with status "queued" or "accepted" (202), is the
+	// migration still in progress, at Version; watch it with GET
+	// /migrations/{id}?watch=<version>. Queue is its queue status.
+	MigrationID string       `json:"migrationID,omitempty"`
+	Version     int          `json:"version,omitempty"`
+	Queue       *QueueStatus `json:"queue,omitempty"`
+}
+
+// Error codes returned in ErrorResponse.Code.
+const (
+	CodeInvalidRequest = "InvalidRequest" // 400
+	CodeUnauthorized   = "Unauthorized"   // 401
+	CodePolicyDenied   = "PolicyDenied"   // 403
+	CodeNotFound       = "NotFound"       // 404
+	CodeConflict       = "Conflict"       // 409
+	CodeInternal       = "Internal"       // 500
+)
+
+// ErrorResponse is the body of every non-2xx answer.
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+}
+
+// Migration directions.
+const (
+	DirectionToGPU = "to-gpu"
+	DirectionToCPU = "to-cpu"
+)
+
+// MigrationRequest is the body of POST /migrations.
+type MigrationRequest struct {
+	Namespace string `json:"namespace"`
+	Notebook  string `json:"notebook"`
+	Direction string `json:"direction"`
+	Profile   string `json:"profile,omitempty"`
+	// Path is a document to open in the new notebook, relative to the server root.
+	Path string `json:"path,omitempty"`
+}
+
+// Migration states.
+const (
+	StatePending = "Pending"
+	// StateQueued is a migration to GPU waiting for free GPUs, see QueueStatus.
+	StateQueued    = "Queued"
+	StateRunning   = "Running"
+	StateSucceeded = "Succeeded"
+	StateFailed    = "Failed"
+	StateCancelled = "Cancelled"
+)
+
+// Migration is an asynchronous migration started with POST /migrations.
+type Migration struct {
+	ID string `json:"id"`
+	MigrationRequest
+	State string `json:"state"`
+	// Step describes what the switcher is doing right now.
+	Step        string `json:"step,omitempty"`
+	NewNotebook string `json:"newNotebook,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Code        string `json:"code,omitempty"`
+	// Queue is set while the migration is queued.
+	Queue *QueueStatus `json:"queue,omitempty"`
+	// Version increases with every change; GET /migrations/{id}?watch=<version>
+	// blocks until the migration moves past that version.
+	Version  int        `json:"version"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// QueueStatus is the place of a migration in the GPU wait queue. Migrations
+// waiting for the same GPU resource start in the order they were queued.
+type QueueStatus struct {
+	// Position is 1 for the next migration to start.
+	Position int `json:"position"`
+	// Pool is the GPU resource key waited for.
+	Pool string `json:"pool"`
+	// Reason tells why the migration cannot start yet.
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	// ETA estimates when the migration starts from how fast the queue moved
+	// so far; it is unset until a migration of the pool left the queue.
+	ETA *time.Time `json:"eta,omitempty"`
+}
+
+// Done reports whether the migration reached a final state.
+func (m *Migration) Done() bool {
+	return m.State == StateSucceeded || m.State == StateFailed || m.State == StateCancelled
+}
+
+// Notebook modes.
+const (
+	ModeCPU = "cpu"
+	ModeGPU = "gpu"
+)
+
+// NotebookStatus answers GET /status.
+type NotebookStatus struct {
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace"`
+	Mode      string    `json:"mode"`
+	Profile   string    `json:"profile,omitempty"`
+	Stopped   bool      `json:"stopped"`
+	PodName   string    `json:"podName,omitempty"`
+	PodPhase  string    `json:"podPhase,omitempty"`
+	Ready     bool      `json:"ready"`
+	Created   time.Time `json:"created"`
+	// Queue is set while a migration of the notebook waits for free GPUs.
+	Queue *QueueStatus `json:"queue,omitempty"`
+}
+
+// HistoryEntry records one migration; GET /history returns them oldest first.
+type HistoryEntry struct {
+	Time    time.Time `json:"time"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Mode    string    `json:"mode"` // mode migrated to
+	Profile string    `json:"profile,omitempty"`
+}
+
+// Profile is a GPU flavour a notebook can be migrated to.
+type Profile struct {
+	Name             string `json:"name"`
+	ResourceKey      string `json:"resourceKey"`
+	Count            int    `json:"count"`
+	RuntimeClassName string `json:"runtimeClassName,omitempty"`
+	// HubProfile is the KubeSpawner profile slug used by the jupyterhub
+	// backend; it defaults to the profile name.
+	HubProfile string `json:"hubProfile,omitempty"`
+	// Placement is added to notebooks migrated to this profile.
+	Placement
+	// Timeouts override those of the namespace for migrations to this profile.
+	Timeouts *Timeouts `json:"timeouts,omitempty"`
+}
+
+// Timeouts bound the steps of a migration. Unset fields keep the value of the
+// level below: profile, namespace, then the backend's flags.
+type Timeouts struct {
+	// API bounds reading the configuration and creating the new notebook.
+	API *Duration `json:"api,omitempty"`
+	// PodReady bounds waiting for the new pod (or Hub server) to become ready.
+	PodReady *Duration `json:"podReady,omitempty"`
+	// Drain is the delay between the new pod being ready and the old notebook
+	// being deleted, e.g. to let the user save their work; may be "0s".
+	Drain *Duration `json:"drain,omitempty"`
+	// Delete bounds deleting the old notebook, including AwaitDeletion.
+	Delete *Duration `json:"delete,omitempty"`
+	// Transfer bounds listing and copying the transfer paths.
+	Transfer *Duration `json:"transfer,omitempty"`
+	// AwaitDeletion makes the migration wait until the old notebook and its
+	// pod are gone before it succeeds.
+	AwaitDeletion *bool `json:"awaitDeletion,omitempty"`
+}
+
+// Duration is a time.Duration written as a string such as "90s" in JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"90s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("negative duration %q", s)
+	}
+	d.Duration = v
+	return nil
+}
+
+// Placement is the environment and scheduling a notebook gets in one mode,
+// e.g. CUDA variables and GPU node tolerations. What a migration adds is
+// recorded on the notebook and removed again by the next migration.
+type Placement struct {
+	// Env is set on the notebook container.
+	Env          []corev1.EnvVar     `json:"env,omitempty"`
+	NodeSelector map[string]string   `json:"nodeSelector,omitempty"`
+	Tolerations  []corev1.Toleration `json:"tolerations,omitempty"`
+	// Affinity terms are merged into the pod's affinity; required node
+	// selector requirements are added to every existing node selector term.
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+}
+
+// IsZero reports whether p changes nothing.
+func (p *Placement) IsZero() bool {
+	return len(p.Env) == 0 && len(p.NodeSelector) == 0 && len(p.Tolerations) == 0 && p.Affinity == nil
+}
+
+// NamespaceConfig answers GET /profiles.
+type NamespaceConfig struct {
+	Namespace string             `json:"namespace"`
+	Profiles  map[string]Profile `json:"profiles"`
+	Policy    policy.Policy      `json:"policy"`
+	// WorkloadBackend is the kind of resource running the notebooks
+	// ("kubeflow", "statefulset" or "jupyterhub").
+	WorkloadBackend string `json:"workloadBackend"`
+	// URLTemplate overrides the notebook URL; {namespace} and {name} are substituted.
+	URLTemplate string `json:"urlTemplate,omitempty"`
+	// DocumentURLTemplate is the URL of a document in a notebook; {path} is
+	// substituted too. Empty appends "lab/tree/{path}" to the notebook URL.
+	DocumentURLTemplate string `json:"documentURLTemplate,omitempty"`
+	// NotebookContainer names the container that gets the GPUs; empty picks it
+	// by the notebook name.
+	NotebookContainer string `json:"notebookContainer,omitempty"`
+	// Timeouts apply to the migrations of the namespace; GPU profiles may
+	// override them.
+	Timeouts *Timeouts `json:"timeouts,omitempty"`
+	// CPUPlacement is added to notebooks migrated to CPU, e.g. anti-affinity
+	// to GPU nodes.
+	CPUPlacement Placement `json:"cpuPlacement,omitzero"`
+	// ImageMap swaps container images between their CPU and GPU variants.
+	ImageMap []ImageRule `json:"imageMap,omitempty"`
+	// AllowedRegistries restricts mapped images to these registries or
+	// repository prefixes; empty allows any.
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+	// Checkpoint is run in the old notebook before it is deleted; nil disables it.
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+	// Transfer copies data outside the workspace volume to the new pod; nil disables it.
+	Transfer *Transfer `json:"transfer,omitempty"`
+	// HubCPUProfile is the KubeSpawner profile of CPU servers; empty uses the Hub's default.
+	HubCPUProfile string `json:"hubCPUProfile,omitempty"`
+}
+
+// Checkpoint saves the state of a notebook before the switcher deletes it.
+type Checkpoint struct {
+	// Command is run with "sh -c" in the notebook container of the old pod,
+	// e.g. a kishu commit of the open notebooks.
+	Command string `json:"command"`
+	// Artifact is a file or directory (relative to the container's working
+	// directory) the command writes to the workspace volume. When set, the new
+	// pod must see it changed, or the old notebook is kept.
+	Artifact string `json:"artifact,omitempty"`
+	// Timeout bounds Command; zero means five minutes.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// Transfer copies files that are not on the workspace volume, such as /tmp
+// or ~/.cache, from the old pod to the new one as a tar stream.
+type Transfer struct {
+	// Paths are absolute or relative to $HOME ("~/" prefix allowed).
+	Paths []string `json:"paths"`
+	// MaxBytes limits the total size; files beyond it are skipped.
+	MaxBytes int64 `json:"maxBytes"`
+	// MaxFileBytes skips single files larger than it.
+	MaxFileBytes int64 `json:"maxFileBytes"`
+}
+
+// ImageRule maps the image of a container when migrating. An exact rule
+// (Regex false) applies both ways by default: From→To to GPU, To→From to CPU.
+// A regex rule matches From against the image and expands To with its
+// submatches ($1, ...); it needs a Direction.
+type ImageRule struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Regex     bool   `json:"regex,omitempty"`
+	Direction string `json:"direction,omitempty"` // DirectionToGPU, DirectionToCPU or empty for both
+}
+
+// Pre-flight checks of a migration to GPU, see PreflightReport.
+const (
+	CheckPolicy   = "policy"   // namespace policy limits
+	CheckSpec     = "spec"     // the GPU clone can be built (container, image mapping)
+	CheckQuota    = "quota"    // ResourceQuota headroom for the new pod
+	CheckCapacity = "capacity" // a schedulable node has the GPUs free
+	CheckVolumes  = "volumes"  // the new pod can mount the notebook's PVCs
+	CheckImages   = "images"   // the images of the new pod exist
+)
+
+// Check results.
+const (
+	CheckPassed = "pass"
+	CheckFailed = "fail"
+	// CheckUnknown is a check that could not be made, e.g. for lack of
+	// permissions or registry credentials; it does not fail the report.
+	CheckUnknown = "unknown"
+)
+
+// PreflightCheck is the outcome of one check.
+type PreflightCheck struct {
+	Name    string `json:"name"`   // one of the Check* names
+	Result  string `json:"result"` // CheckPassed, CheckFailed or CheckUnknown
+	Message string `json:"message"`
+}
+
+// PreflightReport answers GET /preflight: whether migrating the notebook to
+// the profile can be expected to succeed, without changing anything.
+type PreflightReport struct {
+	Namespace string `json:"namespace"`
+	Notebook  string `json:"notebook"`
+	Profile   string `json:"profile"`
+	// ResourceKey is the GPU resource of the profile.
+	ResourceKey string           `json:"resourceKey"`
+	Passed      bool             `json:"passed"` // no check failed
+	Checks      []PreflightCheck `json:"checks"`
+}
+
+// Check returns the check named name, or nil if it was not made.
+func (r *PreflightReport) Check(name string) *PreflightCheck {
+	for i := range r.Checks {
+		if r.Checks[i].Name == name {
+			return &r.Checks[i]
+		}
+	}
+	return nil
+}
+
+// ReleaseIdleResponse answers POST /release-idle.
+type ReleaseIdleResponse struct {
+	Released []string `json:"released"`
+}
@@ -0,0 +1,246 @@
+// Package client is a Go client for the backend-handler HTTP API. It uses the
+// types of package api, the same ones the server encodes.
+//
+//	c := client.New("http://switcher-svc.default")
+//	m, err := c.StartMigration(ctx, api.MigrationRequest{Namespace: "alice", Notebook: "nb", Direction: api.DirectionToGPU})
+//	m, err = c.WatchMigration(ctx, m.ID, func(m *api.Migration) { fmt.Println(m.State, m.Step) })
+package client
+
+import (
+	"backend-handler/api"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to one backend-handler server.
+type Client struct {
+	// BaseURL is the server root, e.g. "http://switcher-svc.default".
+	BaseURL string
+	// HTTPClient defaults to http.DefaultClient. Its timeout must exceed the
+	// server's long-poll duration (30s) for WatchMigration.
+	HTTPClient *http.Client
+	// Token is sent as bearer token, e.g. the operator token of ReleaseIdle.
+	Token string
+}
+
+// New returns a Client for baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+// Error is a non-2xx answer of the server.
+type Error struct {
+	StatusCode int
+	// Code is one of the api.Code* constants; empty for servers that do not send it.
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func hasCode(err error, code string, status int) bool {
+	var e *Error
+	return errors.As(err, &e) && (e.Code == code || e.Code == "" && e.StatusCode == status)
+}
+
+// IsNotFound reports whether err means the notebook or migration does not exist.
+func IsNotFound(err error) bool { return hasCode(err, api.CodeNotFound, http.StatusNotFound) }
+
+// IsPolicyDenied reports whether err is a refusal by the namespace policy.
+func IsPolicyDenied(err error) bool { return hasCode(err, api.CodePolicyDenied, http.StatusForbidden) }
+
+// IsConflict reports whether err means another migration of the notebook is in progress.
+func IsConflict(err error) bool { return hasCode(err, api.CodeConflict, http.StatusConflict) }
+
+// StartMigration starts an asynchronous migration and returns it in state Pending.
+func (c *Client) StartMigration(ctx context.Context, req api.MigrationRequest) (*api.Migration, error) {
+	var m api.Migration
+	if err := c.do(ctx, http.MethodPost, "/migrations", nil, req, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// GetMigration returns the current state of a migration.
+func (c *Client) GetMigration(ctx context.Context, id string) (*api.Migration, error) {
+	var m api.Migration
+	if err := c.do(ctx, http.MethodGet, "/migrations/"+url.PathEscape(id), nil, nil, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// WatchMigration long-polls a migration until it is done, calling fn (if not
+// nil) on every change, and returns its final state. A failed or cancelled
+// migration is returned without error; check its State.
+func (c *Client) WatchMigration(ctx context.Context, id string, fn func(*api.Migration)) (*api.Migration, error) {
+	version := 0
+	for {
+		var m api.Migration
+		q := url.Values{"watch": {strconv.Itoa(version)}}
+		if err := c.do(ctx, http.MethodGet, "/migrations/"+url.PathEscape(id), q, nil, &m); err != nil {
+			return nil, err
+		}
+		if m.Version > version {
+			version = m.Version
+			if fn != nil {
+				fn(&m)
+			}
+		}
+		if m.Done() {
+			return &m, nil
+		}
+	}
+}
+
+// CancelMigration cancels a migration; steps already done are not rolled back.
+func (c *Client) CancelMigration(ctx context.Context, id string) (*api.Migration, error) {
+	var m api.Migration
+	if err := c.do(ctx, http.MethodDelete, "/migrations/"+url.PathEscape(id), nil, nil, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ListMigrations returns the migrations known to the server, newest first.
+// Empty namespace or notebook match all.
+func (c *Client) ListMigrations(ctx context.Context, namespace, notebook string) ([]api.Migration, error) {
+	q := url.Values{}
+	if namespace != "" {
+		q.Set("namespace", namespace)
+	}
+	if notebook != "" {
+		q.Set("notebook", notebook)
+	}
+	var ms []api.Migration
+	err := c.do(ctx, http.MethodGet, "/migrations", q, nil, &ms)
+	return ms, err
+}
+
+// Migrate runs a migration through POST /messages, the endpoint of the
+// front-end extensions. It returns once the migration is done, or once it is
+// queued with Status "queued" and its MigrationID, to follow with
+// WatchMigration.
+func (c *Client) Migrate(ctx context.Context, msg api.Message) (*api.MessageResponse, error) {
+	var res api.MessageResponse
+	if err := c.do(ctx, http.MethodPost, "/messages", nil, msg, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Status returns the mode and pod state of a notebook.
+func (c *Client) Status(ctx context.Context, namespace, notebook string) (*api.NotebookStatus, error) {
+	var st api.NotebookStatus
+	if err := c.do(ctx, http.MethodGet, "/status", url.Values{"namespace": {namespace}, "notebook": {notebook}}, nil, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// History returns the past migrations of a notebook, oldest first.
+func (c *Client) History(ctx context.Context, namespace, notebook string) ([]api.HistoryEntry, error) {
+	var h []api.HistoryEntry
+	err := c.do(ctx, http.MethodGet, "/history", url.Values{"namespace": {namespace}, "notebook": {notebook}}, nil, &h)
+	return h, err
+}
+
+// Profiles returns the GPU profiles and policy of a namespace.
+func (c *Client) Profiles(ctx context.Context, namespace string) (*api.NamespaceConfig, error) {
+	var cfg api.NamespaceConfig
+	if err := c.do(ctx, http.MethodGet, "/profiles", url.Values{"namespace": {namespace}}, nil, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Preflight checks whether migrating a notebook to GPU profile ("" for the
+// default) can be expected to succeed; a failed check is not an error.
+func (c *Client) Preflight(ctx context.Context, namespace, notebook, profile string) (*api.PreflightReport, error) {
+	q := url.Values{"namespace": {namespace}, "notebook": {notebook}}
+	if profile != "" {
+		q.Set("profile", profile)
+	}
+	var rep api.PreflightReport
+	if err := c.do(ctx, http.MethodGet, "/preflight", q, nil, &rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// ReleaseIdle runs one idle reclaim pass on the server (all namespaces if
+// namespace is empty) and returns the released "namespace/name" notebooks.
+// It needs the operator Token. An idleTimeout of 0, or one shorter than the
+// server's, uses the server's.
+func (c *Client) ReleaseIdle(ctx context.Context, namespace string, idleTimeout time.Duration) ([]string, error) {
+	q := url.Values{}
+	if namespace != "" {
+		q.Set("namespace", namespace)
+	}
+	if idleTimeout > 0 {
+		q.Set("idleTimeout", idleTimeout.String())
+	}
+	var res api.ReleaseIdleResponse
+	err := c.do(ctx, http.MethodPost, "/release-idle", q, nil, &res)
+	return res.Released, err
+}
+
+// do sends a request and decodes the JSON response into out; non-2xx answers
+// become *Error.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		e := &Error{StatusCode: resp.StatusCode, Message: string(bytes.TrimSpace(raw))}
+		var body api.ErrorResponse
+		if json.Unmarshal(raw, &body) == nil && body.Error != "" {
+			e.Message, e.Code = body.Error, body.Code
+		}
+		return e
+	}
+	return json.Unmarshal(raw, out)
+}
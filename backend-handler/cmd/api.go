@@ -0,0 +1,267 @@
+package main
+
+import (
+	"backend-handler/api"
+	"backend-handler/migration"
+	switcher "backend-handler/notebook-switcher"
+	"backend-handler/policy"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Read-only and operator endpoints next to /messages, used by the nbswitch CLI.
+
+func setCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+}
+
+// allowMethod writes the CORS headers, answers preflight requests and rejects
+// other methods than method. It reports whether the handler should continue.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	setCORS(w)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return false
+	}
+	if r.Method != method {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Only " + method + " method is allowed"))
+		return false
+	}
+	return true
+}
+
+// errorCode maps err to an HTTP status and one of the api.Code* error codes.
+func errorCode(err error) (int, string) {
+	var denied *policy.DeniedError
+	var conflict *migration.ConflictError
+	var stopped *switcher.StoppedError
+	var locked *switcher.LockedError
+	var statusErr apierrors.APIStatus
+	switch {
+	case errors.As(err, &denied):
+		return http.StatusForbidden, api.CodePolicyDenied
+	case errors.Is(err, migration.ErrNotFound):
+		return http.StatusNotFound, api.CodeNotFound
+	case errors.As(err, &conflict), errors.As(err, &stopped), errors.As(err, &locked):
+		return http.StatusConflict, api.CodeConflict
+	case errors.Is(err, switcher.ErrNoNotebook):
+		return http.StatusNotFound, api.CodeNotFound
+	case apierrors.IsNotFound(err):
+		return http.StatusNotFound, api.CodeNotFound
+	case apierrors.IsAlreadyExists(err), apierrors.IsConflict(err):
+		return http.StatusConflict, api.CodeConflict
+	case apierrors.IsBadRequest(err), apierrors.IsInvalid(err):
+		return http.StatusBadRequest, api.CodeInvalidRequest
+	case errors.As(err, &statusErr) && statusErr.Status().Code >= 400:
+		return int(statusErr.Status().Code), api.CodeInternal
+	}
+	return http.StatusInternalServerError, api.CodeInternal
+}
+
+// codeStatus returns the HTTP status of one of the api.Code* error codes.
+func codeStatus(code string) int {
+	switch code {
+	case api.CodeInvalidRequest:
+		return http.StatusBadRequest
+	case api.CodeUnauthorized:
+		return http.StatusUnauthorized
+	case api.CodePolicyDenied:
+		return http.StatusForbidden
+	case api.CodeNotFound:
+		return http.StatusNotFound
+	case api.CodeConflict:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// writeError maps err to an HTTP status and writes it as an api.ErrorResponse.
+func writeError(w http.ResponseWriter, err error) {
+	status, code := errorCode(err)
+	log.Printf("%v", err)
+	writeJSON(w, status, api.ErrorResponse{Error: err.Error(), Code: code})
+}
+
+// badRequest answers 400 with msg.
+func badRequest(w http.ResponseWriter, msg string) {
+	writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: msg, Code: api.CodeInvalidRequest})
+}
+
+// requireParams returns the query parameters names, answering 400 if one is missing.
+func requireParams(w http.ResponseWriter, r *http.Request, names ...string) ([]string, bool) {
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = r.URL.Query().Get(name)
+		if values[i] == "" {
+			badRequest(w, "missing query parameter "+name)
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+// statusHandler serves GET /status?namespace=&notebook=
+// with the queue position of a migration of the notebook waiting for GPUs.
+func statusHandler(mg *migration.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		p, ok := requireParams(w, r, "namespace", "notebook")
+		if !ok {
+			return
+		}
+		st, err := switcher.GetStatus(r.Context(), p[0], p[1])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if st.Queue, err = mg.Queued(r.Context(), p[0], p[1]); err != nil {
+			log.Printf("Status of %s/%s: %v", p[0], p[1], err)
+		}
+		writeJSON(w, http.StatusOK, st)
+	}
+}
+
+// historyHandler serves GET /history?namespace=&notebook=
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	p, ok := requireParams(w, r, "namespace", "notebook")
+	if !ok {
+		return
+	}
+	h, err := switcher.GetHistory(r.Context(), p[0], p[1])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if h == nil {
+		h = []api.HistoryEntry{}
+	}
+	writeJSON(w, http.StatusOK, h)
+}
+
+// profilesHandler serves GET /profiles?namespace=
+func profilesHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	p, ok := requireParams(w, r, "namespace")
+	if !ok {
+		return
+	}
+	cfg, err := switcher.GetConfig(r.Context(), p[0])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, api.NamespaceConfig(*cfg))
+}
+
+// preflightHandler serves GET /preflight?namespace=&notebook=[&profile=]: the
+// report answers 200 whether the checks passed or not.
+func preflightHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	p, ok := requireParams(w, r, "namespace", "notebook")
+	if !ok {
+		return
+	}
+	rep, err := switcher.Preflight(r.Context(), p[0], p[1], r.URL.Query().Get("profile"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// openHandler serves GET /open/{namespace}/{name}[/{path...}][?wake=true]: a
+// stable link that redirects to the currently active notebook of logical
+// notebook name, opening path in it. wake starts a stopped notebook.
+func openHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	wake, _ := strconv.ParseBool(r.URL.Query().Get("wake"))
+	url, err := switcher.Open(r.Context(), r.PathValue("namespace"), r.PathValue("name"), r.PathValue("path"), wake)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// operator reports whether r carries token as bearer token, answering 401
+// otherwise. Without a token the operator endpoints are disabled (403).
+func operator(w http.ResponseWriter, r *http.Request, token string) bool {
+	if token == "" {
+		writeJSON(w, http.StatusForbidden, api.ErrorResponse{Error: "operator endpoints are disabled: no operator token is set", Code: api.CodePolicyDenied})
+		return false
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, api.ErrorResponse{Error: "missing or invalid operator token", Code: api.CodeUnauthorized})
+		return false
+	}
+	return true
+}
+
+// releaseIdleHandler serves POST /release-idle[?namespace=][&idleTimeout=]
+// to operators holding token: one reclaim pass now, with the server's idle
+// timeout or a longer one. It sends no CORS headers, so that web pages of
+// other origins cannot call it.
+func releaseIdleHandler(o reclaimOptions, token string, mg *migration.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("Only POST method is allowed"))
+			return
+		}
+		if !operator(w, r, token) {
+			return
+		}
+		rc, err := newReclaimer(o)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		q := r.URL.Query()
+		rc.Namespace = q.Get("namespace")
+		if v := q.Get("idleTimeout"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				badRequest(w, "idleTimeout must be a positive duration, e.g. 30m")
+				return
+			}
+			// never shorter than the server's
+			rc.IdleTimeout = max(rc.IdleTimeout, d)
+		}
+		// A client going away must not interrupt a notebook half-way to CPU
+		released, err := rc.ReconcileOnce(context.WithoutCancel(r.Context()))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if released == nil {
+			released = []string{}
+		} else {
+			mg.Kick() // queued migrations may fit now
+		}
+		writeJSON(w, http.StatusOK, api.ReleaseIdleResponse{Released: released})
+	}
+}
@@ -0,0 +1,145 @@
+// Command hubstub is a minimal in-memory JupyterHub REST API for trying the
+// jupyterhub workload backend locally:
+//
+//	go run ./cmd/hubstub -addr :8081
+//	JUPYTERHUB_API_URL=http://localhost:8081/hub/api nbswitch to-gpu alice
+//
+// with workloadBackend: jupyterhub in the namespace's gpu-switcher-config.
+// Servers become ready -spawn-delay after being started.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type server struct {
+	Name        string         `json:"name"`
+	Ready       bool           `json:"ready"`
+	Pending     any            `json:"pending"`
+	URL         string         `json:"url"`
+	UserOptions map[string]any `json:"user_options"`
+}
+
+type user struct {
+	Name    string             `json:"name"`
+	Servers map[string]*server `json:"servers"`
+}
+
+type hub struct {
+	mu         sync.Mutex
+	users      map[string]*user
+	spawnDelay time.Duration
+}
+
+func (h *hub) user(name string) *user {
+	u, ok := h.users[name]
+	if !ok {
+		u = &user{Name: name, Servers: map[string]*server{}}
+		h.users[name] = u
+	}
+	return u
+}
+
+func (h *hub) getUser(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeJSON(w, http.StatusOK, h.user(r.PathValue("name")))
+}
+
+func (h *hub) listUsers(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := []*user{}
+	for _, u := range h.users {
+		if r.URL.Query().Get("state") != "active" || len(u.Servers) > 0 {
+			out = append(out, u)
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (h *hub) start(w http.ResponseWriter, r *http.Request) {
+	name, srv := r.PathValue("name"), r.PathValue("server")
+	options := map[string]any{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	u := h.user(name)
+	if _, running := u.Servers[srv]; running {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": name + " is already running"})
+		return
+	}
+	url := "/user/" + name + "/"
+	if srv != "" {
+		url += srv + "/"
+	}
+	s := &server{Name: srv, Pending: "spawn", URL: url, UserOptions: options}
+	u.Servers[srv] = s
+	log.Printf("starting %s/%s with %v", name, srv, options)
+	time.AfterFunc(h.spawnDelay, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if u.Servers[srv] == s {
+			s.Ready, s.Pending = true, nil
+		}
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *hub) stop(w http.ResponseWriter, r *http.Request) {
+	name, srv := r.PathValue("name"), r.PathValue("server")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	u := h.user(name)
+	// Like the Hub, stopping a stopped server succeeds.
+	delete(u.Servers, srv)
+	log.Printf("stopped %s/%s", name, srv)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func main() {
+	addr := flag.String("addr", ":8081", "listen address")
+	spawnDelay := flag.Duration("spawn-delay", 3*time.Second, "time until a started server is ready")
+	token := flag.String("token", "", "API token to require (default: none)")
+	flag.Parse()
+
+	h := &hub{users: map[string]*user{}, spawnDelay: *spawnDelay}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /hub/api/users", h.listUsers)
+	mux.HandleFunc("GET /hub/api/users/{name}", h.getUser)
+	mux.HandleFunc("POST /hub/api/users/{name}/server", h.start)
+	mux.HandleFunc("DELETE /hub/api/users/{name}/server", h.stop)
+	mux.HandleFunc("POST /hub/api/users/{name}/servers/{server}", h.start)
+	mux.HandleFunc("DELETE /hub/api/users/{name}/servers/{server}", h.stop)
+
+	handler := http.Handler(mux)
+	if *token != "" {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.TrimPrefix(r.Header.Get("Authorization"), "token ") != *token {
+				writeJSON(w, http.StatusForbidden, map[string]string{"message": "invalid token"})
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
+	}
+	log.Printf("Stub JupyterHub API on %s/hub/api", *addr)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
@@ -1,108 +1,140 @@
 package main
 
 import (
+	"backend-handler/api"
+	nbpods "backend-handler/get-nbpods-name"
+	reclaimer "backend-handler/idle-reclaimer"
+	"backend-handler/migration"
+	"backend-handler/notebook"
 	switcher "backend-handler/notebook-switcher"
+	"backend-handler/tracing"
+	"context"
 	"encoding/json"
-	"fmt"
+	"flag"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
-	"path"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Message represents the expected JSON payload
-// Adjust fields according to the message structure from the other application.
-type Message struct {
-	NotifyGPUNeeded   string `json:"NotifyGPUNeeded"`
-	NotifyGPUReleased string `json:"NotifyGPUReleased"`
-	PodName           string `json:"PodName"`
-	PodNamespace      string `json:"PodNamespace"`
-}
+// messageHandler serves POST /messages of the front-end. Its switches run
+// through mg like those of /migrations, so that they wait in the GPU queue
+// the same way. It answers once they are done, or with 202 and the queue
+// status once they are queued; the front-end then watches them through
+// /migrations/{id}.
+func messageHandler(mg *migration.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// CORS headers
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
-func RealName(s string) string {
-	i := strings.LastIndex(s, "-")
-	if i <= 0 { // không có '-' hoặc '-' đứng đầu
-		return s
-	}
-	return s[:i]
-}
-
-func messageHandler(w http.ResponseWriter, r *http.Request) {
-	// CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		// Handle preflight request
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 
-	// Handle preflight request
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("Only POST method is allowed"))
+			return
+		}
 
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("Only POST method is allowed"))
-		return
-	}
+		// Ensure the body is closed after reading
+		defer r.Body.Close()
 
-	// Ensure the body is closed after reading
-	defer r.Body.Close()
+		// Read the request body
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("Error reading body: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-	// Read the request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading body: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
+		// Parse JSON payload into Message struct
+		var msg api.Message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			log.Printf("Error unmarshaling JSON: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid JSON payload"))
+			return
+		}
 
-	// Parse JSON payload into Message struct
-	var msg Message
-	if err := json.Unmarshal(body, &msg); err != nil {
-		log.Printf("Error unmarshaling JSON: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid JSON payload"))
-		return
-	}
+		// Process Notebook
+		NotebookName := switcher.NotebookOfPod(msg.PodName)
+		if msg.NotebookName != "" {
+			NotebookName = msg.NotebookName
+		}
+		var response api.MessageResponse
 
-	// Process Notebook
-	NotebookName := RealName(msg.PodName)
-	response := map[string]string{}
+		// The switch goes on when the front-end closes the dialog; only the
+		// wait for it ends.
+		ctx := r.Context()
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("notebook.name", NotebookName),
+			attribute.String("notebook.namespace", msg.PodNamespace),
+			attribute.String("notify.gpu_needed", msg.NotifyGPUNeeded),
+			attribute.String("notify.gpu_released", msg.NotifyGPUReleased),
+		)
 
-	if msg.NotifyGPUNeeded == "true" {
-		NewNotebookPodName, err := switcher.SwitcherToGPU(NotebookName, msg.PodNamespace)
-		if err != nil {
-			log.Printf("%v", err)
+		if msg.NotifyGPUNeeded == "true" {
+			m, err := startAndWait(ctx, mg, api.MigrationRequest{Namespace: msg.PodNamespace, Notebook: NotebookName, Direction: api.DirectionToGPU, Profile: msg.Profile, Path: msg.DocumentPath})
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if !m.Done() {
+				accepted(w, msg.PodNamespace, m)
+				return
+			}
+			if m.Code == api.CodePolicyDenied {
+				log.Printf("%s", m.Error)
+				writeJSON(w, http.StatusForbidden, api.MessageResponse{Status: "denied", PodNamespace: msg.PodNamespace, Error: m.Error, Code: api.CodePolicyDenied})
+				return
+			}
+			if failed(w, m) {
+				return
+			}
+			NewNotebookName, newURL := m.NewNotebook, m.URL
+			// Send a response back
+			response = api.MessageResponse{Status: "received", PodNamespace: msg.PodNamespace, NewNBName: NewNotebookName, NewURL: newURL}
+			// Process the message (for now, just log it)
+			log.Printf("Received message: NotifyGPUNeeded=%v, namespace=%v, newNBName=%v, newURL=%v", msg.NotifyGPUNeeded, msg.PodNamespace, NewNotebookName, newURL)
 		}
-		NewNotebookName := RealName(NewNotebookPodName)
-		ns := url.PathEscape(msg.PodNamespace)
-		nb := url.PathEscape(NewNotebookName)
-		newURL := fmt.Sprintf("/notebook/%s/%s/", ns, nb)
-		// Send a response back
-		response = map[string]string{"status": "received", "podNamespace": msg.PodNamespace, "newNBName": NewNotebookName, "newURL": newURL}
-		// Process the message (for now, just log it)
-		log.Printf("Received message: NotifyGPUNeeded=%v, namespace=%v, newNBName=%v, newURL=%v", msg.NotifyGPUNeeded, msg.PodNamespace, NewNotebookName, newURL)
-	}
 
-	if msg.NotifyGPUReleased == "true" {
-		NewNotebookPodName, err := switcher.SwitcherToCPU(NotebookName, msg.PodNamespace)
-		if err != nil {
-			log.Printf("%v", err)
+		if msg.NotifyGPUReleased == "true" {
+			m, err := startAndWait(ctx, mg, api.MigrationRequest{Namespace: msg.PodNamespace, Notebook: NotebookName, Direction: api.DirectionToCPU, Path: msg.DocumentPath})
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if !m.Done() {
+				accepted(w, msg.PodNamespace, m)
+				return
+			}
+			if failed(w, m) {
+				return
+			}
+			NewNotebookName, newURL := m.NewNotebook, m.URL
+			// Send a response back
+			response = api.MessageResponse{Status: "received", PodNamespace: msg.PodNamespace, NewNBName: NewNotebookName, NewURL: newURL}
+			// Process the message (for now, just log it)
+			log.Printf("Received message: NotifyGPUReleased=%v, namespace=%v, newNBName=%v, newURL=%v", msg.NotifyGPUReleased, msg.PodNamespace, NewNotebookName, newURL)
 		}
-		NewNotebookName := RealName(NewNotebookPodName)
-		ns := url.PathEscape(msg.PodNamespace)
-		nb := url.PathEscape(NewNotebookName)
-		p := path.Join("/notebook", ns, nb)       // standardize '/'
-		newURL := strings.TrimRight(p, "/") + "/" // ensure exactly 1 '/'
-		// Send a response back
-		response = map[string]string{"status": "received", "podNamespace": msg.PodNamespace, "newNBName": NewNotebookName, "newURL": newURL}
-		// Process the message (for now, just log it)
-		log.Printf("Received message: NotifyGPUReleased=%v, namespace=%v, newNBName=%v, newURL=%v", msg.NotifyGPUReleased, msg.PodNamespace, NewNotebookName, newURL)
+
+		writeJSON(w, http.StatusOK, response)
 	}
+}
 
-	respBytes, err := json.Marshal(response)
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	respBytes, err := json.Marshal(v)
 	if err != nil {
 		log.Printf("Error marshaling response: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -110,18 +142,136 @@ func messageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	w.Write(respBytes)
-
 }
 
 func main() {
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP traces endpoint, e.g. http://otel-collector:4318 (default: OTEL_EXPORTER_OTLP_ENDPOINT, tracing disabled if unset)")
+	idleReclaim := flag.Bool("idle-reclaim", envBool("IDLE_RECLAIM", false), "migrate idle GPU notebooks back to CPU in the background (env IDLE_RECLAIM)")
+	idleTimeout := flag.Duration("idle-timeout", envDuration("IDLE_TIMEOUT", 30*time.Minute), "how long a GPU notebook may stay idle before it is migrated to CPU (env IDLE_TIMEOUT)")
+	idleInterval := flag.Duration("idle-reclaim-interval", envDuration("IDLE_RECLAIM_INTERVAL", time.Minute), "how often GPU notebooks are checked for idleness (env IDLE_RECLAIM_INTERVAL)")
+	idleSource := flag.String("idle-source", envString("IDLE_SOURCE", "jupyter"), "idle signal: jupyter (kernel activity), dcgm (GPU utilisation from Prometheus) or both (env IDLE_SOURCE)")
+	jupyterURL := flag.String("jupyter-url-template", envString(switcher.EnvJupyterURL, reclaimer.DefaultJupyterURLTemplate), "Jupyter server base URL of a notebook; {name} and {namespace} are substituted (env JUPYTER_URL_TEMPLATE)")
+	prometheusURL := flag.String("prometheus-url", envString("PROMETHEUS_URL", ""), "Prometheus-compatible endpoint with DCGM exporter metrics (env PROMETHEUS_URL)")
+	utilThreshold := flag.Float64("gpu-util-threshold", envFloat("GPU_UTIL_THRESHOLD", 5), "GPU utilisation (%) below which a GPU counts as idle (env GPU_UTIL_THRESHOLD)")
+	memThreshold := flag.Float64("gpu-memory-threshold-mib", envFloat("GPU_MEMORY_THRESHOLD_MIB", 0), "GPU memory used (MiB) from which a GPU counts as busy; 0 ignores memory (env GPU_MEMORY_THRESHOLD_MIB)")
+	gpuWindow := flag.Duration("gpu-idle-window", envDuration("GPU_IDLE_WINDOW", 0), "lookback window for GPU utilisation, at least -idle-timeout; defaults to it (env GPU_IDLE_WINDOW)")
+	reconcile := flag.Bool("reconcile", envBool("RECONCILE", true), "stop surplus running notebooks of families left by interrupted migrations, at startup and periodically (env RECONCILE)")
+	reconcileInterval := flag.Duration("reconcile-interval", envDuration("RECONCILE_INTERVAL", 5*time.Minute), "how often notebook families are reconciled (env RECONCILE_INTERVAL)")
+	reconcileGrace := flag.Duration("reconcile-grace", envDuration("RECONCILE_GRACE", 15*time.Minute), "minimum age of notebooks before their family is reconciled, leaving running migrations time to finish (env RECONCILE_GRACE)")
+	reconcileStale := flag.Duration("reconcile-stale", envDuration("RECONCILE_STALE", time.Hour), "age after which the marker of a migration in progress no longer keeps its family from being reconciled, e.g. after a crash (env RECONCILE_STALE)")
+	apiTimeout := flag.Duration("api-timeout", envDuration("API_TIMEOUT", switcher.DefaultGPUTimeouts.API), "bound of the Kubernetes API calls creating a notebook (env API_TIMEOUT)")
+	podReadyTimeout := flag.Duration("pod-ready-timeout", envDuration("POD_READY_TIMEOUT", switcher.DefaultGPUTimeouts.PodReady), "how long to wait for the new notebook pod to become ready (env POD_READY_TIMEOUT)")
+	drainDelay := flag.Duration("drain-delay", envDuration("DRAIN_DELAY", switcher.DefaultGPUTimeouts.Drain), "delay before the old notebook is deleted when switching to GPU (env DRAIN_DELAY)")
+	cpuDrainDelay := flag.Duration("cpu-drain-delay", envDuration("CPU_DRAIN_DELAY", switcher.DefaultCPUTimeouts.Drain), "delay before the old notebook is deleted when switching to CPU (env CPU_DRAIN_DELAY)")
+	deleteTimeout := flag.Duration("delete-timeout", envDuration("DELETE_TIMEOUT", switcher.DefaultGPUTimeouts.Delete), "bound of deleting the old notebook, including -await-deletion (env DELETE_TIMEOUT)")
+	transferTimeout := flag.Duration("transfer-timeout", envDuration("TRANSFER_TIMEOUT", switcher.DefaultGPUTimeouts.Transfer), "bound of copying the transfer paths from the old pod to the new one (env TRANSFER_TIMEOUT)")
+	awaitDeletion := flag.Bool("await-deletion", envBool("AWAIT_DELETION", false), "report a switch done only once the old notebook and its pod are deleted (env AWAIT_DELETION)")
+	operatorToken := flag.String("operator-token", envString("OPERATOR_TOKEN", ""), "bearer token operators send to POST /release-idle; unset disables it (env OPERATOR_TOKEN)")
+	gpuQueue := flag.Bool("gpu-queue", envBool("GPU_QUEUE", true), "queue migrations to GPU while the cluster lacks free GPUs, starting them as GPUs free up (env GPU_QUEUE)")
+	queueInterval := flag.Duration("gpu-queue-interval", envDuration("GPU_QUEUE_INTERVAL", 30*time.Second), "how often the first queued migration of each GPU resource checks for free GPUs (env GPU_QUEUE_INTERVAL)")
+	queueTimeout := flag.Duration("gpu-queue-timeout", envDuration("GPU_QUEUE_TIMEOUT", 2*time.Hour), "fail migrations queued for longer; 0 waits forever (env GPU_QUEUE_TIMEOUT)")
+	webhookEnabled := flag.Bool("webhook", envBool("WEBHOOK", false), "serve the Notebook admission webhook (env WEBHOOK)")
+	webhookAddr := flag.String("webhook-addr", envString("WEBHOOK_ADDR", ":8443"), "listen address of the admission webhook (env WEBHOOK_ADDR)")
+	webhookCert := flag.String("webhook-cert", envString("WEBHOOK_CERT", "/etc/webhook/certs/tls.crt"), "TLS certificate of the admission webhook (env WEBHOOK_CERT)")
+	webhookKey := flag.String("webhook-key", envString("WEBHOOK_KEY", "/etc/webhook/certs/tls.key"), "TLS key of the admission webhook (env WEBHOOK_KEY)")
+	webhookGPUKeys := flag.String("webhook-gpu-keys", envString("WEBHOOK_GPU_KEYS", "nvidia.com/gpu"), "comma-separated GPU resource keys the admission webhook always enforces, on top of those of the namespace profiles (env WEBHOOK_GPU_KEYS)")
+	webhookTrusted := flag.String("webhook-trusted-users", envString("WEBHOOK_TRUSTED_USERS", ""), "comma-separated users allowed to create switcher-managed GPU Notebooks, e.g. system:serviceaccount:default:superuser-sa; required with -webhook (env WEBHOOK_TRUSTED_USERS)")
+	flag.Parse()
+
+	// Namespaces and profiles of the ConfigMap may override these
+	switcher.DefaultGPUTimeouts = switcher.Timeouts{API: *apiTimeout, PodReady: *podReadyTimeout, Drain: *drainDelay, Delete: *deleteTimeout, Transfer: *transferTimeout, AwaitDeletion: *awaitDeletion}
+	switcher.DefaultCPUTimeouts = switcher.DefaultGPUTimeouts
+	switcher.DefaultCPUTimeouts.Drain = *cpuDrainDelay
+	nbpods.DefaultFindTimeout = *podReadyTimeout
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Init(ctx, *otlpEndpoint)
+	if err != nil {
+		log.Printf("Tracing disabled: %v", err)
+	}
+	defer func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			log.Printf("Error flushing traces: %v", err)
+		}
+	}()
+
+	if v, err := switcher.DiscoverNotebookVersion(); err != nil {
+		log.Printf("Notebook API version discovery failed, using %s: %v", notebook.GVR().Version, err)
+	} else {
+		log.Printf("Using Notebook API %s/%s", notebook.Group, v)
+	}
+
+	reclaim := reclaimOptions{
+		idleTimeout:     *idleTimeout,
+		interval:        *idleInterval,
+		source:          *idleSource,
+		jupyterURL:      *jupyterURL,
+		prometheusURL:   *prometheusURL,
+		utilThreshold:   *utilThreshold,
+		memThresholdMiB: *memThreshold,
+		gpuWindow:       *gpuWindow,
+	}
+	if *idleReclaim {
+		if err := startReclaimer(ctx, reclaim); err != nil {
+			log.Fatalf("Idle reclaimer: %v", err)
+		}
+	}
+
+	if *webhookEnabled {
+		if err := startWebhook(ctx, *webhookAddr, *webhookCert, *webhookKey, *webhookTrusted, *webhookGPUKeys); err != nil {
+			log.Fatalf("Admission webhook: %v", err)
+		}
+	}
+
+	migrations := migration.NewManager(runMigration, func(err error) string {
+		_, code := errorCode(err)
+		return code
+	})
+	if err := sharedStores(migrations, *gpuQueue); err != nil {
+		log.Fatalf("Migration stores: %v", err)
+	}
+	if *gpuQueue {
+		migrations.Gate = gpuGate
+		migrations.QueueInterval = *queueInterval
+		migrations.QueueTimeout = *queueTimeout
+	}
+
 	// Register the handler for /messages endpoint
-	http.HandleFunc("/messages", messageHandler)
+	mux := http.NewServeMux()
+	mux.Handle("/messages", tracing.Handler(messageHandler(migrations), "messages"))
+	mux.Handle("/status", tracing.Handler(statusHandler(migrations), "status"))
+	mux.Handle("/history", tracing.Handler(http.HandlerFunc(historyHandler), "history"))
+	mux.Handle("/profiles", tracing.Handler(http.HandlerFunc(profilesHandler), "profiles"))
+	mux.Handle("/preflight", tracing.Handler(http.HandlerFunc(preflightHandler), "preflight"))
+	mux.Handle("/release-idle", tracing.Handler(releaseIdleHandler(reclaim, *operatorToken, migrations), "release-idle"))
+
+	if *reconcile {
+		if err := startReconciler(ctx, *reconcileInterval, *reconcileGrace, *reconcileStale, reclaim, migrations.InProgress); err != nil {
+			log.Fatalf("Family reconciler: %v", err)
+		}
+	}
+	mux.Handle("/migrations", tracing.Handler(migrationsHandler(migrations), "migrations"))
+	mux.Handle("/migrations/{id}", tracing.Handler(migrationHandler(migrations), "migration"))
+	mux.Handle("/open/{namespace}/{name}", tracing.Handler(http.HandlerFunc(openHandler), "open"))
+	mux.Handle("/open/{namespace}/{name}/{path...}", tracing.Handler(http.HandlerFunc(openHandler), "open"))
 
 	// Start the HTTP server on port 8080
+	srv := &http.Server{Addr: ":8080", Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
 	log.Println("Starting server on :8080, listening for POST messages at /messages")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"backend-handler/api"
+	"backend-handler/migration"
+	switcher "backend-handler/notebook-switcher"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Asynchronous migrations, used by package client:
+//
+//	POST   /migrations                          start one (202 + api.Migration)
+//	GET    /migrations?namespace=&notebook=     list known migrations
+//	GET    /migrations/{id}[?watch=<version>]   get one; with watch, long-poll for a change
+//	DELETE /migrations/{id}                     cancel one
+//
+// A migration runs on the replica that started it, but the replicas share
+// the migrations and the GPU queue they wait in (see sharedStores), so any
+// of them serves these requests.
+
+// The ConfigMaps, in the namespace of the backend, the replicas share the
+// migrations and the GPU queue in.
+const (
+	migrationsConfigMapName = "gpu-switcher-migrations"
+	queueConfigMapName      = "gpu-switcher-queue"
+)
+
+// maxWatch bounds how long GET /migrations/{id}?watch= blocks.
+const maxWatch = 30 * time.Second
+
+// runMigration is the migration.Runner of the server: it calls the switcher.
+func runMigration(ctx context.Context, req api.MigrationRequest, progress func(step string)) (string, string, error) {
+	return switcher.Migrate(switcher.WithProgress(ctx, progress), req)
+}
+
+// sharedStores makes mg keep its migrations, and with queue its GPU queue,
+// in ConfigMaps shared by the replicas.
+func sharedStores(mg *migration.Manager, queue bool) error {
+	cfg, err := switcher.BuildConfig()
+	if err != nil {
+		return fmt.Errorf("build kube config: %w", err)
+	}
+	cs, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("k8s clientset: %w", err)
+	}
+	ns := envString("POD_NAMESPACE", "default")
+	mg.Migrations = &migration.ConfigMapMigrationStore{Clientset: cs, Namespace: ns, Name: migrationsConfigMapName}
+	if queue {
+		mg.Queue = &migration.ConfigMapStore{Clientset: cs, Namespace: ns, Name: queueConfigMapName}
+	}
+	return nil
+}
+
+// startAndWait starts req with mg and waits until it is done or queued, or
+// ctx ends. The migration goes on in the background meanwhile.
+func startAndWait(ctx context.Context, mg *migration.Manager, req api.MigrationRequest) (api.Migration, error) {
+	m, err := mg.Start(ctx, req)
+	for err == nil && !m.Done() && m.State != api.StateQueued && ctx.Err() == nil {
+		m, err = mg.Wait(ctx, m.ID, m.Version)
+	}
+	return m, err
+}
+
+// accepted answers /messages with 202 for migration m, which is not done
+// yet: "queued" with its queue status, else "accepted".
+func accepted(w http.ResponseWriter, namespace string, m api.Migration) {
+	status := "accepted"
+	if m.State == api.StateQueued {
+		status = "queued"
+	}
+	w.Header().Set("Location", "/migrations/"+m.ID)
+	writeJSON(w, http.StatusAccepted, api.MessageResponse{Status: status, PodNamespace: namespace, MigrationID: m.ID, Version: m.Version, Queue: m.Queue})
+}
+
+// failed answers the error of migration m if it did not get as far as a new
+// notebook and reports whether it did. Later failures (e.g. deleting the old
+// notebook) are only logged.
+func failed(w http.ResponseWriter, m api.Migration) bool {
+	if m.Error == "" {
+		return false
+	}
+	log.Printf("Migration %s of %s/%s: %s", m.ID, m.Namespace, m.Notebook, m.Error)
+	if m.NewNotebook != "" && m.State == api.StateFailed {
+		return false
+	}
+	code := m.Code
+	if code == "" {
+		code = api.CodeInternal
+	}
+	writeJSON(w, codeStatus(code), api.ErrorResponse{Error: m.Error, Code: code})
+	return true
+}
+
+// gpuGate is the migration.Gate of the server: migrations to GPU wait in the
+// queue of their GPU resource while the capacity pre-flight check fails. Its
+// "unknown" result, e.g. without the RBAC to list nodes, admits them.
+func gpuGate(ctx context.Context, req api.MigrationRequest) (migration.Admission, error) {
+	rep, err := switcher.Preflight(ctx, req.Namespace, req.Notebook, req.Profile, api.CheckCapacity)
+	if err != nil {
+		return migration.Admission{}, err
+	}
+	adm := migration.Admission{OK: true, Pool: rep.ResourceKey}
+	if c := rep.Check(api.CheckCapacity); c != nil && c.Result == api.CheckFailed {
+		adm.OK, adm.Reason = false, c.Message
+	}
+	return adm, nil
+}
+
+// migrationsHandler serves POST and GET /migrations.
+func migrationsHandler(mg *migration.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setCORS(w)
+		switch r.Method {
+		case http.MethodOptions:
+			w.WriteHeader(http.StatusOK)
+
+		case http.MethodGet:
+			q := r.URL.Query()
+			list, err := mg.List(r.Context(), q.Get("namespace"), q.Get("notebook"))
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, list)
+
+		case http.MethodPost:
+			var req api.MigrationRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				badRequest(w, "invalid JSON payload: "+err.Error())
+				return
+			}
+			if req.Namespace == "" || req.Notebook == "" {
+				badRequest(w, "namespace and notebook are required")
+				return
+			}
+			if req.Direction != api.DirectionToGPU && req.Direction != api.DirectionToCPU {
+				badRequest(w, "direction must be "+api.DirectionToGPU+" or "+api.DirectionToCPU)
+				return
+			}
+			trace.SpanFromContext(r.Context()).SetAttributes(
+				attribute.String("notebook.name", req.Notebook),
+				attribute.String("notebook.namespace", req.Namespace),
+				attribute.String("migration.direction", req.Direction),
+			)
+			m, err := mg.Start(r.Context(), req)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			w.Header().Set("Location", "/migrations/"+m.ID)
+			writeJSON(w, http.StatusAccepted, m)
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("Only GET and POST methods are allowed"))
+		}
+	}
+}
+
+// migrationHandler serves GET and DELETE /migrations/{id}.
+func migrationHandler(mg *migration.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setCORS(w)
+		id := r.PathValue("id")
+		var m api.Migration
+		var err error
+		switch r.Method {
+		case http.MethodOptions:
+			w.WriteHeader(http.StatusOK)
+			return
+
+		case http.MethodGet:
+			watch := r.URL.Query().Get("watch")
+			if watch == "" {
+				m, err = mg.Get(r.Context(), id)
+				break
+			}
+			version, convErr := strconv.Atoi(watch)
+			if convErr != nil {
+				badRequest(w, "watch must be a migration version")
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), maxWatch)
+			defer cancel()
+			m, err = mg.Wait(ctx, id, version)
+
+		case http.MethodDelete:
+			m, err = mg.Cancel(r.Context(), id)
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("Only GET and DELETE methods are allowed"))
+			return
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, m)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"backend-handler/api"
+	reclaimer "backend-handler/idle-reclaimer"
+	switcher "backend-handler/notebook-switcher"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// directBackend runs the switcher in-process against the kubeconfig cluster.
+type directBackend struct{}
+
+func (directBackend) ToGPU(ctx context.Context, namespace, notebook, profile string) (*migrationResult, error) {
+	return migrate(ctx, api.MigrationRequest{Namespace: namespace, Notebook: notebook, Direction: api.DirectionToGPU, Profile: profile})
+}
+
+func (directBackend) ToCPU(ctx context.Context, namespace, notebook string) (*migrationResult, error) {
+	return migrate(ctx, api.MigrationRequest{Namespace: namespace, Notebook: notebook, Direction: api.DirectionToCPU})
+}
+
+func migrate(ctx context.Context, req api.MigrationRequest) (*migrationResult, error) {
+	name, u, err := switcher.Migrate(ctx, req)
+	if name == "" {
+		return nil, err
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+	}
+	return &migrationResult{Namespace: req.Namespace, Notebook: name, URL: u}, nil
+}
+
+func (directBackend) Status(ctx context.Context, namespace, notebook string) (any, error) {
+	return switcher.GetStatus(ctx, namespace, notebook)
+}
+
+func (directBackend) History(ctx context.Context, namespace, notebook string) (any, error) {
+	return switcher.GetHistory(ctx, namespace, notebook)
+}
+
+func (directBackend) Profiles(ctx context.Context, namespace string) (any, error) {
+	return switcher.GetConfig(ctx, namespace)
+}
+
+func (directBackend) Preflight(ctx context.Context, namespace, notebook, profile string) (*api.PreflightReport, error) {
+	return switcher.Preflight(ctx, namespace, notebook, profile)
+}
+
+// defaultIdleTimeout is the idle timeout of release-idle without -server,
+// like the backend's default.
+const defaultIdleTimeout = 30 * time.Minute
+
+// ReleaseIdle runs one reclaim pass using kernel activity. The Jupyter servers
+// must be reachable from here (JUPYTER_URL_TEMPLATE), e.g. through a port-forward
+// or when running inside the cluster.
+func (directBackend) ReleaseIdle(ctx context.Context, namespace string, idleTimeout time.Duration) ([]string, error) {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	cfg, err := switcher.BuildConfig()
+	if err != nil {
+		return nil, fmt.Errorf("build kube config: %w", err)
+	}
+	dc, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("dynamic client: %w", err)
+	}
+	cs, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("k8s clientset: %w", err)
+	}
+	r := &reclaimer.Reclaimer{
+		Dynamic:   dc,
+		Clientset: cs,
+		Source: &reclaimer.JupyterActivity{
+			URLTemplate: os.Getenv("JUPYTER_URL_TEMPLATE"),
+			Token:       os.Getenv("JUPYTER_TOKEN"),
+			Client:      &http.Client{Timeout: 10 * time.Second},
+		},
+		IdleTimeout: idleTimeout,
+		Namespace:   namespace,
+	}
+	return r.ReconcileOnce(ctx)
+}
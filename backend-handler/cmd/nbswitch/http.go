@@ -0,0 +1,82 @@
+package main
+
+import (
+	"backend-handler/api"
+	"backend-handler/client"
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// httpBackend talks to the backend-handler HTTP API through package client.
+type httpBackend struct {
+	c *client.Client
+}
+
+func (h *httpBackend) ToGPU(ctx context.Context, namespace, notebook, profile string) (*migrationResult, error) {
+	return h.migrate(ctx, api.MigrationRequest{Namespace: namespace, Notebook: notebook, Direction: api.DirectionToGPU, Profile: profile})
+}
+
+func (h *httpBackend) ToCPU(ctx context.Context, namespace, notebook string) (*migrationResult, error) {
+	return h.migrate(ctx, api.MigrationRequest{Namespace: namespace, Notebook: notebook, Direction: api.DirectionToCPU})
+}
+
+// migrate starts an asynchronous migration, prints its steps to stderr and
+// cancels it on the server when ctx ends (Ctrl-C).
+func (h *httpBackend) migrate(ctx context.Context, req api.MigrationRequest) (*migrationResult, error) {
+	started, err := h.c.StartMigration(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	m, err := h.c.WatchMigration(ctx, started.ID, func(m *api.Migration) {
+		switch {
+		case m.Queue != nil:
+			fmt.Fprintf(os.Stderr, "queued for %s, position %d", m.Queue.Pool, m.Queue.Position)
+			if m.Queue.ETA != nil {
+				fmt.Fprintf(os.Stderr, ", expected at %s", m.Queue.ETA.Local().Format(time.Kitchen))
+			}
+			fmt.Fprintln(os.Stderr)
+		case m.Step != "":
+			fmt.Fprintf(os.Stderr, "%s...\n", m.Step)
+		}
+	})
+	if ctx.Err() != nil {
+		cancelCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		h.c.CancelMigration(cancelCtx, started.ID)
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.State != api.StateSucceeded {
+		if m.NewNotebook == "" {
+			return nil, fmt.Errorf("migration %s %s: %s", m.ID, m.State, m.Error)
+		}
+		fmt.Fprintln(os.Stderr, "warning:", m.Error)
+	}
+	return &migrationResult{Namespace: m.Namespace, Notebook: m.NewNotebook, URL: m.URL}, nil
+}
+
+func (h *httpBackend) Status(ctx context.Context, namespace, notebook string) (any, error) {
+	return h.c.Status(ctx, namespace, notebook)
+}
+
+func (h *httpBackend) History(ctx context.Context, namespace, notebook string) (any, error) {
+	return h.c.History(ctx, namespace, notebook)
+}
+
+func (h *httpBackend) Profiles(ctx context.Context, namespace string) (any, error) {
+	return h.c.Profiles(ctx, namespace)
+}
+
+func (h *httpBackend) Preflight(ctx context.Context, namespace, notebook, profile string) (*api.PreflightReport, error) {
+	return h.c.Preflight(ctx, namespace, notebook, profile)
+}
+
+// ReleaseIdle runs one reclaim pass on the server; an idleTimeout of 0
+// applies the server's.
+func (h *httpBackend) ReleaseIdle(ctx context.Context, namespace string, idleTimeout time.Duration) ([]string, error) {
+	return h.c.ReleaseIdle(ctx, namespace, idleTimeout)
+}
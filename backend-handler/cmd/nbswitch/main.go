@@ -0,0 +1,309 @@
+// Command nbswitch triggers and inspects CPU/GPU notebook migrations.
+//
+// It talks to the backend-handler HTTP API when -server (or NBSWITCH_SERVER)
+// is set, and otherwise drives the cluster directly through the kubeconfig
+// with the same switcher package the backend uses. Installed as
+// "kubectl-nbswitch" on the PATH it also works as "kubectl nbswitch".
+//
+//	nbswitch [-server URL] [-n namespace] [-o json] <command> [flags] [notebook]
+//
+// Commands: to-gpu, to-cpu, preflight, status, history, profiles, release-idle.
+package main
+
+import (
+	"backend-handler/api"
+	"backend-handler/client"
+	switcher "backend-handler/notebook-switcher"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+type globalFlags struct {
+	server     string
+	token      string
+	namespace  string
+	kubeconfig string
+	output     string
+}
+
+// backend is implemented by the HTTP API and by direct cluster access.
+type backend interface {
+	ToGPU(ctx context.Context, namespace, notebook, profile string) (*migrationResult, error)
+	ToCPU(ctx context.Context, namespace, notebook string) (*migrationResult, error)
+	Status(ctx context.Context, namespace, notebook string) (any, error)
+	History(ctx context.Context, namespace, notebook string) (any, error)
+	Profiles(ctx context.Context, namespace string) (any, error)
+	Preflight(ctx context.Context, namespace, notebook, profile string) (*api.PreflightReport, error)
+	ReleaseIdle(ctx context.Context, namespace string, idleTimeout time.Duration) ([]string, error)
+}
+
+type migrationResult struct {
+	Namespace string `json:"podNamespace"`
+	Notebook  string `json:"newNBName"`
+	URL       string `json:"newURL"`
+}
+
+const usage = `Usage: nbswitch [global flags] <command> [flags] [notebook]
+
+Commands:
+  to-gpu <notebook> [-profile name]   migrate a notebook to a GPU pod
+  to-cpu <notebook>                   migrate a notebook back to a CPU-only pod
+  preflight <notebook> [-profile name] check quota, free GPUs, volumes, images and policy before to-gpu
+  status <notebook>                   show mode, profile and pod state
+  history <notebook>                  show past migrations of the notebook
+  profiles                            list GPU profiles and the namespace policy
+  release-idle [-idle-timeout d]      migrate idle GPU notebooks of the namespace (-A: all) to CPU
+
+Global flags:
+`
+
+func main() {
+	var g globalFlags
+	fs := flag.NewFlagSet("nbswitch", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&g.server, "server", os.Getenv("NBSWITCH_SERVER"), "backend-handler base URL, e.g. http://switcher-svc.default (env NBSWITCH_SERVER); empty uses the cluster directly")
+	fs.StringVar(&g.token, "token", os.Getenv("NBSWITCH_TOKEN"), "operator token of the backend-handler, needed by release-idle with -server (env NBSWITCH_TOKEN)")
+	fs.StringVar(&g.namespace, "n", "", "namespace (default: namespace of the current kubeconfig context)")
+	fs.StringVar(&g.kubeconfig, "kubeconfig", "", "path to the kubeconfig file (default: KUBECONFIG or ~/.kube/config)")
+	fs.StringVar(&g.output, "o", "text", "output format: text or json")
+	fs.Parse(os.Args[1:])
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if g.kubeconfig != "" {
+		os.Setenv("KUBECONFIG", g.kubeconfig)
+	}
+	if g.namespace == "" {
+		g.namespace = currentNamespace()
+	}
+
+	var b backend = directBackend{}
+	if g.server == "" {
+		if _, err := switcher.DiscoverNotebookVersion(); err != nil {
+			fmt.Fprintln(os.Stderr, "warning:", err)
+		}
+	} else {
+		c := client.New(g.server)
+		c.Token = g.token
+		b = &httpBackend{c: c}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := run(ctx, b, g, fs.Arg(0), fs.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "nbswitch:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, b backend, g globalFlags, cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	profile := fs.String("profile", "", "GPU profile (to-gpu, preflight)")
+	idleTimeout := fs.Duration("idle-timeout", 0, "idle time after which a GPU notebook is released; default: the server's, or 30m without -server (release-idle)")
+	allNamespaces := fs.Bool("A", false, "all namespaces (release-idle)")
+	positional := parseInterleaved(fs, args)
+
+	notebook := func() (string, error) {
+		if len(positional) != 1 {
+			return "", fmt.Errorf("%s needs exactly one notebook name", cmd)
+		}
+		return positional[0], nil
+	}
+
+	switch cmd {
+	case "to-gpu", "to-cpu":
+		name, err := notebook()
+		if err != nil {
+			return err
+		}
+		var res *migrationResult
+		if cmd == "to-gpu" {
+			res, err = b.ToGPU(ctx, g.namespace, name, *profile)
+		} else {
+			res, err = b.ToCPU(ctx, g.namespace, name)
+		}
+		if err != nil {
+			return err
+		}
+		return output(g, res, func(w *tabwriter.Writer) {
+			fmt.Fprintf(w, "Migrated %s/%s to %s\n", g.namespace, name, res.Notebook)
+			if res.URL != "" {
+				fmt.Fprintf(w, "URL:\t%s\n", res.URL)
+			}
+		})
+
+	case "preflight":
+		name, err := notebook()
+		if err != nil {
+			return err
+		}
+		rep, err := b.Preflight(ctx, g.namespace, name, *profile)
+		if err != nil {
+			return err
+		}
+		err = output(g, rep, func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "CHECK\tRESULT\tMESSAGE")
+			for _, c := range rep.Checks {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, c.Result, c.Message)
+			}
+		})
+		if err == nil && !rep.Passed {
+			err = fmt.Errorf("pre-flight checks of %s/%s for profile %q failed", g.namespace, name, rep.Profile)
+		}
+		return err
+
+	case "status":
+		name, err := notebook()
+		if err != nil {
+			return err
+		}
+		st, err := b.Status(ctx, g.namespace, name)
+		if err != nil {
+			return err
+		}
+		return output(g, st, func(w *tabwriter.Writer) { printFields(w, st) })
+
+	case "history":
+		name, err := notebook()
+		if err != nil {
+			return err
+		}
+		h, err := b.History(ctx, g.namespace, name)
+		if err != nil {
+			return err
+		}
+		return output(g, h, func(w *tabwriter.Writer) {
+			var entries []map[string]any
+			remarshal(h, &entries)
+			fmt.Fprintln(w, "TIME\tMODE\tPROFILE\tFROM\tTO")
+			for _, e := range entries {
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", e["time"], e["mode"], valueOr(e["profile"], "-"), e["from"], e["to"])
+			}
+		})
+
+	case "profiles":
+		cfg, err := b.Profiles(ctx, g.namespace)
+		if err != nil {
+			return err
+		}
+		return output(g, cfg, func(w *tabwriter.Writer) {
+			var c struct {
+				Profiles map[string]map[string]any `json:"profiles"`
+				Policy   map[string]string         `json:"policy"`
+			}
+			remarshal(cfg, &c)
+			names := make([]string, 0, len(c.Profiles))
+			for name := range c.Profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			fmt.Fprintln(w, "PROFILE\tRESOURCE\tCOUNT\tRUNTIME CLASS")
+			for _, name := range names {
+				p := c.Profiles[name]
+				fmt.Fprintf(w, "%s\t%v\t%v\t%v\n", name, p["resourceKey"], p["count"], valueOr(p["runtimeClassName"], "-"))
+			}
+			if len(c.Policy) > 0 {
+				fmt.Fprintln(w, "\nPOLICY\tVALUE")
+				printFields(w, c.Policy)
+			}
+		})
+
+	case "release-idle":
+		ns := g.namespace
+		if *allNamespaces {
+			ns = ""
+		}
+		released, err := b.ReleaseIdle(ctx, ns, *idleTimeout)
+		if err != nil {
+			return err
+		}
+		return output(g, map[string][]string{"released": released}, func(w *tabwriter.Writer) {
+			if len(released) == 0 {
+				fmt.Fprintln(w, "No idle GPU notebooks.")
+			}
+			for _, nb := range released {
+				fmt.Fprintf(w, "Released %s\n", nb)
+			}
+		})
+	}
+	return fmt.Errorf("unknown command %q (see nbswitch -h)", cmd)
+}
+
+// parseInterleaved parses the flags of args into fs wherever they are, so
+// that both "to-gpu -profile a100 nb" and "to-gpu nb -profile a100" work,
+// and returns the other arguments.
+func parseInterleaved(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// output writes v as JSON with -o json, or through text otherwise.
+func output(g globalFlags, v any, text func(w *tabwriter.Writer)) error {
+	if g.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	text(w)
+	return w.Flush()
+}
+
+// printFields prints the JSON fields of v as "key:<tab>value" lines.
+func printFields(w *tabwriter.Writer, v any) {
+	var m map[string]any
+	remarshal(v, &m)
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s:\t%v\n", k, m[k])
+	}
+}
+
+// remarshal converts v into out through JSON, so both backends print alike.
+func remarshal(v, out any) {
+	b, _ := json.Marshal(v)
+	json.Unmarshal(b, out)
+}
+
+func valueOr(v any, def string) any {
+	if v == nil || v == "" {
+		return def
+	}
+	return v
+}
+
+// currentNamespace returns the namespace of the current kubeconfig context, or "default".
+func currentNamespace() string {
+	cfg := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{})
+	if ns, _, err := cfg.Namespace(); err == nil && ns != "" {
+		return ns
+	}
+	return "default"
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	reclaimer "backend-handler/idle-reclaimer"
+	switcher "backend-handler/notebook-switcher"
+	"backend-handler/tracing"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// reclaimLeaseName is the Lease used so that only one replica reclaims at a time.
+const reclaimLeaseName = "gpu-switcher-idle-reclaimer"
+
+// reclaimOptions configures the idle reclaimer from flags.
+type reclaimOptions struct {
+	idleTimeout time.Duration
+	interval    time.Duration
+	// source is "jupyter" (kernel activity), "dcgm" (GPU utilisation) or "both".
+	source     string
+	jupyterURL string
+
+	prometheusURL   string
+	utilThreshold   float64
+	memThresholdMiB float64
+	gpuWindow       time.Duration
+}
+
+// activitySource builds the idle-detection source selected by o.source.
+func (o reclaimOptions) activitySource() (reclaimer.ActivitySource, error) {
+	client := &http.Client{Timeout: 10 * time.Second, Transport: tracing.WrapTransport(http.DefaultTransport)}
+	jupyter := &reclaimer.JupyterActivity{
+		URLTemplate: o.jupyterURL,
+		Token:       os.Getenv(switcher.EnvJupyterToken),
+		Client:      client,
+	}
+	var dcgm *reclaimer.PrometheusActivity
+	if o.source == "dcgm" || o.source == "both" {
+		if o.prometheusURL == "" {
+			return nil, fmt.Errorf("idle source %q needs a Prometheus URL", o.source)
+		}
+		window := o.gpuWindow
+		if window <= 0 {
+			window = o.idleTimeout
+		}
+		if window < o.idleTimeout {
+			// idle times are capped at the window: no notebook would ever be reclaimed
+			return nil, fmt.Errorf("GPU idle window %v is shorter than the idle timeout %v", window, o.idleTimeout)
+		}
+		dcgm = &reclaimer.PrometheusActivity{
+			URL:                o.prometheusURL,
+			Window:             window,
+			UtilThreshold:      o.utilThreshold,
+			MemoryThresholdMiB: o.memThresholdMiB,
+			PodLabel:           envString("DCGM_POD_LABEL", "pod"),
+			NamespaceLabel:     envString("DCGM_NAMESPACE_LABEL", "namespace"),
+			Client:             client,
+		}
+	}
+
+	switch o.source {
+	case "", "jupyter":
+		return jupyter, nil
+	case "dcgm":
+		return dcgm, nil
+	case "both":
+		return reclaimer.AllIdle{jupyter, dcgm}, nil
+	}
+	return nil, fmt.Errorf("unknown idle source %q (want jupyter, dcgm or both)", o.source)
+}
+
+// newReclaimer builds a reclaimer from o.
+func newReclaimer(o reclaimOptions) (*reclaimer.Reclaimer, error) {
+	src, err := o.activitySource()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := switcher.BuildConfig()
+	if err != nil {
+		return nil, fmt.Errorf("build kube config: %w", err)
+	}
+	dc, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("dynamic client: %w", err)
+	}
+	cs, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("k8s clientset: %w", err)
+	}
+
+	return &reclaimer.Reclaimer{
+		Dynamic:     dc,
+		Clientset:   cs,
+		Source:      src,
+		IdleTimeout: o.idleTimeout,
+		Interval:    o.interval,
+	}, nil
+}
+
+// startReclaimer runs the idle reclaimer in the background for as long as this
+// replica holds the reclaimer lease.
+func startReclaimer(ctx context.Context, o reclaimOptions) error {
+	r, err := newReclaimer(o)
+	if err != nil {
+		return err
+	}
+	return runLeading(ctx, r.Clientset, reclaimLeaseName, "Idle reclaimer", r.Run)
+}
+
+// runLeading runs run in the background whenever this replica holds Lease
+// leaseName, so that only one replica runs it at a time.
+func runLeading(ctx context.Context, cs kubernetes.Interface, leaseName, what string, run func(ctx context.Context)) error {
+	id, _ := os.Hostname()
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: leaseName, Namespace: envString("POD_NAMESPACE", "default")},
+		Client:     cs.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: id},
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   30 * time.Second,
+		RenewDeadline:   20 * time.Second,
+		RetryPeriod:     5 * time.Second,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: run,
+			OnStoppedLeading: func() { log.Printf("%s: %s stopped leading", what, id) },
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("leader election: %w", err)
+	}
+
+	go func() {
+		// Run returns when leadership is lost; compete again until shutdown.
+		for ctx.Err() == nil {
+			elector.Run(ctx)
+		}
+	}()
+	return nil
+}
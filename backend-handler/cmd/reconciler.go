@@ -0,0 +1,49 @@
+package main
+
+import (
+	reconciler "backend-handler/family-reconciler"
+	switcher "backend-handler/notebook-switcher"
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// reconcileLeaseName is the Lease used so that only one replica reconciles at a time.
+const reconcileLeaseName = "gpu-switcher-family-reconciler"
+
+// startReconciler runs the family reconciler in the background, at startup and
+// every interval, for as long as this replica holds the reconciler lease.
+// Notebooks with a migration in progress on this replica (busy) or marked by
+// one younger than stale are left alone.
+func startReconciler(ctx context.Context, interval, grace, stale time.Duration, reclaim reclaimOptions, busy func(namespace, name string) bool) error {
+	src, err := reclaim.activitySource()
+	if err != nil {
+		return err
+	}
+	cfg, err := switcher.BuildConfig()
+	if err != nil {
+		return fmt.Errorf("build kube config: %w", err)
+	}
+	dc, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("dynamic client: %w", err)
+	}
+	cs, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("k8s clientset: %w", err)
+	}
+
+	r := &reconciler.Reconciler{
+		Dynamic:   dc,
+		Clientset: cs,
+		Source:    src,
+		Interval:  interval,
+		Grace:     grace,
+		Stale:     stale,
+		Busy:      busy,
+	}
+	return runLeading(ctx, cs, reconcileLeaseName, "Family reconciler", r.Run)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	webhook "backend-handler/admission-webhook"
+	switcher "backend-handler/notebook-switcher"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// startWebhook serves the Notebook admission webhook over TLS on addr.
+func startWebhook(ctx context.Context, addr, certFile, keyFile, trustedUsers, gpuKeys string) error {
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("admission webhook needs -webhook-cert and -webhook-key")
+	}
+	s := &webhook.Server{}
+	for _, u := range strings.Split(trustedUsers, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			s.TrustedUsers = append(s.TrustedUsers, u)
+		}
+	}
+	for _, k := range strings.Split(gpuKeys, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			s.GPUKeys = append(s.GPUKeys, k)
+		}
+	}
+	if len(s.TrustedUsers) == 0 {
+		// the switcher's own Notebooks would be rejected
+		return fmt.Errorf("admission webhook needs -webhook-trusted-users, e.g. the switcher's service account")
+	}
+	cfg, err := switcher.BuildConfig()
+	if err != nil {
+		return fmt.Errorf("build kube config: %w", err)
+	}
+	cs, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("k8s clientset: %w", err)
+	}
+
+	s.Clientset = cs
+
+	srv := &http.Server{Addr: addr, Handler: s.Handler()}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		log.Printf("Starting admission webhook on %s (/validate, /mutate)", addr)
+		if err := srv.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Admission webhook failed: %v", err)
+		}
+	}()
+	return nil
+}
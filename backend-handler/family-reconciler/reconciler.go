@@ -0,0 +1,213 @@
+// Package reconciler cleans up after migrations that were interrupted between
+// creating the new notebook and deleting the old one, e.g. by a crash of the
+// backend: such notebook families have more than one running member.
+package reconciler
+
+import (
+	nbpods "backend-handler/get-nbpods-name"
+	reclaimer "backend-handler/idle-reclaimer"
+	switcher "backend-handler/notebook-switcher"
+	"backend-handler/tracing"
+	"backend-handler/workload"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+var tracer = otel.Tracer("backend-handler/family-reconciler")
+
+// Reconciler keeps one running notebook per family. Of the running members it
+// keeps the one whose pod is ready and most recently active, and stops the
+// others; their data stays on the workspace volume and a later switch adopts
+// them (see switcher.Migrate).
+type Reconciler struct {
+	Dynamic   dynamic.Interface
+	Clientset kubernetes.Interface
+	// Source tells the most recently active member; nil ranks by creation time only.
+	Source reclaimer.ActivitySource
+
+	Interval time.Duration
+	// Grace leaves families alone whose newest member is younger, so that
+	// migrations still running (on any replica) can finish.
+	Grace time.Duration
+	// Stale bounds how long the marker of a migration in progress
+	// (switcher.MigratingAnnotation) leaves a family alone; older markers
+	// were left by migrations that crashed.
+	Stale time.Duration
+	// Namespace restricts the reconciler to one namespace; empty means all.
+	Namespace string
+	// Busy reports notebooks with a migration in progress; their families are skipped.
+	Busy func(namespace, name string) bool
+}
+
+// member is a running notebook of a family.
+type member struct {
+	nb      *workload.Workload
+	ready   bool
+	pod     string
+	lastUse time.Time // zero if unknown
+}
+
+// Run reconciles right away, then every Interval until ctx is cancelled.
+func (r *Reconciler) Run(ctx context.Context) {
+	log.Printf("Family reconciler started: interval %v, grace %v, stale %v", r.Interval, r.Grace, r.Stale)
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.ReconcileOnce(ctx); err != nil {
+			log.Printf("Family reconciler: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReconcileOnce stops the surplus running members of every family created by
+// the switcher and returns them as "namespace/name". Errors on single
+// families are logged and do not stop the pass.
+func (r *Reconciler) ReconcileOnce(ctx context.Context) (_ []string, err error) {
+	ctx, span := tracer.Start(ctx, "reconcile notebook families")
+	defer func() { tracing.End(span, err) }()
+
+	configs := map[string]*switcher.Config{} // per namespace, loaded once per pass
+	var stopped []string
+	listed := false
+	for _, kind := range []string{workload.KindKubeflow, workload.KindStatefulSet} {
+		backend, err := workload.New(kind, r.Dynamic, r.Clientset, workload.Options{})
+		if err != nil {
+			return nil, err
+		}
+		list, err := backend.List(ctx, r.Namespace)
+		if err != nil {
+			// e.g. a cluster without Kubeflow
+			log.Printf("Family reconciler: list %s notebooks: %v", kind, err)
+			continue
+		}
+		listed = true
+
+		// namespace/family ID -> running members
+		families := map[string][]*workload.Workload{}
+		managed := map[string]bool{}
+		for _, nb := range list {
+			if nb.Stopped || nb.GetDeletionTimestamp() != nil {
+				continue
+			}
+			ns := nb.GetNamespace()
+			nsCfg, ok := configs[ns]
+			if !ok {
+				if nsCfg, err = switcher.LoadConfig(ctx, r.Clientset, ns); err != nil {
+					log.Printf("Family reconciler: namespace %s: %v", ns, err)
+				}
+				configs[ns] = nsCfg
+			}
+			if nsCfg == nil || nsCfg.WorkloadBackend != kind {
+				continue
+			}
+			id, _ := switcher.Family(nb)
+			key := ns + "/" + id
+			families[key] = append(families[key], nb)
+			if nb.GetAnnotations()[switcher.ManagedByAnnotation] == switcher.ManagedByValue {
+				managed[key] = true
+			}
+		}
+
+		for key, members := range families {
+			if len(members) < 2 || !managed[key] {
+				continue
+			}
+			names, err := r.reconcileFamily(ctx, backend, members)
+			if err != nil {
+				log.Printf("Family reconciler: family %s: %v", key, err)
+			}
+			stopped = append(stopped, names...)
+		}
+	}
+	if !listed {
+		return nil, fmt.Errorf("list notebooks: no workload backend could be listed")
+	}
+	span.SetAttributes(attribute.Int("notebooks.stopped", len(stopped)))
+	return stopped, nil
+}
+
+// reconcileFamily keeps the best of the running members of one family and
+// stops the others.
+func (r *Reconciler) reconcileFamily(ctx context.Context, backend workload.Backend, running []*workload.Workload) (_ []string, err error) {
+	ns := running[0].GetNamespace()
+	_, canonical := switcher.Family(running[0])
+	ctx, span := tracer.Start(ctx, "reconcile family", trace.WithAttributes(
+		attribute.String("notebook.namespace", ns),
+		attribute.String("notebook.family", canonical),
+		attribute.Int("family.running", len(running)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	var members []member
+	for _, nb := range running {
+		if time.Since(nb.GetCreationTimestamp().Time) < r.Grace {
+			return nil, nil
+		}
+		if r.Busy != nil && r.Busy(ns, nb.GetName()) {
+			return nil, nil
+		}
+		if since, ok := switcher.MigratingSince(nb); ok && time.Since(since) < r.Stale {
+			return nil, nil
+		}
+		m := member{nb: nb}
+		pod, err := backend.Pod(ctx, ns, nb.GetName())
+		if err != nil {
+			return nil, fmt.Errorf("get pod of %s: %w", nb.GetName(), err)
+		}
+		if pod != nil {
+			m.pod, m.ready = pod.Name, nbpods.IsPodReady(pod)
+		}
+		if m.ready && r.Source != nil {
+			t := reclaimer.Target{Name: nb.GetName(), Namespace: ns, PodName: m.pod, Created: reclaimer.CreatedAt(nb)}
+			since, err := r.Source.IdleSince(ctx, t)
+			switch {
+			case err != nil:
+				log.Printf("Family reconciler: activity of %s/%s: %v", ns, nb.GetName(), err)
+			case since.IsZero(): // busy right now
+				m.lastUse = time.Now()
+			default:
+				m.lastUse = since
+			}
+		}
+		members = append(members, m)
+	}
+
+	// ready first, then most recently active, then newest
+	sort.Slice(members, func(i, j int) bool {
+		a, b := members[i], members[j]
+		if a.ready != b.ready {
+			return a.ready
+		}
+		if !a.lastUse.Equal(b.lastUse) {
+			return a.lastUse.After(b.lastUse)
+		}
+		return b.nb.CreationTimestamp.Before(&a.nb.CreationTimestamp)
+	})
+	keep := members[0].nb.GetName()
+	span.SetAttributes(attribute.String("notebook.kept", keep))
+
+	var stopped []string
+	for _, m := range members[1:] {
+		name := m.nb.GetName()
+		log.Printf("Family reconciler: %s/%s and %s/%s both run, stopping %s", ns, keep, ns, name, name)
+		if err := backend.Stop(ctx, ns, name); err != nil {
+			return stopped, fmt.Errorf("stop %s: %w", name, err)
+		}
+		stopped = append(stopped, ns+"/"+name)
+	}
+	return stopped, nil
+}
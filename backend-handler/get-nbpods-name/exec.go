@@ -0,0 +1,85 @@
+package nbpods
+
+import (
+	"backend-handler/tracing"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Exec runs command in container of pod (pods/exec), streaming stdin (may be
+// nil) to it and its output to stdout and stderr. A non-zero exit status is
+// returned as an error carrying the last line of stderr when stderr is nil.
+func Exec(
+	ctx context.Context,
+	cfg *rest.Config,
+	client kubernetes.Interface,
+	namespace, pod, container string,
+	command []string,
+	stdin io.Reader, stdout, stderr io.Writer,
+) (err error) {
+	ctx, span := tracer.Start(ctx, "exec in pod", trace.WithAttributes(
+		attribute.String("pod.namespace", namespace),
+		attribute.String("pod.name", pod),
+		attribute.String("pod.container", container),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	req := client.CoreV1().RESTClient().Post().
+		Resource("pods").Namespace(namespace).Name(pod).SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdin:     stdin != nil,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	spdy, err := remotecommand.NewSPDYExecutor(cfg, "POST", req.URL())
+	if err != nil {
+		return fmt.Errorf("exec %s/%s: %w", namespace, pod, err)
+	}
+	ws, err := remotecommand.NewWebSocketExecutor(cfg, "GET", req.URL().String())
+	if err != nil {
+		return fmt.Errorf("exec %s/%s: %w", namespace, pod, err)
+	}
+	exec, err := remotecommand.NewFallbackExecutor(ws, spdy, httpstream.IsUpgradeFailure)
+	if err != nil {
+		return fmt.Errorf("exec %s/%s: %w", namespace, pod, err)
+	}
+
+	var errBuf bytes.Buffer
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	if stderr == nil {
+		stderr = &errBuf
+	}
+	err = exec.StreamWithContext(ctx, remotecommand.StreamOptions{Stdin: stdin, Stdout: stdout, Stderr: stderr})
+	if err != nil {
+		if msg := lastLine(errBuf.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return fmt.Errorf("exec in %s/%s: %w", namespace, pod, err)
+	}
+	return nil
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		s = s[i+1:]
+	}
+	return s
+}
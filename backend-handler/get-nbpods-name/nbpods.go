@@ -1,11 +1,16 @@
 package nbpods
 
 import (
+	"backend-handler/retry"
+	"backend-handler/tracing"
 	"context"
 	"fmt"
 	"sort"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -13,6 +18,11 @@ import (
 	"k8s.io/client-go/kubernetes"
 )
 
+var tracer = otel.Tracer("backend-handler/get-nbpods-name")
+
+// DefaultFindTimeout bounds FindFirstPodName when ctx has no deadline.
+var DefaultFindTimeout = 3 * time.Minute
+
 // FindFirstPodNameByNotebookName returns the first pod (according to alphabet) of the notebook.
 // Filter by label: notebook-name=<notebookName> inside the namespace.
 // Return error if it doesn't find any pod.
@@ -24,13 +34,26 @@ func FindFirstPodNameByNotebookName(
 	client kubernetes.Interface,
 	notebookName, namespace string,
 ) (string, error) {
+	return FindFirstPodName(ctx, client, namespace, "notebook-name="+notebookName)
+}
 
-	ls := "notebook-name=" + notebookName
-
-	// Default timeout is 3 minutes if "ctx" has no deadline yet.
+// FindFirstPodName is FindFirstPodNameByNotebookName for any label selector,
+// e.g. the selector of a StatefulSet.
+func FindFirstPodName(
+	ctx context.Context,
+	client kubernetes.Interface,
+	namespace, ls string,
+) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "wait notebook pod created", trace.WithAttributes(
+		attribute.String("pod.selector", ls),
+		attribute.String("notebook.namespace", namespace),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	// Default timeout is DefaultFindTimeout if "ctx" has no deadline yet.
 	if _, ok := ctx.Deadline(); !ok {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, 3*time.Minute)
+		ctx, cancel = context.WithTimeout(ctx, DefaultFindTimeout)
 		defer cancel()
 	}
 
@@ -42,16 +65,17 @@ func FindFirstPodNameByNotebookName(
 		podList, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
 			LabelSelector: ls,
 		})
-		if err != nil {
-			// error API (network, RBAC, ...) -> return error
+		if err != nil && !retry.Retryable(err) {
+			// error API (RBAC, ...) -> return error
 			return "", err
 		}
 
-		if len(podList.Items) > 0 {
+		if err == nil && len(podList.Items) > 0 {
 			// get the first pod according to notebook name and namespace
 			sort.Slice(podList.Items, func(i, j int) bool {
 				return podList.Items[i].Name < podList.Items[j].Name
 			})
+			span.SetAttributes(attribute.String("pod.name", podList.Items[0].Name))
 			return podList.Items[0].Name, nil
 		}
 
@@ -60,6 +84,9 @@ func FindFirstPodNameByNotebookName(
 		select {
 		case <-ctx.Done():
 			timer.Stop()
+			if err != nil {
+				return "", fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+			}
 			return "", ctx.Err()
 		case <-timer.C:
 			// increase delay time for the next iteration
@@ -81,7 +108,13 @@ func WaitPodReady(
 	client kubernetes.Interface,
 	namespace, podName string,
 	timeout time.Duration,
-) error {
+) (err error) {
+	ctx, span := tracer.Start(ctx, "wait pod ready", trace.WithAttributes(
+		attribute.String("pod.name", podName),
+		attribute.String("pod.namespace", namespace),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	// Add default deadline if ctx has no deadline yet.
 	if _, ok := ctx.Deadline(); !ok && timeout > 0 {
 		var cancel context.CancelFunc
@@ -90,6 +123,9 @@ func WaitPodReady(
 	}
 
 	interval := time.Second
+	// conditions already reported as span events, so the trace shows when the pod
+	// got scheduled, initialised (image pulled) and became ready
+	seen := map[string]bool{}
 
 	return wait.PollUntilContextCancel(ctx, interval, true, func(ctx context.Context) (bool, error) {
 		pod, err := client.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
@@ -97,10 +133,16 @@ func WaitPodReady(
 			// If pod is newly created or recreated -> continue for waiting
 			return false, nil
 		}
+		if retry.Retryable(err) {
+			// throttled or API server unavailable: poll again
+			return false, nil
+		}
 		if err != nil {
 			return false, err
 		}
 
+		recordPodProgress(span, pod, seen)
+
 		// If pod is marked for deletion, return as an error
 		if pod.DeletionTimestamp != nil {
 			return false, fmt.Errorf("pod %q is being deleted", pod.Name)
@@ -112,15 +154,67 @@ func WaitPodReady(
 		}
 
 		// If pod is Ready
-		if isPodReady(pod) {
+		if IsPodReady(pod) {
 			return true, nil
 		}
 		return false, nil
 	})
 }
 
-// isPodReady: if Running and PodReady=True
-func isPodReady(p *corev1.Pod) bool {
+// recordPodProgress adds a span event for every pod condition that turned True
+// since the last poll, and for containers stuck in a waiting state (e.g. ImagePullBackOff).
+func recordPodProgress(span trace.Span, p *corev1.Pod, seen map[string]bool) {
+	for _, c := range p.Status.Conditions {
+		if c.Status != corev1.ConditionTrue || seen[string(c.Type)] {
+			continue
+		}
+		seen[string(c.Type)] = true
+		attrs := []attribute.KeyValue{attribute.String("pod.phase", string(p.Status.Phase))}
+		if c.Type == corev1.PodScheduled && p.Spec.NodeName != "" {
+			attrs = append(attrs, attribute.String("node.name", p.Spec.NodeName))
+		}
+		span.AddEvent("pod condition "+string(c.Type), trace.WithTimestamp(c.LastTransitionTime.Time), trace.WithAttributes(attrs...))
+	}
+	for _, cs := range p.Status.ContainerStatuses {
+		if w := cs.State.Waiting; w != nil && w.Reason != "" && w.Reason != "ContainerCreating" {
+			key := "waiting/" + cs.Name + "/" + w.Reason
+			if !seen[key] {
+				seen[key] = true
+				span.AddEvent("container waiting", trace.WithAttributes(
+					attribute.String("container.name", cs.Name),
+					attribute.String("reason", w.Reason),
+					attribute.String("message", w.Message),
+				))
+			}
+		}
+	}
+}
+
+// GetNotebookPod returns the first pod of the notebook without waiting,
+// or nil if the notebook has no pod (e.g. it is stopped).
+func GetNotebookPod(ctx context.Context, client kubernetes.Interface, notebookName, namespace string) (*corev1.Pod, error) {
+	return GetFirstPod(ctx, client, namespace, "notebook-name="+notebookName)
+}
+
+// GetFirstPod is GetNotebookPod for any label selector.
+func GetFirstPod(ctx context.Context, client kubernetes.Interface, namespace, ls string) (*corev1.Pod, error) {
+	podList, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: ls,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(podList.Items) == 0 {
+		return nil, nil
+	}
+	sort.Slice(podList.Items, func(i, j int) bool {
+		return podList.Items[i].Name < podList.Items[j].Name
+	})
+	return &podList.Items[0], nil
+}
+
+// IsPodReady: if Running and PodReady=True
+func IsPodReady(p *corev1.Pod) bool {
 	if p.Status.Phase != corev1.PodRunning {
 		return false
 	}
@@ -0,0 +1,214 @@
+package reclaimer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DCGM exporter metrics used to judge GPU activity.
+const (
+	metricGPUUtil = "DCGM_FI_DEV_GPU_UTIL" // GPU utilisation in percent
+	metricFBUsed  = "DCGM_FI_DEV_FB_USED"  // framebuffer memory used in MiB
+)
+
+// PrometheusActivity judges GPU activity from DCGM exporter metrics stored in a
+// Prometheus-compatible endpoint. A GPU counts as active at a given time when
+// its utilisation is at or above UtilThreshold, or (if MemoryThresholdMiB > 0)
+// when it holds at least MemoryThresholdMiB of memory.
+//
+// Unlike kernel activity this catches kernels that keep running pure CPU work
+// while holding a GPU.
+type PrometheusActivity struct {
+	// URL is the Prometheus base URL, e.g. http://prometheus-k8s.monitoring:9090.
+	URL string
+	// Window is how far back samples are inspected; a pod without any active
+	// sample in Window is reported idle since the start of Window. The
+	// Target's IdleTimeout extends it, or the pod could never look idle long
+	// enough.
+	Window time.Duration
+	// Step is the resolution of the lookback subquery (default 30s).
+	Step time.Duration
+
+	UtilThreshold      float64
+	MemoryThresholdMiB float64
+
+	// PodLabel and NamespaceLabel are the labels DCGM exporter uses to attach
+	// metrics to pods (default "pod" and "namespace").
+	PodLabel       string
+	NamespaceLabel string
+
+	Client *http.Client
+}
+
+// IdleSince returns the last time the pod's GPUs were active within Window
+// (or the start of Window / the notebook creation if they never were),
+// and the zero time if they are active right now.
+func (p *PrometheusActivity) IdleSince(ctx context.Context, t Target) (time.Time, error) {
+	now := time.Now()
+	sel := p.selector(t)
+
+	// Refuse to judge a pod DCGM knows nothing about; an exporter without pod
+	// mapping would otherwise make every notebook look idle.
+	series, err := p.query(ctx, fmt.Sprintf("count(%s%s)", metricGPUUtil, sel), now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(series) == 0 {
+		return time.Time{}, fmt.Errorf("no %s series for pod %s/%s", metricGPUUtil, t.Namespace, t.PodName)
+	}
+
+	active := fmt.Sprintf("timestamp(%s%s >= %s)", metricGPUUtil, sel, formatFloat(p.UtilThreshold))
+	if p.MemoryThresholdMiB > 0 {
+		active += fmt.Sprintf(" or timestamp(%s%s >= %s)", metricFBUsed, sel, formatFloat(p.MemoryThresholdMiB))
+	}
+	window := max(p.window(), t.IdleTimeout)
+	q := fmt.Sprintf("max(max_over_time((%s)[%s:%s]))", active, promDuration(window), promDuration(p.step()))
+	res, err := p.query(ctx, q, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	since := now.Add(-window)
+	if t.Created.After(since) {
+		since = t.Created
+	}
+	if len(res) > 0 && !math.IsNaN(res[0]) {
+		last := time.Unix(0, int64(res[0]*float64(time.Second)))
+		if now.Sub(last) <= p.step() {
+			// active in the latest sample
+			return time.Time{}, nil
+		}
+		if last.After(since) {
+			since = last
+		}
+	}
+	return since, nil
+}
+
+func (p *PrometheusActivity) selector(t Target) string {
+	podLabel, nsLabel := p.PodLabel, p.NamespaceLabel
+	if podLabel == "" {
+		podLabel = "pod"
+	}
+	if nsLabel == "" {
+		nsLabel = "namespace"
+	}
+	return fmt.Sprintf("{%s=%q,%s=%q}", nsLabel, t.Namespace, podLabel, t.PodName)
+}
+
+func (p *PrometheusActivity) window() time.Duration {
+	if p.Window <= 0 {
+		return 30 * time.Minute
+	}
+	return p.Window
+}
+
+func (p *PrometheusActivity) step() time.Duration {
+	if p.Step <= 0 {
+		return 30 * time.Second
+	}
+	return p.Step
+}
+
+// promResponse is the subset of the Prometheus HTTP API instant-query response we need.
+type promResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Value  [2]any            `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// query runs an instant query and returns the sample values of the resulting vector.
+func (p *PrometheusActivity) query(ctx context.Context, q string, at time.Time) ([]float64, error) {
+	v := url.Values{}
+	v.Set("query", q)
+	v.Set("time", strconv.FormatFloat(float64(at.UnixNano())/float64(time.Second), 'f', 3, 64))
+	u := strings.TrimRight(p.URL, "/") + "/api/v1/query?" + v.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("prometheus query: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var pr promResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+		return nil, fmt.Errorf("decode prometheus response (%s): %w", resp.Status, err)
+	}
+	if pr.Status != "success" {
+		return nil, fmt.Errorf("prometheus query %q: %s: %s", q, pr.ErrorType, pr.Error)
+	}
+	if pr.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("prometheus query %q: unexpected result type %q", q, pr.Data.ResultType)
+	}
+
+	out := make([]float64, 0, len(pr.Data.Result))
+	for _, r := range pr.Data.Result {
+		s, ok := r.Value[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("prometheus query %q: malformed sample %v", q, r.Value)
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("prometheus query %q: %w", q, err)
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// promDuration renders d in PromQL duration syntax (whole seconds).
+func promDuration(d time.Duration) string {
+	s := int64(d / time.Second)
+	if s < 1 {
+		s = 1
+	}
+	return strconv.FormatInt(s, 10) + "s"
+}
+
+// AllIdle combines sources: a notebook is idle only while every source says so,
+// and is idle since the latest of their idle times.
+type AllIdle []ActivitySource
+
+// IdleSince implements ActivitySource.
+func (a AllIdle) IdleSince(ctx context.Context, t Target) (time.Time, error) {
+	var since time.Time
+	for _, src := range a {
+		s, err := src.IdleSince(ctx, t)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if s.IsZero() {
+			return time.Time{}, nil
+		}
+		if s.After(since) {
+			since = s
+		}
+	}
+	return since, nil
+}
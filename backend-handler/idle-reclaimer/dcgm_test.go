@@ -0,0 +1,133 @@
+package reclaimer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePrometheus answers instant queries like Prometheus: the count query
+// with series (none if absent), the activity query with lastActive (an
+// empty vector if zero). Other answers come from status/errorType.
+type fakePrometheus struct {
+	series     int
+	lastActive time.Time
+	status     string
+	queries    []string
+}
+
+func (f *fakePrometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/query" {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query().Get("query")
+	f.queries = append(f.queries, q)
+	if f.status != "" && f.status != "success" {
+		json.NewEncoder(w).Encode(map[string]any{"status": f.status, "errorType": "bad_data", "error": "parse error"})
+		return
+	}
+
+	var result []any
+	sample := func(v float64) any {
+		return map[string]any{"metric": map[string]string{}, "value": []any{1.0, strconv.FormatFloat(v, 'f', -1, 64)}}
+	}
+	switch {
+	case strings.HasPrefix(q, "count("):
+		if f.series > 0 {
+			result = append(result, sample(float64(f.series)))
+		}
+	case !f.lastActive.IsZero():
+		result = append(result, sample(float64(f.lastActive.UnixNano())/float64(time.Second)))
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"data":   map[string]any{"resultType": "vector", "result": result},
+	})
+}
+
+func TestPrometheusActivity(t *testing.T) {
+	now := time.Now()
+	target := Target{Name: "nb-gpu", Namespace: "team", PodName: "nb-gpu-0", Created: now.Add(-2 * time.Hour)}
+
+	tests := []struct {
+		name    string
+		prom    fakePrometheus
+		target  Target
+		window  time.Duration
+		want    time.Time // zero: active
+		wantErr bool
+	}{
+		{name: "active now", prom: fakePrometheus{series: 1, lastActive: now.Add(-10 * time.Second)}, target: target, window: 30 * time.Minute},
+		{name: "idle since last activity", prom: fakePrometheus{series: 1, lastActive: now.Add(-10 * time.Minute)}, target: target, window: 30 * time.Minute, want: now.Add(-10 * time.Minute)},
+		{name: "never active in window", prom: fakePrometheus{series: 1}, target: target, window: 30 * time.Minute, want: now.Add(-30 * time.Minute)},
+		{name: "created within window", prom: fakePrometheus{series: 1}, target: Target{Namespace: "team", PodName: "nb-gpu-0", Created: now.Add(-5 * time.Minute)}, window: 30 * time.Minute, want: now.Add(-5 * time.Minute)},
+		{name: "idle timeout extends window", prom: fakePrometheus{series: 1}, target: Target{Namespace: "team", PodName: "nb-gpu-0", Created: target.Created, IdleTimeout: time.Hour}, window: 30 * time.Minute, want: now.Add(-time.Hour)},
+		{name: "no DCGM series", prom: fakePrometheus{}, target: target, window: 30 * time.Minute, wantErr: true},
+		{name: "query error", prom: fakePrometheus{status: "error"}, target: target, window: 30 * time.Minute, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(&tt.prom)
+			defer srv.Close()
+			p := &PrometheusActivity{URL: srv.URL + "/", Window: tt.window, UtilThreshold: 5, Client: srv.Client()}
+
+			got, err := p.IdleSince(context.Background(), tt.target)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("IdleSince() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("IdleSince(): %v", err)
+			}
+			if tt.want.IsZero() != got.IsZero() || got.Sub(tt.want).Abs() > 2*time.Second {
+				t.Errorf("IdleSince() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrometheusActivityQuery(t *testing.T) {
+	prom := &fakePrometheus{series: 1}
+	srv := httptest.NewServer(prom)
+	defer srv.Close()
+	p := &PrometheusActivity{URL: srv.URL, Window: 15 * time.Minute, UtilThreshold: 5, MemoryThresholdMiB: 512, PodLabel: "exported_pod", Client: srv.Client()}
+
+	if _, err := p.IdleSince(context.Background(), Target{Namespace: "team", PodName: "nb-gpu-0", IdleTimeout: 20 * time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if len(prom.queries) != 2 {
+		t.Fatalf("got %d queries, want 2: %q", len(prom.queries), prom.queries)
+	}
+	want := `max(max_over_time((timestamp(DCGM_FI_DEV_GPU_UTIL{namespace="team",exported_pod="nb-gpu-0"} >= 5) or timestamp(DCGM_FI_DEV_FB_USED{namespace="team",exported_pod="nb-gpu-0"} >= 512))[1200s:30s]))`
+	if prom.queries[1] != want {
+		t.Errorf("activity query\n got %s\nwant %s", prom.queries[1], want)
+	}
+}
+
+func TestAllIdle(t *testing.T) {
+	now := time.Now()
+	idle := func(since time.Time) ActivitySource { return fixedSource(since) }
+
+	got, _ := AllIdle{idle(now.Add(-time.Hour)), idle(now.Add(-10 * time.Minute))}.IdleSince(context.Background(), Target{})
+	if !got.Equal(now.Add(-10 * time.Minute)) {
+		t.Errorf("AllIdle = %v, want the latest idle time", got)
+	}
+	got, _ = AllIdle{idle(now.Add(-time.Hour)), idle(time.Time{})}.IdleSince(context.Background(), Target{})
+	if !got.IsZero() {
+		t.Errorf("AllIdle = %v, want active", got)
+	}
+}
+
+type fixedSource time.Time
+
+func (s fixedSource) IdleSince(context.Context, Target) (time.Time, error) {
+	return time.Time(s), nil
+}
@@ -0,0 +1,103 @@
+package reclaimer
+
+import (
+	switcher "backend-handler/notebook-switcher"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultJupyterURLTemplate reaches a Kubeflow notebook through the Service the
+// notebook controller creates (port 80 -> 8888) under its NB_PREFIX base URL.
+const DefaultJupyterURLTemplate = switcher.DefaultJupyterURLTemplate
+
+// JupyterActivity reads activity from the Jupyter server REST API
+// (/api/status and /api/kernels) of each notebook.
+type JupyterActivity struct {
+	// URLTemplate is the server base URL; "{name}" and "{namespace}" are substituted.
+	URLTemplate string
+	// Token is sent as "Authorization: token <Token>" when set.
+	Token  string
+	Client *http.Client
+}
+
+type jupyterStatus struct {
+	LastActivity time.Time `json:"last_activity"`
+	Connections  int       `json:"connections"`
+	Kernels      int       `json:"kernels"`
+}
+
+type jupyterKernel struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	LastActivity   time.Time `json:"last_activity"`
+	ExecutionState string    `json:"execution_state"`
+	Connections    int       `json:"connections"`
+}
+
+// IdleSince returns the most recent last_activity of the server and its kernels,
+// or the zero time while any kernel is busy (or starting).
+func (j *JupyterActivity) IdleSince(ctx context.Context, t Target) (time.Time, error) {
+	base := j.baseURL(t)
+
+	var status jupyterStatus
+	if err := j.getJSON(ctx, base+"/api/status", &status); err != nil {
+		return time.Time{}, err
+	}
+	var kernels []jupyterKernel
+	if err := j.getJSON(ctx, base+"/api/kernels", &kernels); err != nil {
+		return time.Time{}, err
+	}
+
+	last := status.LastActivity
+	for _, k := range kernels {
+		if k.ExecutionState == "busy" || k.ExecutionState == "starting" {
+			return time.Time{}, nil
+		}
+		if k.LastActivity.After(last) {
+			last = k.LastActivity
+		}
+	}
+	if last.IsZero() {
+		return time.Time{}, fmt.Errorf("jupyter server %s reported no last_activity", base)
+	}
+	return last, nil
+}
+
+func (j *JupyterActivity) baseURL(t Target) string {
+	tmpl := j.URLTemplate
+	if tmpl == "" {
+		tmpl = DefaultJupyterURLTemplate
+	}
+	r := strings.NewReplacer("{name}", t.Name, "{namespace}", t.Namespace)
+	return strings.TrimRight(r.Replace(tmpl), "/")
+}
+
+func (j *JupyterActivity) getJSON(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if j.Token != "" {
+		req.Header.Set("Authorization", "token "+j.Token)
+	}
+	client := j.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("GET %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode %s: %w", url, err)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package reclaimer
+
+import (
+	switcher "backend-handler/notebook-switcher"
+	"backend-handler/policy"
+	"backend-handler/tracing"
+	"backend-handler/workload"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+var tracer = otel.Tracer("backend-handler/idle-reclaimer")
+
+// Target is a running GPU notebook considered for reclaim.
+type Target struct {
+	Name      string
+	Namespace string
+	PodName   string
+	// Created is when the Notebook was created or, if later, adopted by a
+	// migration (see CreatedAt); activity before it is not looked at.
+	Created time.Time
+	// IdleTimeout is how long the notebook may stay idle; sources that look
+	// back over a bounded window cover at least this much.
+	IdleTimeout time.Duration
+}
+
+// CreatedAt returns when nb was created or, if a migration adopted it
+// later, when that migration ran.
+func CreatedAt(nb *workload.Workload) time.Time {
+	created := nb.GetCreationTimestamp().Time
+	if at, ok := switcher.MigratedAt(nb); ok && at.After(created) {
+		return at
+	}
+	return created
+}
+
+// ActivitySource reports when a notebook became idle.
+type ActivitySource interface {
+	// IdleSince returns the time since which the notebook has been idle,
+	// or the zero time if it is active right now.
+	IdleSince(ctx context.Context, t Target) (time.Time, error)
+}
+
+// Reclaimer periodically migrates GPU notebooks that have been idle for longer
+// than IdleTimeout back to CPU, independently of any open browser tab.
+type Reclaimer struct {
+	Dynamic   dynamic.Interface
+	Clientset kubernetes.Interface
+	Source    ActivitySource
+
+	IdleTimeout time.Duration
+	Interval    time.Duration
+	// Namespace restricts the reclaimer to one namespace; empty means all.
+	Namespace string
+
+	// Release migrates a notebook back to CPU; defaults to switcher.SwitcherToCPU.
+	Release func(ctx context.Context, notebookName, notebookNamespace string) (string, error)
+}
+
+// Run reconciles every Interval until ctx is cancelled.
+func (r *Reclaimer) Run(ctx context.Context) {
+	log.Printf("Idle reclaimer started: idle timeout %v, interval %v", r.IdleTimeout, r.Interval)
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.ReconcileOnce(ctx); err != nil {
+			log.Printf("Idle reclaimer: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReconcileOnce lists the GPU notebooks of all namespaces (or Namespace) and
+// releases the idle ones, returning them as "namespace/name".
+// Errors on single notebooks are logged and do not stop the pass.
+func (r *Reclaimer) ReconcileOnce(ctx context.Context) (_ []string, err error) {
+	ctx, span := tracer.Start(ctx, "reclaim idle notebooks")
+	defer func() { tracing.End(span, err) }()
+
+	configs := map[string]*switcher.Config{} // per namespace, loaded once per pass
+	var released []string
+	listed := false
+	for _, kind := range []string{workload.KindKubeflow, workload.KindStatefulSet} {
+		backend, err := workload.New(kind, r.Dynamic, r.Clientset, workload.Options{})
+		if err != nil {
+			return nil, err
+		}
+		list, err := backend.List(ctx, r.Namespace)
+		if err != nil {
+			// e.g. a cluster without Kubeflow
+			log.Printf("Idle reclaimer: list %s notebooks: %v", kind, err)
+			continue
+		}
+		listed = true
+
+		for _, nb := range list {
+			ns := nb.GetNamespace()
+			if nb.Stopped || nb.GetDeletionTimestamp() != nil {
+				continue
+			}
+			nsCfg, ok := configs[ns]
+			if !ok {
+				if nsCfg, err = switcher.LoadConfig(ctx, r.Clientset, ns); err != nil {
+					log.Printf("Idle reclaimer: namespace %s: %v", ns, err)
+				}
+				configs[ns] = nsCfg
+			}
+			// Only the backend configured for the namespace is migrated.
+			if nsCfg == nil || nsCfg.WorkloadBackend != kind || !switcher.HasGPUResources(nb, nsCfg.ResourceKeys()...) {
+				continue
+			}
+
+			ok, err := r.reconcileNotebook(ctx, backend, nb, nsCfg.Policy)
+			if err != nil {
+				log.Printf("Idle reclaimer: notebook %s/%s: %v", ns, nb.GetName(), err)
+				continue
+			}
+			if ok {
+				released = append(released, ns+"/"+nb.GetName())
+			}
+		}
+	}
+	if !listed {
+		return nil, fmt.Errorf("list notebooks: no workload backend could be listed")
+	}
+	span.SetAttributes(attribute.Int("notebooks.released", len(released)))
+	return released, nil
+}
+
+// reconcileNotebook releases a single GPU notebook if it is idle for too long
+// or has exceeded the GPU session length allowed by the namespace policy.
+func (r *Reclaimer) reconcileNotebook(ctx context.Context, backend workload.Backend, nb *workload.Workload, pol policy.Policy) (_ bool, err error) {
+	ctx, span := tracer.Start(ctx, "check notebook", trace.WithAttributes(
+		attribute.String("notebook.name", nb.GetName()),
+		attribute.String("notebook.namespace", nb.GetNamespace()),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	t := Target{Name: nb.GetName(), Namespace: nb.GetNamespace(), Created: CreatedAt(nb)}
+	// GPU to GPU switches create a new notebook but keep the session
+	session := t.Created
+	if start, ok := switcher.GPUSessionStart(nb); ok {
+		session = start
+	}
+	if pol.SessionExceeded(session, time.Now()) {
+		return r.release(ctx, t, fmt.Sprintf("GPU session limit %v of namespace policy reached", pol.MaxGPUSession))
+	}
+
+	podCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	t.PodName, err = backend.FindPod(podCtx, t.Namespace, t.Name)
+	cancel()
+	if err != nil {
+		return false, fmt.Errorf("find pod: %w", err)
+	}
+
+	// The namespace policy may only shorten the operator's timeout
+	t.IdleTimeout = r.IdleTimeout
+	if pol.IdleTimeout > 0 && pol.IdleTimeout < t.IdleTimeout {
+		t.IdleTimeout = pol.IdleTimeout
+	}
+	since, err := r.Source.IdleSince(ctx, t)
+	if err != nil {
+		return false, fmt.Errorf("read activity: %w", err)
+	}
+	if since.IsZero() {
+		return false, nil
+	}
+	idle := time.Since(since)
+	span.SetAttributes(attribute.String("notebook.idle", idle.Round(time.Second).String()))
+	if idle < t.IdleTimeout {
+		return false, nil
+	}
+	return r.release(ctx, t, fmt.Sprintf("idle for %v", idle.Round(time.Second)))
+}
+
+// release migrates t back to CPU, logging why.
+func (r *Reclaimer) release(ctx context.Context, t Target, reason string) (bool, error) {
+	log.Printf("Idle reclaimer: notebook %s/%s %s, migrating to CPU", t.Namespace, t.Name, reason)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("reclaim.reason", reason))
+	release := r.Release
+	if release == nil {
+		release = switcher.SwitcherToCPU
+	}
+	newPod, err := release(ctx, t.Name, t.Namespace)
+	if err != nil {
+		return false, fmt.Errorf("migrate to CPU: %w", err)
+	}
+	log.Printf("Idle reclaimer: notebook %s/%s released, new pod %s", t.Namespace, t.Name, newPod)
+	return true, nil
+}
@@ -0,0 +1,354 @@
+// Package migration runs notebook migrations asynchronously and tracks their
+// progress for the /migrations API.
+package migration
+
+import (
+	"backend-handler/api"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for unknown (or already pruned) migration IDs.
+var ErrNotFound = errors.New("migration not found")
+
+// ConflictError is returned when the notebook already has a migration in progress.
+type ConflictError struct {
+	ID string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("notebook already has migration %s in progress", e.ID)
+}
+
+// Runner performs a migration and returns the new Notebook name and URL.
+// It reports its steps through progress and must honour ctx cancellation.
+type Runner func(ctx context.Context, req api.MigrationRequest, progress func(step string)) (newNotebook, url string, err error)
+
+// Manager runs migrations in the background and keeps their state in a
+// MigrationStore, so that clients can start, watch and cancel them through
+// any replica.
+type Manager struct {
+	run Runner
+	// code maps a failure to one of the api.Code* error codes.
+	code func(error) string
+	// Retention is how long finished migrations remain visible.
+	Retention time.Duration
+	// Migrations keeps the migrations; NewManager keeps them in memory, for
+	// a single replica.
+	Migrations MigrationStore
+	// Replica identifies this replica as the owner of its migrations.
+	Replica string
+	// SyncInterval is how often this replica renews its migrations in the
+	// store and picks up the cancellations asked for on other replicas, and
+	// how often it checks the migrations of other replicas that are watched.
+	SyncInterval time.Duration
+
+	// Gate, if set, holds back migrations to GPU until it admits them; they
+	// wait in the queue of their pool meanwhile (see waitTurn).
+	Gate Gate
+	// QueueInterval is how often queued migrations are asked for again, on
+	// top of every time a migration finishes.
+	QueueInterval time.Duration
+	// QueueTimeout fails migrations queued for longer; 0 waits forever.
+	QueueTimeout time.Duration
+	// Queue keeps the queues; NewManager keeps them in memory, for a single
+	// replica.
+	Queue QueueStore
+
+	mu     sync.Mutex
+	items  map[string]*item // the migrations of this replica
+	kicked chan struct{}    // closed and replaced by kick
+	renew  sync.Once
+	sync   sync.Once
+}
+
+type item struct {
+	m       api.Migration
+	cancel  context.CancelFunc
+	changed chan struct{} // closed and replaced on every change
+}
+
+// NewManager returns a Manager that runs migrations with run and classifies
+// failures with code.
+func NewManager(run Runner, code func(error) string) *Manager {
+	host, _ := os.Hostname()
+	return &Manager{
+		run:           run,
+		code:          code,
+		Retention:     time.Hour,
+		Migrations:    &memoryMigrations{},
+		Replica:       host + "-" + newID()[:6],
+		SyncInterval:  5 * time.Second,
+		QueueInterval: 30 * time.Second,
+		Queue:         &memoryStore{},
+		items:         map[string]*item{},
+		kicked:        make(chan struct{}),
+	}
+}
+
+// Start launches a migration in the background. ctx only carries values
+// (e.g. the trace span); the migration outlives the request that started it.
+// It fails with a ConflictError while the notebook has a migration in
+// progress on any replica.
+func (mg *Manager) Start(ctx context.Context, req api.MigrationRequest) (api.Migration, error) {
+	m := api.Migration{
+		ID:               newID(),
+		MigrationRequest: req,
+		State:            api.StatePending,
+		Version:          1,
+		Created:          time.Now().UTC(),
+	}
+	var conflict string
+	_, err := mg.updateMigrations(ctx, func(s *MigrationState, now time.Time) bool {
+		conflict = ""
+		if r := s.active(req.Namespace, req.Notebook); r != nil {
+			conflict = r.ID
+			return false
+		}
+		s.put(&Record{Migration: m, Owner: mg.Replica, Seen: now})
+		return true
+	})
+	if err != nil {
+		return api.Migration{}, fmt.Errorf("record migration: %w", err)
+	}
+	if conflict != "" {
+		return api.Migration{}, &ConflictError{ID: conflict}
+	}
+
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	mg.prune()
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	mg.items[m.ID] = &item{m: m, cancel: cancel, changed: make(chan struct{})}
+	id := m.ID
+	mg.sync.Do(func() { go mg.syncMigrations() })
+	if mg.gated(req) {
+		mg.renew.Do(func() { go mg.renewQueue() })
+	}
+
+	go func() {
+		defer cancel()
+		if err := mg.waitTurn(runCtx, id, req); err != nil {
+			mg.finish(runCtx, id, "", "", err)
+			return
+		}
+		mg.update(id, func(m *api.Migration) {
+			m.State = api.StateRunning
+			m.Queue = nil
+		})
+		progress := func(step string) { mg.update(id, func(m *api.Migration) { m.Step = step }) }
+
+		newNotebook, url, err := mg.run(runCtx, req, progress)
+		mg.finish(runCtx, id, newNotebook, url, err)
+	}()
+	return m, nil
+}
+
+// finish records the outcome of migration id, whose context is runCtx, and
+// lets the queue move on.
+func (mg *Manager) finish(runCtx context.Context, id, newNotebook, url string, err error) {
+	mg.update(id, func(m *api.Migration) {
+		now := time.Now().UTC()
+		m.Finished = &now
+		m.Step = ""
+		m.Queue = nil
+		m.NewNotebook, m.URL = newNotebook, url
+		switch {
+		case err == nil:
+			m.State = api.StateSucceeded
+		case runCtx.Err() != nil:
+			m.State = api.StateCancelled
+			m.Error = err.Error()
+		default:
+			m.State = api.StateFailed
+			m.Error = err.Error()
+			m.Code = mg.code(err)
+		}
+	})
+	mg.mu.Lock()
+	it, ok := mg.items[id]
+	gated := ok && mg.gated(it.m.MigrationRequest)
+	mg.mu.Unlock()
+	if gated {
+		mg.leaveQueue(id)
+	}
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	mg.kick()
+}
+
+// Get returns the current state of migration id, started on any replica.
+func (mg *Manager) Get(ctx context.Context, id string) (api.Migration, error) {
+	if m, _, ok := mg.local(id); ok {
+		return m, nil
+	}
+	return mg.stored(ctx, id)
+}
+
+// Wait blocks until migration id moves past version (or is done), or ctx ends,
+// and returns its state at that point. The migrations of other replicas are
+// checked in the store every second.
+func (mg *Manager) Wait(ctx context.Context, id string, version int) (api.Migration, error) {
+	var last api.Migration
+	for {
+		m, changed, ok := mg.local(id)
+		if !ok {
+			var err error
+			if m, err = mg.stored(ctx, id); err != nil {
+				if ctx.Err() != nil && last.ID != "" {
+					return last, nil
+				}
+				return api.Migration{}, err
+			}
+			last = m
+		}
+
+		if m.Version > version || m.Done() {
+			return m, nil
+		}
+		var poll <-chan time.Time
+		if !ok {
+			poll = time.After(time.Second)
+		}
+		select {
+		case <-changed:
+		case <-poll:
+		case <-ctx.Done():
+			return m, nil
+		}
+	}
+}
+
+// Cancel stops migration id. Steps already done (e.g. the new Notebook being
+// created) are not rolled back. A migration of another replica is cancelled
+// by it within SyncInterval.
+func (mg *Manager) Cancel(ctx context.Context, id string) (api.Migration, error) {
+	mg.mu.Lock()
+	it, ok := mg.items[id]
+	mg.mu.Unlock()
+	if ok {
+		it.cancel()
+		return mg.Get(ctx, id)
+	}
+
+	var m *api.Migration
+	_, err := mg.updateMigrations(ctx, func(s *MigrationState, _ time.Time) bool {
+		r, ok := s.Migrations[id]
+		if !ok {
+			m = nil
+			return false
+		}
+		m = &r.Migration
+		if r.Done() || r.CancelRequested {
+			return false
+		}
+		r.CancelRequested = true
+		return true
+	})
+	if err != nil {
+		return api.Migration{}, err
+	}
+	if m == nil {
+		return api.Migration{}, ErrNotFound
+	}
+	return *m, nil
+}
+
+// List returns the known migrations of all the replicas, newest first,
+// optionally filtered by namespace and notebook.
+func (mg *Manager) List(ctx context.Context, namespace, notebook string) ([]api.Migration, error) {
+	state, err := mg.Migrations.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]api.Migration{}
+	for id, r := range state.Migrations {
+		all[id] = r.Migration
+	}
+	mg.mu.Lock()
+	for id, it := range mg.items {
+		// ours are more recent than the store
+		all[id] = it.m
+	}
+	mg.mu.Unlock()
+
+	out := []api.Migration{}
+	for _, m := range all {
+		if (namespace == "" || m.Namespace == namespace) && (notebook == "" || m.Notebook == notebook) {
+			out = append(out, m)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out, nil
+}
+
+// InProgress reports whether notebook has a migration on this replica that
+// is not done yet. Those of other replicas are told by the
+// MigratingAnnotation of their new notebook.
+func (mg *Manager) InProgress(namespace, notebook string) bool {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	for _, it := range mg.items {
+		if !it.m.Done() && it.m.Namespace == namespace && it.m.Notebook == notebook {
+			return true
+		}
+	}
+	return false
+}
+
+// local returns migration id if it runs on this replica, and the channel
+// closed on its next change.
+func (mg *Manager) local(id string) (api.Migration, <-chan struct{}, bool) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	it, ok := mg.items[id]
+	if !ok {
+		return api.Migration{}, nil, false
+	}
+	return it.m, it.changed, true
+}
+
+// update applies fn to migration id, wakes up its watchers and saves it.
+func (mg *Manager) update(id string, fn func(m *api.Migration)) {
+	mg.mu.Lock()
+	it, ok := mg.items[id]
+	var m api.Migration
+	if ok {
+		it.update(fn)
+		m = it.m
+	}
+	mg.mu.Unlock()
+	if ok {
+		mg.save(m)
+	}
+}
+
+// update applies fn to the migration and wakes up its watchers. Callers hold mu.
+func (it *item) update(fn func(m *api.Migration)) {
+	fn(&it.m)
+	it.m.Version++
+	close(it.changed)
+	it.changed = make(chan struct{})
+}
+
+// prune drops migrations finished longer than Retention ago. Callers hold mu.
+func (mg *Manager) prune() {
+	for id, it := range mg.items {
+		if it.m.Finished != nil && time.Since(*it.m.Finished) > mg.Retention {
+			delete(mg.items, id)
+		}
+	}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
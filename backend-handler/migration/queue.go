@@ -0,0 +1,430 @@
+package migration
+
+import (
+	"backend-handler/api"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrQueueTimeout fails migrations that waited longer than Manager.QueueTimeout.
+var ErrQueueTimeout = errors.New("timed out waiting in the GPU queue")
+
+// Gate decides whether migration req may start now.
+type Gate func(ctx context.Context, req api.MigrationRequest) (Admission, error)
+
+// Admission is the answer of a Gate.
+type Admission struct {
+	OK bool
+	// Pool names the resource the migration needs, e.g. a GPU resource key.
+	// The migrations queued for one pool start in the order they came.
+	Pool string
+	// Reason tells why the migration cannot start yet.
+	Reason string
+}
+
+// QueueState holds the migrations waiting for each pool. It is kept in a
+// QueueStore shared by the replicas, so that the migrations started on any
+// of them wait in one queue per pool.
+type QueueState struct {
+	Pools map[string]*Pool `json:"pools,omitempty"`
+}
+
+// Pool is the queue of one pool, first come first served. The migration
+// that last left the queue, or was admitted without waiting, is Starting
+// until it finished; the next one waits meanwhile, so that both do not count
+// on the same free GPUs.
+type Pool struct {
+	Waiting  []Entry `json:"waiting,omitempty"`
+	Starting *Entry  `json:"starting,omitempty"`
+	// Pace is the moving average of how long a queued migration took to
+	// advance one position, Moved when a migration last left the queue.
+	Pace  time.Duration `json:"pace,omitempty"`
+	Moved time.Time     `json:"moved"`
+}
+
+// Entry is a migration in a queue.
+type Entry struct {
+	ID        string `json:"id"`
+	Namespace string `json:"namespace"`
+	Notebook  string `json:"notebook"`
+	Reason    string `json:"reason,omitempty"`
+	// Since is when it was queued, at position QueuedAt.
+	Since    time.Time `json:"since"`
+	QueuedAt int       `json:"queuedAt"`
+	// Seen is renewed by the replica running the migration; the entries of
+	// replicas that are gone expire (see Manager.queueStale).
+	Seen time.Time `json:"seen"`
+}
+
+// QueueStore keeps the QueueState.
+type QueueStore interface {
+	// Load returns the current state.
+	Load(ctx context.Context) (*QueueState, error)
+	// Update applies fn to the current state, saves it if fn reports a
+	// change and returns it, atomically with respect to the other users of
+	// the store. fn may be called more than once.
+	Update(ctx context.Context, fn func(s *QueueState) bool) (*QueueState, error)
+}
+
+// memoryStore keeps the queue state in memory, for a single replica.
+type memoryStore struct {
+	mu    sync.Mutex
+	state QueueState
+}
+
+func (m *memoryStore) Load(context.Context) (*QueueState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state.clone(), nil
+}
+
+func (m *memoryStore) Update(_ context.Context, fn func(s *QueueState) bool) (*QueueState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(&m.state)
+	return m.state.clone(), nil
+}
+
+// waitTurn returns once migration id may start. Migrations to GPU ask the
+// Gate; those it holds back are queued and ask again every QueueInterval
+// or when another migration of this replica finishes, the head of each pool
+// only. Errors of the Gate or the store let migrations that are not queued
+// yet start.
+func (mg *Manager) waitTurn(ctx context.Context, id string, req api.MigrationRequest) error {
+	if !mg.gated(req) {
+		return nil
+	}
+	var timeout <-chan time.Time
+	if mg.QueueTimeout > 0 {
+		t := time.NewTimer(mg.QueueTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	entry := Entry{ID: id, Namespace: req.Namespace, Notebook: req.Notebook}
+	queued := false
+	for {
+		mg.mu.Lock()
+		kicked := mg.kicked
+		mg.mu.Unlock()
+
+		head := true
+		if state, err := mg.Queue.Load(ctx); err == nil {
+			head = state.position(id) <= 1
+			mg.setQueue(id, state.status(id))
+		} else if queued {
+			log.Printf("Migration %s: read GPU queue: %v", id, err)
+		}
+
+		if head {
+			adm, err := mg.Gate(ctx, req)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			start := false
+			if err == nil {
+				var state *QueueState
+				state, err = mg.updateQueue(ctx, func(s *QueueState, now time.Time) bool {
+					start = s.admit(entry, adm, now)
+					return true
+				})
+				if err == nil {
+					queued = !start
+					mg.setQueue(id, state.status(id))
+				}
+			}
+			if err != nil {
+				log.Printf("Migration %s: admission check failed: %v", id, err)
+				start = !queued
+			}
+			if start {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return fmt.Errorf("%w after %v", ErrQueueTimeout, mg.QueueTimeout)
+		case <-kicked:
+		case <-time.After(mg.QueueInterval):
+		}
+	}
+}
+
+// Queued returns the queue status of the migration of notebook waiting for
+// free GPUs, started on any replica, or nil if it has none.
+func (mg *Manager) Queued(ctx context.Context, namespace, notebook string) (*api.QueueStatus, error) {
+	if mg.Gate == nil {
+		return nil, nil
+	}
+	state, err := mg.Queue.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return state.statusOf(func(e Entry) bool { return e.Namespace == namespace && e.Notebook == notebook }), nil
+}
+
+// Kick makes the heads of the queues ask the Gate again now, e.g. after GPUs
+// were released outside of the Manager. Other replicas ask at their next
+// QueueInterval.
+func (mg *Manager) Kick() {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	mg.kick()
+}
+
+// gated reports whether req waits for the Gate.
+func (mg *Manager) gated(req api.MigrationRequest) bool {
+	return mg.Gate != nil && req.Direction == api.DirectionToGPU
+}
+
+// queueStale is how long queue entries live without being renewed.
+func (mg *Manager) queueStale() time.Duration {
+	return max(3*mg.QueueInterval, time.Minute)
+}
+
+// updateQueue is Queue.Update with the expired entries pruned.
+func (mg *Manager) updateQueue(ctx context.Context, fn func(s *QueueState, now time.Time) bool) (*QueueState, error) {
+	stale := mg.queueStale()
+	return mg.Queue.Update(ctx, func(s *QueueState) bool {
+		now := time.Now().UTC()
+		pruned := s.prune(now, stale)
+		return fn(s, now) || pruned
+	})
+}
+
+// setQueue records the queue status st of migration id, if it is queued.
+func (mg *Manager) setQueue(id string, st *api.QueueStatus) {
+	mg.mu.Lock()
+	it, ok := mg.items[id]
+	if !ok || st == nil || it.m.Done() || it.m.State == api.StateRunning || sameQueue(it.m.Queue, st) {
+		mg.mu.Unlock()
+		return
+	}
+	it.update(func(m *api.Migration) {
+		m.State = api.StateQueued
+		m.Queue = st
+	})
+	m := it.m
+	mg.mu.Unlock()
+	mg.save(m)
+}
+
+// leaveQueue takes migration id, which finished, out of the queue.
+func (mg *Manager) leaveQueue(id string) {
+	// The migration's context may be done already
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := mg.updateQueue(ctx, func(s *QueueState, _ time.Time) bool { return s.remove(id) }); err != nil {
+		log.Printf("Migration %s: leave GPU queue: %v", id, err)
+	}
+}
+
+// renewQueue renews the queue entries of the migrations of this replica
+// every QueueInterval, so that those of replicas that are gone expire.
+func (mg *Manager) renewQueue() {
+	ticker := time.NewTicker(mg.QueueInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ids := map[string]bool{}
+		mg.mu.Lock()
+		for id, it := range mg.items {
+			if !it.m.Done() && mg.gated(it.m.MigrationRequest) {
+				ids[id] = true
+			}
+		}
+		mg.mu.Unlock()
+		if len(ids) == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), mg.QueueInterval)
+		_, err := mg.updateQueue(ctx, func(s *QueueState, now time.Time) bool { return s.touch(ids, now) })
+		cancel()
+		if err != nil {
+			log.Printf("Renew GPU queue: %v", err)
+		}
+	}
+}
+
+// kick wakes up the migrations waiting in waitTurn. Callers hold mu.
+func (mg *Manager) kick() {
+	close(mg.kicked)
+	mg.kicked = make(chan struct{})
+}
+
+// admit reports whether migration e may start given adm: the Gate lets it
+// and no earlier migration of its pool is queued or still starting.
+// Otherwise it queues it.
+func (s *QueueState) admit(e Entry, adm Admission, now time.Time) bool {
+	name, i := s.find(e.ID)
+	if i < 0 {
+		name = adm.Pool
+	}
+	p := s.pool(name)
+	if adm.OK && (i == 0 || i < 0 && len(p.Waiting) == 0) && p.Starting == nil {
+		if i == 0 {
+			e = p.Waiting[0]
+			p.Waiting = p.Waiting[1:]
+		} else {
+			e.Since, e.QueuedAt = now, 1
+		}
+		e.Seen = now
+		p.Starting = &e
+		p.learn(e, now)
+		return true
+	}
+
+	if i < 0 {
+		e.Since, e.Seen, e.QueuedAt = now, now, len(p.Waiting)+1
+		p.Waiting = append(p.Waiting, e)
+		i = len(p.Waiting) - 1
+	}
+	if adm.Reason != "" {
+		p.Waiting[i].Reason = adm.Reason
+	}
+	return false
+}
+
+// find returns the pool migration id waits in and its index there, -1 if
+// it waits in none.
+func (s *QueueState) find(id string) (string, int) {
+	for name, p := range s.Pools {
+		if i := slices.IndexFunc(p.Waiting, func(e Entry) bool { return e.ID == id }); i >= 0 {
+			return name, i
+		}
+	}
+	return "", -1
+}
+
+// position returns the 1-based position of migration id in its queue, 0 if
+// not queued.
+func (s *QueueState) position(id string) int {
+	_, i := s.find(id)
+	return i + 1
+}
+
+// status returns the queue status of migration id, or nil if it is not queued.
+func (s *QueueState) status(id string) *api.QueueStatus {
+	return s.statusOf(func(e Entry) bool { return e.ID == id })
+}
+
+// statusOf returns the queue status of the first queued migration match
+// accepts, or nil.
+func (s *QueueState) statusOf(match func(e Entry) bool) *api.QueueStatus {
+	for name, p := range s.Pools {
+		for i, e := range p.Waiting {
+			if !match(e) {
+				continue
+			}
+			st := &api.QueueStatus{Position: i + 1, Pool: name, Reason: e.Reason, Since: e.Since}
+			if p.Pace > 0 {
+				eta := p.Moved.Add(time.Duration(i+1) * p.Pace).UTC().Truncate(time.Second)
+				st.ETA = &eta
+			}
+			return st
+		}
+	}
+	return nil
+}
+
+// pool returns the queue of pool name, created if needed.
+func (s *QueueState) pool(name string) *Pool {
+	if s.Pools == nil {
+		s.Pools = map[string]*Pool{}
+	}
+	p, ok := s.Pools[name]
+	if !ok {
+		p = &Pool{}
+		s.Pools[name] = p
+	}
+	return p
+}
+
+// remove takes migration id out of its queue and reports whether it was in one.
+func (s *QueueState) remove(id string) bool {
+	removed := false
+	for _, p := range s.Pools {
+		if p.Starting != nil && p.Starting.ID == id {
+			p.Starting = nil
+			removed = true
+		}
+		if i := slices.IndexFunc(p.Waiting, func(e Entry) bool { return e.ID == id }); i >= 0 {
+			p.Waiting = slices.Delete(p.Waiting, i, i+1)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// touch renews the entries of the migrations ids and reports whether any.
+func (s *QueueState) touch(ids map[string]bool, now time.Time) bool {
+	touched := false
+	for _, p := range s.Pools {
+		if p.Starting != nil && ids[p.Starting.ID] {
+			p.Starting.Seen = now
+			touched = true
+		}
+		for i := range p.Waiting {
+			if ids[p.Waiting[i].ID] {
+				p.Waiting[i].Seen = now
+				touched = true
+			}
+		}
+	}
+	return touched
+}
+
+// prune drops the entries not renewed for stale and reports whether any.
+func (s *QueueState) prune(now time.Time, stale time.Duration) bool {
+	expired := func(e Entry) bool { return now.Sub(e.Seen) > stale }
+	pruned := false
+	for name, p := range s.Pools {
+		if p.Starting != nil && expired(*p.Starting) {
+			log.Printf("GPU queue %s: migration %s of %s/%s expired while starting", name, p.Starting.ID, p.Starting.Namespace, p.Starting.Notebook)
+			p.Starting = nil
+			pruned = true
+		}
+		if n := len(p.Waiting); n > 0 {
+			p.Waiting = slices.DeleteFunc(p.Waiting, expired)
+			pruned = pruned || len(p.Waiting) < n
+		}
+	}
+	return pruned
+}
+
+// learn updates the pace of the queue with e, which just left it.
+func (p *Pool) learn(e Entry, now time.Time) {
+	sample := now.Sub(e.Since) / time.Duration(max(e.QueuedAt, 1))
+	if p.Pace > 0 {
+		sample = (7*p.Pace + 3*sample) / 10
+	}
+	p.Pace, p.Moved = sample, now
+}
+
+func (s *QueueState) clone() *QueueState {
+	out := &QueueState{Pools: make(map[string]*Pool, len(s.Pools))}
+	for name, p := range s.Pools {
+		c := *p
+		c.Waiting = slices.Clone(p.Waiting)
+		if p.Starting != nil {
+			starting := *p.Starting
+			c.Starting = &starting
+		}
+		out.Pools[name] = &c
+	}
+	return out
+}
+
+func sameQueue(a, b *api.QueueStatus) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Position == b.Position && a.Pool == b.Pool && a.Reason == b.Reason && a.Since.Equal(b.Since) &&
+		(a.ETA == nil) == (b.ETA == nil) && (a.ETA == nil || a.ETA.Equal(*b.ETA))
+}
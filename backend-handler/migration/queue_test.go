@@ -0,0 +1,180 @@
+package migration
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// t0 is the fake clock the queue tests pass as now.
+var t0 = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func entry(id string, since time.Time, queuedAt int) Entry {
+	return Entry{ID: id, Namespace: "team", Notebook: "nb-" + id, Since: since, QueuedAt: queuedAt, Seen: since}
+}
+
+func ids(entries []Entry) []string {
+	out := []string{}
+	for _, e := range entries {
+		out = append(out, e.ID)
+	}
+	return out
+}
+
+func TestAdmit(t *testing.T) {
+	free := Admission{OK: true, Pool: "gpu"}
+	full := Admission{Pool: "gpu", Reason: "no free GPU"}
+
+	tests := []struct {
+		name         string
+		pool         Pool
+		id           string
+		adm          Admission
+		wantStart    bool
+		wantWaiting  []string
+		wantStarting string
+		wantReason   string // of id while waiting
+	}{
+		{name: "empty queue, free GPU", id: "a", adm: free, wantStart: true, wantWaiting: []string{}, wantStarting: "a"},
+		{name: "empty queue, no GPU", id: "a", adm: full, wantWaiting: []string{"a"}, wantReason: "no free GPU"},
+		{name: "another one starting", pool: Pool{Starting: &Entry{ID: "s", Seen: t0}}, id: "a", adm: free, wantWaiting: []string{"a"}, wantStarting: "s"},
+		{name: "others waiting", pool: Pool{Waiting: []Entry{entry("w", t0, 1)}}, id: "a", adm: free, wantWaiting: []string{"w", "a"}},
+		{name: "head, free GPU", pool: Pool{Waiting: []Entry{entry("a", t0, 1), entry("b", t0, 2)}}, id: "a", adm: free, wantStart: true, wantWaiting: []string{"b"}, wantStarting: "a"},
+		{name: "head, another one starting", pool: Pool{Waiting: []Entry{entry("a", t0, 1)}, Starting: &Entry{ID: "s", Seen: t0}}, id: "a", adm: free, wantWaiting: []string{"a"}, wantStarting: "s"},
+		{name: "head, no GPU", pool: Pool{Waiting: []Entry{entry("a", t0, 1)}}, id: "a", adm: full, wantWaiting: []string{"a"}, wantReason: "no free GPU"},
+		{name: "behind, free GPU", pool: Pool{Waiting: []Entry{entry("w", t0, 1), entry("a", t0, 2)}}, id: "a", adm: free, wantWaiting: []string{"w", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := tt.pool
+			s := &QueueState{Pools: map[string]*Pool{"gpu": &pool}}
+			now := t0.Add(time.Minute)
+
+			start := s.admit(Entry{ID: tt.id, Namespace: "team", Notebook: "nb-" + tt.id}, tt.adm, now)
+			if start != tt.wantStart {
+				t.Errorf("admit = %v, want %v", start, tt.wantStart)
+			}
+			p := s.Pools["gpu"]
+			if got := ids(p.Waiting); !slices.Equal(got, tt.wantWaiting) {
+				t.Errorf("waiting = %v, want %v", got, tt.wantWaiting)
+			}
+			starting := ""
+			if p.Starting != nil {
+				starting = p.Starting.ID
+			}
+			if starting != tt.wantStarting {
+				t.Errorf("starting = %q, want %q", starting, tt.wantStarting)
+			}
+			if tt.wantStart && (p.Starting.Seen != now || !p.Moved.Equal(now)) {
+				t.Errorf("started entry seen %v, pool moved %v, want %v", p.Starting.Seen, p.Moved, now)
+			}
+			if st := s.status(tt.id); tt.wantReason != "" && (st == nil || st.Reason != tt.wantReason) {
+				t.Errorf("status = %+v, want reason %q", st, tt.wantReason)
+			}
+		})
+	}
+}
+
+// Two migrations admitted one after the other for the same free GPU: the
+// second waits until the first finished.
+func TestAdmitReservesGPU(t *testing.T) {
+	s := &QueueState{}
+	free := Admission{OK: true, Pool: "gpu"}
+	if !s.admit(Entry{ID: "a"}, free, t0) {
+		t.Fatal("first migration not admitted")
+	}
+	if s.admit(Entry{ID: "b"}, free, t0) {
+		t.Fatal("second migration admitted while the first is starting")
+	}
+	if pos := s.position("b"); pos != 1 {
+		t.Fatalf("second migration at position %d, want 1", pos)
+	}
+	if !s.remove("a") {
+		t.Fatal("remove of the starting migration found nothing")
+	}
+	if !s.admit(Entry{ID: "b"}, free, t0.Add(time.Minute)) {
+		t.Fatal("second migration not admitted after the first finished")
+	}
+	if s.remove("a") {
+		t.Error("remove of a migration no longer queued reported a change")
+	}
+}
+
+func TestLearn(t *testing.T) {
+	var p Pool
+	// waited 10m from position 2: 5m per position
+	p.learn(entry("a", t0, 2), t0.Add(10*time.Minute))
+	if p.Pace != 5*time.Minute || !p.Moved.Equal(t0.Add(10*time.Minute)) {
+		t.Fatalf("pace %v moved %v, want 5m at t0+10m", p.Pace, p.Moved)
+	}
+	// moving average: 0.7*5m + 0.3*15m
+	p.learn(entry("b", t0, 1), t0.Add(15*time.Minute))
+	if want := 8 * time.Minute; p.Pace != want {
+		t.Errorf("pace %v, want %v", p.Pace, want)
+	}
+	// admitted without waiting
+	p.learn(entry("c", t0, 0), t0)
+	if want := 8 * time.Minute * 7 / 10; p.Pace != want {
+		t.Errorf("pace %v, want %v", p.Pace, want)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	stale := time.Minute
+	s := &QueueState{Pools: map[string]*Pool{
+		"gpu": {
+			Waiting:  []Entry{entry("old", t0, 1), entry("fresh", t0.Add(50*time.Second), 2)},
+			Starting: &Entry{ID: "gone", Seen: t0},
+		},
+		"a100": {Waiting: []Entry{entry("x", t0.Add(30*time.Second), 1)}},
+	}}
+	if !s.prune(t0.Add(90*time.Second), stale) {
+		t.Fatal("prune reported no change")
+	}
+	if got := ids(s.Pools["gpu"].Waiting); !slices.Equal(got, []string{"fresh"}) {
+		t.Errorf("gpu waiting = %v, want [fresh]", got)
+	}
+	if s.Pools["gpu"].Starting != nil {
+		t.Errorf("expired starting entry kept: %+v", s.Pools["gpu"].Starting)
+	}
+	if got := ids(s.Pools["a100"].Waiting); !slices.Equal(got, []string{"x"}) {
+		t.Errorf("a100 waiting = %v, want [x]", got)
+	}
+	if s.prune(t0.Add(90*time.Second), stale) {
+		t.Error("second prune reported a change")
+	}
+
+	if !s.touch(map[string]bool{"x": true}, t0.Add(2*time.Minute)) {
+		t.Fatal("touch found nothing")
+	}
+	s.prune(t0.Add(150*time.Second), stale)
+	if got := ids(s.Pools["a100"].Waiting); !slices.Equal(got, []string{"x"}) {
+		t.Errorf("renewed entry pruned: %v", got)
+	}
+}
+
+func TestStatusOf(t *testing.T) {
+	s := &QueueState{Pools: map[string]*Pool{
+		"gpu": {Waiting: []Entry{entry("a", t0, 1), entry("b", t0.Add(time.Minute), 2)}, Pace: 90 * time.Second, Moved: t0.Add(2 * time.Minute)},
+		"t4":  {Waiting: []Entry{entry("c", t0, 1)}},
+	}}
+	s.Pools["gpu"].Waiting[1].Reason = "no free GPU"
+
+	st := s.status("b")
+	if st == nil || st.Position != 2 || st.Pool != "gpu" || st.Reason != "no free GPU" || !st.Since.Equal(t0.Add(time.Minute)) {
+		t.Fatalf("status(b) = %+v", st)
+	}
+	// moved + 2 positions * 90s
+	if want := t0.Add(5 * time.Minute); st.ETA == nil || !st.ETA.Equal(want) {
+		t.Errorf("ETA = %v, want %v", st.ETA, want)
+	}
+	if st := s.status("c"); st == nil || st.Position != 1 || st.ETA != nil {
+		t.Errorf("status(c) = %+v, want position 1 without ETA", st)
+	}
+	if st := s.statusOf(func(e Entry) bool { return e.Notebook == "nb-a" }); st == nil || st.Position != 1 || st.Pool != "gpu" {
+		t.Errorf("status of notebook nb-a = %+v", st)
+	}
+	if st := s.status("none"); st != nil {
+		t.Errorf("status of an unknown migration = %+v", st)
+	}
+}
@@ -0,0 +1,199 @@
+package migration
+
+import (
+	"backend-handler/api"
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"sync"
+	"time"
+)
+
+// MigrationState holds the migrations of all the replicas. It is kept in a
+// MigrationStore they share, so that any of them serves GET and DELETE
+// /migrations/{id} and finds the migrations in progress of a notebook.
+type MigrationState struct {
+	Migrations map[string]*Record `json:"migrations,omitempty"`
+}
+
+// Record is a migration and the replica running it.
+type Record struct {
+	api.Migration
+	// Owner is the replica running the migration. It renews Seen until the
+	// migration is done; those of replicas that are gone fail (see
+	// Manager.migrationStale).
+	Owner string    `json:"owner"`
+	Seen  time.Time `json:"seen"`
+	// CancelRequested asks Owner to cancel the migration.
+	CancelRequested bool `json:"cancelRequested,omitempty"`
+}
+
+// MigrationStore keeps the MigrationState, like QueueStore the QueueState.
+type MigrationStore interface {
+	// Load returns the current state.
+	Load(ctx context.Context) (*MigrationState, error)
+	// Update applies fn to the current state, saves it if fn reports a
+	// change and returns it, atomically with respect to the other users of
+	// the store. fn may be called more than once.
+	Update(ctx context.Context, fn func(s *MigrationState) bool) (*MigrationState, error)
+}
+
+// memoryMigrations keeps the migrations in memory, for a single replica.
+type memoryMigrations struct {
+	mu    sync.Mutex
+	state MigrationState
+}
+
+func (m *memoryMigrations) Load(context.Context) (*MigrationState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state.clone(), nil
+}
+
+func (m *memoryMigrations) Update(_ context.Context, fn func(s *MigrationState) bool) (*MigrationState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(&m.state)
+	return m.state.clone(), nil
+}
+
+// migrationStale is how long the migrations of a replica live without being
+// renewed.
+func (mg *Manager) migrationStale() time.Duration {
+	return max(6*mg.SyncInterval, 30*time.Second)
+}
+
+// updateMigrations is Migrations.Update with the migrations finished longer
+// than Retention ago dropped and those of replicas that are gone failed.
+func (mg *Manager) updateMigrations(ctx context.Context, fn func(s *MigrationState, now time.Time) bool) (*MigrationState, error) {
+	stale := mg.migrationStale()
+	return mg.Migrations.Update(ctx, func(s *MigrationState) bool {
+		now := time.Now().UTC()
+		pruned := s.prune(now, mg.Retention, stale)
+		return fn(s, now) || pruned
+	})
+}
+
+// save records m, a migration of this replica, in the store unless a newer
+// version of it is there already.
+func (mg *Manager) save(m api.Migration) {
+	// The migration's context may be done already
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := mg.updateMigrations(ctx, func(s *MigrationState, now time.Time) bool {
+		r, ok := s.Migrations[m.ID]
+		if ok && r.Version >= m.Version {
+			return false
+		}
+		s.put(&Record{Migration: m, Owner: mg.Replica, Seen: now, CancelRequested: ok && r.CancelRequested})
+		return true
+	})
+	if err != nil {
+		log.Printf("Migration %s: save: %v", m.ID, err)
+	}
+}
+
+// stored returns migration id as the store has it.
+func (mg *Manager) stored(ctx context.Context, id string) (api.Migration, error) {
+	state, err := mg.Migrations.Load(ctx)
+	if err != nil {
+		return api.Migration{}, err
+	}
+	r, ok := state.Migrations[id]
+	if !ok {
+		return api.Migration{}, ErrNotFound
+	}
+	return r.Migration, nil
+}
+
+// syncMigrations renews the migrations of this replica in the store every
+// SyncInterval and cancels those another replica was asked to cancel.
+func (mg *Manager) syncMigrations() {
+	ticker := time.NewTicker(mg.SyncInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ids := map[string]bool{}
+		mg.mu.Lock()
+		for id, it := range mg.items {
+			if !it.m.Done() {
+				ids[id] = true
+			}
+		}
+		mg.mu.Unlock()
+		if len(ids) == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), mg.SyncInterval)
+		state, err := mg.updateMigrations(ctx, func(s *MigrationState, now time.Time) bool {
+			for id := range ids {
+				if r, ok := s.Migrations[id]; ok {
+					r.Seen = now
+				}
+			}
+			return true
+		})
+		cancel()
+		if err != nil {
+			log.Printf("Renew migrations: %v", err)
+			continue
+		}
+		mg.mu.Lock()
+		for id := range ids {
+			if it, ok := mg.items[id]; ok && state.Migrations[id] != nil && state.Migrations[id].CancelRequested {
+				it.cancel()
+			}
+		}
+		mg.mu.Unlock()
+	}
+}
+
+// active returns the migration of notebook that is not done yet, if any.
+func (s *MigrationState) active(namespace, notebook string) *Record {
+	for _, r := range s.Migrations {
+		if !r.Done() && r.Namespace == namespace && r.Notebook == notebook {
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *MigrationState) put(r *Record) {
+	if s.Migrations == nil {
+		s.Migrations = map[string]*Record{}
+	}
+	s.Migrations[r.ID] = r
+}
+
+// prune drops the migrations finished longer than retention ago and fails
+// those not renewed for stale, and reports whether it changed anything.
+func (s *MigrationState) prune(now time.Time, retention, stale time.Duration) bool {
+	changed := false
+	for id, r := range s.Migrations {
+		switch {
+		case r.Finished != nil && now.Sub(*r.Finished) > retention:
+			delete(s.Migrations, id)
+		case !r.Done() && now.Sub(r.Seen) > stale:
+			r.State = api.StateFailed
+			r.Step = ""
+			r.Queue = nil
+			r.Error = fmt.Sprintf("replica %s running the migration is gone", r.Owner)
+			r.Code = api.CodeInternal
+			r.Finished = &now
+			r.Version++
+		default:
+			continue
+		}
+		changed = true
+	}
+	return changed
+}
+
+func (s *MigrationState) clone() *MigrationState {
+	c := &MigrationState{Migrations: maps.Clone(s.Migrations)}
+	for id, r := range c.Migrations {
+		r := *r
+		c.Migrations[id] = &r
+	}
+	return c
+}
@@ -0,0 +1,118 @@
+package migration
+
+import (
+	"backend-handler/api"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// replicas returns two Managers sharing their migrations, as two replicas
+// of the backend do. Their migrations run until cancelled or release is
+// closed.
+func replicas(release chan struct{}) (*Manager, *Manager) {
+	run := func(ctx context.Context, req api.MigrationRequest, progress func(string)) (string, string, error) {
+		progress("running")
+		select {
+		case <-ctx.Done():
+			return "", "", ctx.Err()
+		case <-release:
+			return req.Notebook + "-gpu", "/url", nil
+		}
+	}
+	code := func(error) string { return api.CodeInternal }
+	store := &memoryMigrations{}
+	a, b := NewManager(run, code), NewManager(run, code)
+	a.Migrations, b.Migrations = store, store
+	a.SyncInterval, b.SyncInterval = 10*time.Millisecond, 10*time.Millisecond
+	return a, b
+}
+
+func TestSharedMigrations(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	release := make(chan struct{})
+	a, b := replicas(release)
+	req := api.MigrationRequest{Namespace: "team", Notebook: "nb", Direction: api.DirectionToGPU}
+
+	m, err := a.Start(ctx, req)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	var conflict *ConflictError
+	if _, err := b.Start(ctx, req); !errors.As(err, &conflict) || conflict.ID != m.ID {
+		t.Fatalf("Start on the other replica = %v, want a conflict with %s", err, m.ID)
+	}
+	if got, err := b.Get(ctx, m.ID); err != nil || got.ID != m.ID {
+		t.Fatalf("Get on the other replica = %+v, %v", got, err)
+	}
+	if list, err := b.List(ctx, "team", "nb"); err != nil || len(list) != 1 || list[0].ID != m.ID {
+		t.Fatalf("List on the other replica = %+v, %v", list, err)
+	}
+
+	close(release)
+	for !m.Done() {
+		if m, err = b.Wait(ctx, m.ID, m.Version); err != nil || ctx.Err() != nil {
+			t.Fatalf("Wait on the other replica = %+v, %v", m, err)
+		}
+	}
+	if m.State != api.StateSucceeded || m.NewNotebook != "nb-gpu" {
+		t.Errorf("migration seen by the other replica = %+v", m)
+	}
+	if _, err := b.Start(ctx, req); err != nil {
+		t.Errorf("Start after the first migration finished: %v", err)
+	}
+	if _, err := b.Get(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of an unknown migration = %v, want ErrNotFound", err)
+	}
+}
+
+func TestCancelOnOtherReplica(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a, b := replicas(make(chan struct{}))
+
+	m, err := a.Start(ctx, api.MigrationRequest{Namespace: "team", Notebook: "nb", Direction: api.DirectionToCPU})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if _, err := b.Cancel(ctx, m.ID); err != nil {
+		t.Fatalf("Cancel on the other replica: %v", err)
+	}
+	for !m.Done() {
+		if m, err = b.Wait(ctx, m.ID, m.Version); err != nil || ctx.Err() != nil {
+			t.Fatalf("Wait = %+v, %v", m, err)
+		}
+	}
+	if m.State != api.StateCancelled {
+		t.Errorf("state = %s, want %s", m.State, api.StateCancelled)
+	}
+	if _, err := b.Cancel(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Cancel of an unknown migration = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMigrationStatePrune(t *testing.T) {
+	done := t0.Add(-2 * time.Hour)
+	s := &MigrationState{Migrations: map[string]*Record{
+		"old":   {Migration: api.Migration{ID: "old", State: api.StateSucceeded, Finished: &done}, Seen: done},
+		"gone":  {Migration: api.Migration{ID: "gone", State: api.StateRunning, Version: 3}, Owner: "r1", Seen: t0.Add(-time.Minute)},
+		"alive": {Migration: api.Migration{ID: "alive", State: api.StateRunning}, Seen: t0.Add(-10 * time.Second)},
+	}}
+	if !s.prune(t0, time.Hour, 30*time.Second) {
+		t.Fatal("prune reported no change")
+	}
+	if _, ok := s.Migrations["old"]; ok {
+		t.Error("migration finished before the retention kept")
+	}
+	if r := s.Migrations["gone"]; r.State != api.StateFailed || r.Finished == nil || r.Version != 4 || r.Code != api.CodeInternal {
+		t.Errorf("migration of a replica that is gone = %+v", r)
+	}
+	if r := s.Migrations["alive"]; r.State != api.StateRunning {
+		t.Errorf("renewed migration = %+v", r)
+	}
+	if s.prune(t0, time.Hour, 30*time.Second) {
+		t.Error("second prune reported a change")
+	}
+}
@@ -0,0 +1,132 @@
+package migration
+
+import (
+	"backend-handler/retry"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The ConfigMap keys of the queue state and of the migrations.
+const (
+	queueKey      = "queue.json"
+	migrationsKey = "migrations.json"
+)
+
+// ConfigMapStore keeps the queue state in ConfigMap Name of Namespace, so
+// that the replicas of the backend share it. Updates are optimistic and
+// retried on conflicts.
+type ConfigMapStore struct {
+	Clientset kubernetes.Interface
+	Namespace string
+	Name      string
+}
+
+func (s *ConfigMapStore) Load(ctx context.Context) (*QueueState, error) {
+	return s.doc().load(ctx)
+}
+
+func (s *ConfigMapStore) Update(ctx context.Context, fn func(s *QueueState) bool) (*QueueState, error) {
+	return s.doc().update(ctx, fn)
+}
+
+func (s *ConfigMapStore) doc() configMapDoc[QueueState] {
+	return configMapDoc[QueueState]{s.Clientset, s.Namespace, s.Name, queueKey, "GPU queue"}
+}
+
+// ConfigMapMigrationStore keeps the migrations in ConfigMap Name of
+// Namespace, like ConfigMapStore the queue state.
+type ConfigMapMigrationStore struct {
+	Clientset kubernetes.Interface
+	Namespace string
+	Name      string
+}
+
+func (s *ConfigMapMigrationStore) Load(ctx context.Context) (*MigrationState, error) {
+	return s.doc().load(ctx)
+}
+
+func (s *ConfigMapMigrationStore) Update(ctx context.Context, fn func(s *MigrationState) bool) (*MigrationState, error) {
+	return s.doc().update(ctx, fn)
+}
+
+func (s *ConfigMapMigrationStore) doc() configMapDoc[MigrationState] {
+	return configMapDoc[MigrationState]{s.Clientset, s.Namespace, s.Name, migrationsKey, "migrations"}
+}
+
+// configMapDoc is a JSON document, what, under key of a ConfigMap.
+type configMapDoc[T any] struct {
+	clientset       kubernetes.Interface
+	namespace, name string
+	key, what       string
+}
+
+func (d configMapDoc[T]) load(ctx context.Context) (*T, error) {
+	cm, err := d.clientset.CoreV1().ConfigMaps(d.namespace).Get(ctx, d.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return new(T), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get %s %s/%s: %w", d.what, d.namespace, d.name, err)
+	}
+	return d.decode(cm), nil
+}
+
+func (d configMapDoc[T]) update(ctx context.Context, fn func(v *T) bool) (v *T, err error) {
+	cms := d.clientset.CoreV1().ConfigMaps(d.namespace)
+	err = retry.Do(ctx, retry.DefaultBackoff, func() error {
+		cm, err := cms.Get(ctx, d.name, metav1.GetOptions{})
+		create := apierrors.IsNotFound(err)
+		if create {
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: d.name, Namespace: d.namespace}}
+		} else if err != nil {
+			return err
+		}
+		v = d.decode(cm)
+		if !fn(v) {
+			return nil
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[d.key] = string(data)
+		if !create {
+			_, err = cms.Update(ctx, cm, metav1.UpdateOptions{})
+			return err
+		}
+		_, err = cms.Create(ctx, cm, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// created by another replica meanwhile: retry against it
+			return apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, d.name, err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("update %s %s/%s: %w", d.what, d.namespace, d.name, err)
+	}
+	return v, nil
+}
+
+// decode returns the document in cm; one that cannot be read is started
+// over.
+func (d configMapDoc[T]) decode(cm *corev1.ConfigMap) *T {
+	v := new(T)
+	if data := cm.Data[d.key]; data != "" {
+		if err := json.Unmarshal([]byte(data), v); err != nil {
+			log.Printf("%s %s/%s is invalid, starting it over: %v", d.what, d.namespace, d.name, err)
+			return new(T)
+		}
+	}
+	return v
+}
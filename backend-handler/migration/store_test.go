@@ -0,0 +1,130 @@
+package migration
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// failFirst makes the first verb request on configmaps fail with err.
+func failFirst(cs *fake.Clientset, verb string, err error) {
+	failed := false
+	cs.PrependReactor(verb, "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if failed {
+			return false, nil, nil
+		}
+		failed = true
+		return true, nil, err
+	})
+}
+
+func TestConfigMapStore(t *testing.T) {
+	ctx := context.Background()
+	conflict := apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "queue", nil)
+	exists := apierrors.NewAlreadyExists(schema.GroupResource{Resource: "configmaps"}, "queue")
+
+	tests := []struct {
+		name      string
+		existing  bool
+		fail      string // verb failing once
+		err       error
+		wantCalls int
+	}{
+		{name: "create", wantCalls: 1},
+		{name: "update", existing: true, wantCalls: 1},
+		{name: "update conflict", existing: true, fail: "update", err: conflict, wantCalls: 2},
+		{name: "created meanwhile", fail: "create", err: exists, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := fake.NewSimpleClientset()
+			if tt.existing {
+				cs = fake.NewSimpleClientset(&corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Name: "queue", Namespace: "sys"},
+					Data:       map[string]string{"other": "kept", queueKey: `{"pools":{"gpu":{"waiting":[{"id":"w"}]}}}`},
+				})
+			}
+			if tt.fail != "" {
+				failFirst(cs, tt.fail, tt.err)
+			}
+			store := &ConfigMapStore{Clientset: cs, Namespace: "sys", Name: "queue"}
+
+			calls := 0
+			got, err := store.Update(ctx, func(s *QueueState) bool {
+				calls++
+				s.admit(Entry{ID: "a"}, Admission{Pool: "gpu"}, t0)
+				return true
+			})
+			if err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("fn called %d times, want %d", calls, tt.wantCalls)
+			}
+			want := 1
+			if tt.existing {
+				want = 2
+			}
+			if pos := got.position("a"); pos != want {
+				t.Errorf("returned state has a at position %d, want %d", pos, want)
+			}
+
+			loaded, err := store.Load(ctx)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if pos := loaded.position("a"); pos != want {
+				t.Errorf("saved state has a at position %d, want %d", pos, want)
+			}
+			cm, _ := cs.CoreV1().ConfigMaps("sys").Get(ctx, "queue", metav1.GetOptions{})
+			if tt.existing && cm.Data["other"] != "kept" {
+				t.Errorf("other keys of the ConfigMap lost: %v", cm.Data)
+			}
+		})
+	}
+}
+
+func TestConfigMapStoreNoChange(t *testing.T) {
+	cs := fake.NewSimpleClientset()
+	store := &ConfigMapStore{Clientset: cs, Namespace: "sys", Name: "queue"}
+	if _, err := store.Update(context.Background(), func(*QueueState) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range cs.Actions() {
+		if a.GetVerb() != "get" {
+			t.Errorf("unchanged state written: %s", a.GetVerb())
+		}
+	}
+}
+
+func TestConfigMapStoreGivesUp(t *testing.T) {
+	cs := fake.NewSimpleClientset(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "queue", Namespace: "sys"}})
+	cs.PrependReactor("update", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "queue", nil)
+	})
+	store := &ConfigMapStore{Clientset: cs, Namespace: "sys", Name: "queue"}
+	calls := 0
+	_, err := store.Update(context.Background(), func(*QueueState) bool { calls++; return true })
+	if !apierrors.IsForbidden(err) || calls != 1 {
+		t.Errorf("Update = %v after %d calls, want Forbidden after 1", err, calls)
+	}
+}
+
+func TestConfigMapStoreInvalid(t *testing.T) {
+	cs := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "queue", Namespace: "sys"},
+		Data:       map[string]string{queueKey: "{not json"},
+	})
+	store := &ConfigMapStore{Clientset: cs, Namespace: "sys", Name: "queue"}
+	s, err := store.Load(context.Background())
+	if err != nil || len(s.Pools) != 0 {
+		t.Errorf("Load of an invalid state = %+v, %v, want an empty one", s, err)
+	}
+}
@@ -0,0 +1,103 @@
+package switcher
+
+import (
+	nbpods "backend-handler/get-nbpods-name"
+	"backend-handler/tracing"
+	"backend-handler/workload"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// defaultCheckpointTimeout bounds a checkpoint command without a configured timeout.
+const defaultCheckpointTimeout = 5 * time.Minute
+
+// newestScript prints the newest modification time (Unix seconds) of the
+// files under $1, or nothing if there are none.
+const newestScript = `find "$1" -type f -exec stat -c %Y {} + 2>/dev/null | sort -n | tail -n 1`
+
+// checkpoint runs the namespace's checkpoint command in the notebook container
+// of src, the old notebook, and verifies through newPod, which mounts the same
+// workspace volume, that the artifact was written. An error means the old
+// notebook must be kept. Stopped notebooks have no state to save and are skipped.
+func checkpoint(ctx context.Context, cfg *rest.Config, cs kubernetes.Interface, backend workload.Backend, nsCfg *Config, src *workload.Workload, newPod string) (err error) {
+	ck := nsCfg.Checkpoint
+	if ck == nil {
+		return nil
+	}
+	ctx, span := tracer.Start(ctx, "checkpoint", trace.WithAttributes(
+		attribute.String("notebook.name", src.Name),
+		attribute.String("checkpoint.artifact", ck.Artifact),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	pod, err := backend.Pod(ctx, src.Namespace, src.Name)
+	if err != nil {
+		return fmt.Errorf("get pod of %s: %w", src.Name, err)
+	}
+	if pod == nil {
+		fmt.Printf("Notebook %s/%s has no pod, skipping checkpoint\n", src.Namespace, src.Name)
+		return nil
+	}
+	idx, err := mainContainer(src, nsCfg.NotebookContainer, src.Name)
+	if err != nil {
+		return err
+	}
+	container := src.PodSpec().Containers[idx].Name
+
+	var before int64
+	if ck.Artifact != "" {
+		if before, err = newest(ctx, cfg, cs, src.Namespace, pod.Name, container, ck.Artifact); err != nil {
+			return err
+		}
+	}
+
+	timeout := ck.Timeout
+	if timeout == 0 {
+		timeout = defaultCheckpointTimeout
+	}
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := nbpods.Exec(runCtx, cfg, cs, src.Namespace, pod.Name, container, []string{"sh", "-c", ck.Command}, nil, nil, nil); err != nil {
+		return fmt.Errorf("checkpoint command: %w", err)
+	}
+
+	if ck.Artifact == "" {
+		return nil
+	}
+	after, err := newest(ctx, cfg, cs, src.Namespace, newPod, container, ck.Artifact)
+	if err != nil {
+		return err
+	}
+	if after == 0 || after <= before {
+		return fmt.Errorf("checkpoint artifact %q not updated on the workspace volume", ck.Artifact)
+	}
+	fmt.Printf("Checkpoint of %s/%s verified in %s\n", src.Namespace, src.Name, newPod)
+	return nil
+}
+
+// newest returns the newest modification time of the files under path in a
+// container, 0 if there are none.
+func newest(ctx context.Context, cfg *rest.Config, cs kubernetes.Interface, namespace, pod, container, path string) (int64, error) {
+	var out bytes.Buffer
+	if err := nbpods.Exec(ctx, cfg, cs, namespace, pod, container, []string{"sh", "-c", newestScript, "sh", path}, nil, &out, nil); err != nil {
+		return 0, fmt.Errorf("stat checkpoint artifact in %s: %w", pod, err)
+	}
+	s := strings.TrimSpace(out.String())
+	if s == "" {
+		return 0, nil
+	}
+	t, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("stat checkpoint artifact in %s: unexpected output %q", pod, s)
+	}
+	return t, nil
+}
@@ -0,0 +1,314 @@
+package switcher
+
+import (
+	"backend-handler/api"
+	"backend-handler/policy"
+	"backend-handler/retry"
+	"backend-handler/tracing"
+	"backend-handler/workload"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ConfigMap "gpu-switcher-config" in the notebook namespace configures the switcher:
+//   - gpuResourceKey, numGpuResource: resource key and count of the "default" profile
+//   - profiles: optional JSON object of named profiles, e.g.
+//     {"a100": {"resourceKey": "nvidia.com/gpu", "count": 2, "runtimeClassName": "nvidia"}}
+//   - workloadBackend: "kubeflow" (default), "statefulset" or "jupyterhub", see package workload
+//   - urlTemplate: notebook URL, default "/notebook/{namespace}/{name}/"
+//   - documentURLTemplate: URL opening a document, e.g. "/notebook/{namespace}/{name}/lab/tree/{path}";
+//     by default "lab/tree/{path}" is appended to the notebook URL
+//   - timeouts: JSON api.Timeouts of migrations, e.g. {"podReady": "10m", "drain": "0s",
+//     "awaitDeletion": true}; GPU profiles may override them under "timeouts"
+//   - cpuPlacement: JSON api.Placement (env, nodeSelector, tolerations, affinity) of
+//     CPU notebooks; GPU profiles carry the same fields
+//   - imageMap: JSON list of api.ImageRule swapping CPU and GPU images, e.g.
+//     [{"from": "kubeflownotebookswg/jupyter-scipy:v1.8.0", "to": "kubeflownotebookswg/jupyter-pytorch-cuda:v1.8.0"}]
+//   - allowedRegistries: comma-separated registries/prefixes mapped images must come from
+//   - notebookContainer: name of the container that gets the GPUs (see mainContainer)
+//   - checkpointCommand, checkpointArtifact, checkpointTimeout: checkpoint run in
+//     the old pod before it is deleted, see api.Checkpoint
+//   - transferPaths, transferMaxBytes, transferMaxFileBytes: comma-separated paths
+//     copied to the new pod and size limits (quantities, default 1Gi and 100Mi)
+//   - hubCPUProfile: CPU KubeSpawner profile of the jupyterhub backend
+//
+// The namespace policy is not read from it, since the tenant may edit it,
+// but from PolicyConfigMapName.
+const (
+	ConfigMapName = "gpu-switcher-config"
+
+	cmKeyGPUResource = "gpuResourceKey"
+	cmKeyNumGPU      = "numGpuResource"
+	cmKeyProfiles    = "profiles"
+	cmKeyBackend     = "workloadBackend"
+	cmKeyURLTemplate = "urlTemplate"
+	cmKeyDocURL      = "documentURLTemplate"
+	cmKeyContainer   = "notebookContainer"
+	cmKeyImageMap    = "imageMap"
+	cmKeyCPU         = "cpuPlacement"
+	cmKeyTimeouts    = "timeouts"
+	cmKeyRegistries  = "allowedRegistries"
+	cmKeyCkptCmd     = "checkpointCommand"
+	cmKeyCkptPath    = "checkpointArtifact"
+	cmKeyCkptTimeout = "checkpointTimeout"
+	cmKeyXferPaths   = "transferPaths"
+	cmKeyXferMax     = "transferMaxBytes"
+	cmKeyXferFileMax = "transferMaxFileBytes"
+	cmKeyHubCPU      = "hubCPUProfile"
+)
+
+// ConfigMap PolicyConfigMapName, in the namespace of the backend (env
+// EnvPolicyNamespace, "default" if unset), holds the namespace policies of the
+// admins: one key per tenant namespace, its policy a JSON object of the keys
+// of package policy, e.g. team-a: {"maxGpuNotebooks": "2", "idleTimeout": "15m"}.
+// Namespaces without a key have no limits.
+const (
+	PolicyConfigMapName = "gpu-switcher-policy"
+	EnvPolicyNamespace  = "POD_NAMESPACE"
+)
+
+// DefaultProfile is used when a request does not name a profile.
+const DefaultProfile = "default"
+
+// Profile is a GPU flavour a notebook can be migrated to.
+type Profile = api.Profile
+
+// Config is the switcher configuration of one namespace; it is served as is by GET /profiles.
+type Config api.NamespaceConfig
+
+// LoadConfig reads the configuration of namespace ns. A missing ConfigMap
+// yields the defaults: profile "default" with 1 "nvidia.com/gpu" and no policy limits.
+func LoadConfig(ctx context.Context, cs kubernetes.Interface, ns string) (_ *Config, err error) {
+	ctx, span := tracer.Start(ctx, "load switcher config")
+	defer func() { tracing.End(span, err) }()
+
+	data := map[string]string{}
+	cm, err := cs.CoreV1().ConfigMaps(ns).Get(ctx, ConfigMapName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		err = nil
+	case err != nil:
+		return nil, fmt.Errorf("get configmap %s/%s: %w", ns, ConfigMapName, err)
+	default:
+		data = cm.Data
+	}
+	c, err := parseConfig(ns, data)
+	if err != nil {
+		return nil, err
+	}
+	if c.Policy, err = loadPolicy(ctx, cs, ns); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadPolicy reads the policy of namespace ns from PolicyConfigMapName.
+func loadPolicy(ctx context.Context, cs kubernetes.Interface, ns string) (policy.Policy, error) {
+	pns := os.Getenv(EnvPolicyNamespace)
+	if pns == "" {
+		pns = "default"
+	}
+	cm, err := cs.CoreV1().ConfigMaps(pns).Get(ctx, PolicyConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return policy.Policy{}, nil
+	}
+	if err != nil {
+		return policy.Policy{}, fmt.Errorf("get configmap %s/%s: %w", pns, PolicyConfigMapName, err)
+	}
+	return parsePolicy(cm.Data, ns)
+}
+
+// parsePolicy returns the policy of namespace ns in the data of
+// PolicyConfigMapName.
+func parsePolicy(data map[string]string, ns string) (policy.Policy, error) {
+	var p policy.Policy
+	if raw := data[ns]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &p); err != nil {
+			return policy.Policy{}, fmt.Errorf("%s: namespace %q: %w", PolicyConfigMapName, ns, err)
+		}
+	}
+	return p, nil
+}
+
+func parseConfig(ns string, data map[string]string) (*Config, error) {
+	c := &Config{
+		Namespace:           ns,
+		Profiles:            map[string]Profile{},
+		WorkloadBackend:     workload.KindKubeflow,
+		URLTemplate:         data[cmKeyURLTemplate],
+		DocumentURLTemplate: data[cmKeyDocURL],
+		NotebookContainer:   data[cmKeyContainer],
+		HubCPUProfile:       data[cmKeyHubCPU],
+	}
+	if v := data[cmKeyBackend]; v != "" {
+		c.WorkloadBackend = v
+	}
+
+	def := Profile{Name: DefaultProfile, ResourceKey: "nvidia.com/gpu", Count: 1, RuntimeClassName: "nvidia"}
+	if data[cmKeyGPUResource] != "" && data[cmKeyNumGPU] != "" {
+		def.ResourceKey = data[cmKeyGPUResource]
+		n, err := strconv.Atoi(data[cmKeyNumGPU])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%s: invalid GPU count %q", cmKeyNumGPU, data[cmKeyNumGPU])
+		}
+		def.Count = n
+	}
+	c.Profiles[DefaultProfile] = withHubProfile(def)
+
+	if raw := data[cmKeyProfiles]; raw != "" {
+		var profiles map[string]Profile
+		if err := json.Unmarshal([]byte(raw), &profiles); err != nil {
+			return nil, fmt.Errorf("%s: %w", cmKeyProfiles, err)
+		}
+		for name, p := range profiles {
+			p.Name = name
+			if p.ResourceKey == "" {
+				p.ResourceKey = def.ResourceKey
+			}
+			if p.Count == 0 {
+				p.Count = 1
+			}
+			if p.Count < 0 {
+				return nil, fmt.Errorf("%s: profile %q: invalid GPU count %d", cmKeyProfiles, name, p.Count)
+			}
+			if err := validateTimeouts(p.Timeouts); err != nil {
+				return nil, fmt.Errorf("%s: profile %q: timeouts: %w", cmKeyProfiles, name, err)
+			}
+			c.Profiles[name] = withHubProfile(p)
+		}
+	}
+
+	if raw := data[cmKeyTimeouts]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &c.Timeouts); err != nil {
+			return nil, fmt.Errorf("%s: %w", cmKeyTimeouts, err)
+		}
+		if err := validateTimeouts(c.Timeouts); err != nil {
+			return nil, fmt.Errorf("%s: %w", cmKeyTimeouts, err)
+		}
+	}
+	if raw := data[cmKeyCPU]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &c.CPUPlacement); err != nil {
+			return nil, fmt.Errorf("%s: %w", cmKeyCPU, err)
+		}
+	}
+	if raw := data[cmKeyImageMap]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &c.ImageMap); err != nil {
+			return nil, fmt.Errorf("%s: %w", cmKeyImageMap, err)
+		}
+		if err := validateImageMap(c.ImageMap); err != nil {
+			return nil, fmt.Errorf("%s: %w", cmKeyImageMap, err)
+		}
+	}
+	c.AllowedRegistries = splitList(data[cmKeyRegistries])
+
+	if cmd := strings.TrimSpace(data[cmKeyCkptCmd]); cmd != "" {
+		c.Checkpoint = &api.Checkpoint{Command: cmd, Artifact: strings.TrimSpace(data[cmKeyCkptPath])}
+		if v := strings.TrimSpace(data[cmKeyCkptTimeout]); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("%s: invalid duration %q", cmKeyCkptTimeout, v)
+			}
+			c.Checkpoint.Timeout = d
+		}
+	}
+
+	if paths := splitList(data[cmKeyXferPaths]); len(paths) > 0 {
+		c.Transfer = &api.Transfer{Paths: paths}
+		var err error
+		if c.Transfer.MaxBytes, err = parseBytes(data, cmKeyXferMax, "1Gi"); err != nil {
+			return nil, err
+		}
+		if c.Transfer.MaxFileBytes, err = parseBytes(data, cmKeyXferFileMax, "100Mi"); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// splitList splits a comma-separated ConfigMap value, dropping empty items.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// parseBytes reads a size such as "512Mi" from key, or def if it is unset.
+func parseBytes(data map[string]string, key, def string) (int64, error) {
+	v := strings.TrimSpace(data[key])
+	if v == "" {
+		v = def
+	}
+	q, err := resource.ParseQuantity(v)
+	if err != nil || q.Sign() <= 0 {
+		return 0, fmt.Errorf("%s: invalid size %q", key, v)
+	}
+	return q.Value(), nil
+}
+
+func withHubProfile(p Profile) Profile {
+	if p.HubProfile == "" {
+		p.HubProfile = p.Name
+	}
+	return p
+}
+
+// Profile returns the named profile ("" selects DefaultProfile).
+func (c *Config) Profile(name string) (Profile, error) {
+	if name == "" {
+		name = DefaultProfile
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown GPU profile %q in namespace %q", name, c.Namespace)
+	}
+	return p, nil
+}
+
+// ProfileNames returns the profile names in alphabetical order.
+func (c *Config) ProfileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Backend returns the workload backend of the namespace, retrying transient
+// API errors.
+func (c *Config) Backend(dc dynamic.Interface, cs kubernetes.Interface) (workload.Backend, error) {
+	b, err := workload.New(c.WorkloadBackend, dc, cs, workload.Options{URLTemplate: c.URLTemplate})
+	if err != nil {
+		return nil, err
+	}
+	return workload.WithRetry(b, retry.DefaultBackoff), nil
+}
+
+// ResourceKeys returns every GPU resource key used by the profiles.
+func (c *Config) ResourceKeys() []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, name := range c.ProfileNames() {
+		if k := c.Profiles[name].ResourceKey; !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
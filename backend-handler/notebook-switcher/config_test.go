@@ -0,0 +1,52 @@
+package switcher
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func configMap(ns, name string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}, Data: data}
+}
+
+// The policy comes from the admins' ConfigMap, never from the tenant's own.
+func TestLoadConfigPolicy(t *testing.T) {
+	t.Setenv(EnvPolicyNamespace, "gpu-system")
+	ctx := context.Background()
+	tenant := configMap("team-a", ConfigMapName, map[string]string{"maxGpuNotebooks": "100", "maxGpuSessionDuration": "1000h"})
+
+	tests := []struct {
+		name    string
+		policy  *corev1.ConfigMap
+		wantMax int
+		wantErr bool
+	}{
+		{name: "no policy ConfigMap"},
+		{name: "other namespaces only", policy: configMap("gpu-system", PolicyConfigMapName, map[string]string{"team-b": `{"maxGpuNotebooks": "3"}`})},
+		{name: "policy of the namespace", policy: configMap("gpu-system", PolicyConfigMapName, map[string]string{"team-a": `{"maxGpuNotebooks": "2"}`}), wantMax: 2},
+		{name: "policy in the tenant namespace", policy: configMap("team-a", PolicyConfigMapName, map[string]string{"team-a": `{"maxGpuNotebooks": "2"}`})},
+		{name: "invalid policy", policy: configMap("gpu-system", PolicyConfigMapName, map[string]string{"team-a": `{"maxGpuNotebooks": "two"}`}), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := fake.NewSimpleClientset(tenant)
+			if tt.policy != nil {
+				cs = fake.NewSimpleClientset(tenant, tt.policy)
+			}
+			cfg, err := LoadConfig(ctx, cs, "team-a")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig error = %v, want error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if cfg.Policy.MaxGPUNotebooks != tt.wantMax || cfg.Policy.MaxGPUSession != 0 {
+				t.Errorf("policy = %+v, want maxGpuNotebooks %d and nothing from the tenant", cfg.Policy, tt.wantMax)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package switcher
+
+import (
+	"backend-handler/workload"
+	"fmt"
+	"strings"
+)
+
+// ContainerAnnotation names the notebook container of a workload, the only
+// one that gets GPU resources. The switcher sets it on every clone, so the
+// container is still found once the workload got a -gpu/-cpu name.
+const ContainerAnnotation = "gpu-switcher/container"
+
+// mainContainer returns the index of the notebook container of w, which was
+// read as srcName. It is, in order: the container named by ContainerAnnotation,
+// by the namespace's "notebookContainer" setting, the container named like the
+// workload (Kubeflow's convention) or its name without -gpu/-cpu suffix, and
+// finally the only container. Sidecars and init containers are never chosen.
+func mainContainer(w *workload.Workload, configured, srcName string) (int, error) {
+	containers := w.PodSpec().Containers
+	find := func(name string) int {
+		for i, c := range containers {
+			if name != "" && c.Name == name {
+				return i
+			}
+		}
+		return -1
+	}
+
+	if name := w.GetAnnotations()[ContainerAnnotation]; name != "" {
+		if i := find(name); i >= 0 {
+			return i, nil
+		}
+		return -1, fmt.Errorf("container %q named by annotation %s not found", name, ContainerAnnotation)
+	}
+	if configured != "" {
+		if i := find(configured); i >= 0 {
+			return i, nil
+		}
+		return -1, fmt.Errorf("container %q set by %s not found", configured, cmKeyContainer)
+	}
+	for _, name := range []string{srcName, baseName(srcName)} {
+		if i := find(name); i >= 0 {
+			return i, nil
+		}
+	}
+	if len(containers) == 1 {
+		return 0, nil
+	}
+	return -1, fmt.Errorf("cannot tell the notebook container among %d containers: set annotation %s or ConfigMap key %s", len(containers), ContainerAnnotation, cmKeyContainer)
+}
+
+// baseName strips the -gpu/-cpu suffix of clone names (see cloneName).
+func baseName(name string) string {
+	for _, suffix := range []string{"-gpu", "-cpu"} {
+		if s, ok := strings.CutSuffix(name, suffix); ok && s != "" {
+			return s
+		}
+	}
+	return name
+}
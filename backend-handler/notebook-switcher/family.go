@@ -0,0 +1,201 @@
+package switcher
+
+import (
+	nbpods "backend-handler/get-nbpods-name"
+	"backend-handler/tracing"
+	"backend-handler/workload"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A notebook family is a notebook and the clones migrations made of it. The
+// first notebook gives the family its identity, which every clone inherits
+// (workload clones keep labels and annotations):
+//   - FamilyLabel: stable family ID, the UID of the first notebook
+//   - NameAnnotation: canonical display name, the name of the first notebook
+//
+// Clone names are derived from the canonical name and the mode, e.g. "foo"
+// → "foo-gpu" → "foo-cpu", so names that end in -cpu or -gpu themselves are
+// not mistaken for a suffix.
+const (
+	FamilyLabel    = "gpu-switcher/family"
+	NameAnnotation = "gpu-switcher/name"
+)
+
+// maxNameLength bounds clone names: Kubeflow names the StatefulSet, Service and
+// pod after the notebook, and the pods' controller-revision-hash label adds 11
+// characters to it within the 63 allowed.
+const maxNameLength = 52
+
+// ErrNoNotebook is returned when no notebook belongs to a logical name.
+var ErrNoNotebook = errors.New("no notebook with this logical name")
+
+// StoppedError is returned by Open for a stopped notebook when it may not wake it.
+type StoppedError struct {
+	Namespace, Name string
+}
+
+func (e *StoppedError) Error() string {
+	return fmt.Sprintf("notebook %s/%s is stopped", e.Namespace, e.Name)
+}
+
+// Family returns the family ID and canonical name of w. A notebook that was
+// never switched starts its own family. Clones made before the family was
+// recorded get their name without -gpu/-cpu suffix as canonical name.
+func Family(w *workload.Workload) (id, name string) {
+	id, name = w.Labels[FamilyLabel], w.Annotations[NameAnnotation]
+	if id == "" {
+		id = string(w.UID)
+	}
+	if name == "" {
+		name = w.Name
+		if w.Annotations[ManagedByAnnotation] == ManagedByValue {
+			name = baseName(name)
+		}
+	}
+	return id, name
+}
+
+// setFamily records the family of src on its clone dst.
+func setFamily(dst, src *workload.Workload) {
+	id, name := Family(src)
+	if dst.Labels == nil {
+		dst.Labels = map[string]string{}
+	}
+	dst.Labels[FamilyLabel] = id
+	setAnnotation(dst, NameAnnotation, name)
+}
+
+// cloneName returns the name of the clone in mode (api.ModeGPU or
+// api.ModeCPU) of a notebook with canonical name: "<name>-<mode>", made a
+// valid DNS-1123 label of at most maxNameLength characters. Names too long
+// are cut and get a hash of the canonical name to stay distinct.
+func cloneName(canonical, mode string) string {
+	base := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		}
+		return '-'
+	}, canonical)
+	base = strings.Trim(base, "-")
+	if base == "" {
+		base = "notebook"
+	}
+	suffix := "-" + mode
+	if len(base)+len(suffix) > maxNameLength {
+		h := fnv.New32a()
+		h.Write([]byte(canonical))
+		hash := fmt.Sprintf("%08x", h.Sum32())
+		base = strings.TrimRight(base[:maxNameLength-len(suffix)-len(hash)-1], "-") + "-" + hash
+	}
+	return base + suffix
+}
+
+// Open resolves logical notebook name of namespace, a canonical name or the
+// name of a family member, to the family's currently active notebook and
+// returns its URL, opening docPath if set. The active notebook is the one
+// with a ready pod, else a running one, else the newest, leaving out those
+// being deleted.
+// A stopped notebook is started when wake is set, otherwise *StoppedError is
+// returned.
+func Open(ctx context.Context, namespace, name, docPath string, wake bool) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "open notebook", trace.WithAttributes(
+		attribute.String("notebook.namespace", namespace),
+		attribute.String("notebook.family", name),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	backend, nsCfg, err := namespaceBackend(ctx, namespace)
+	if err != nil {
+		return "", err
+	}
+	list, err := backend.List(ctx, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	active, err := activeMember(ctx, backend, namespace, name, list)
+	if err != nil {
+		return "", err
+	}
+
+	if active.Stopped {
+		if !wake {
+			return "", &StoppedError{Namespace: namespace, Name: active.Name}
+		}
+		if err := backend.Start(ctx, namespace, active.Name); err != nil {
+			return "", fmt.Errorf("start notebook %s: %w", active.Name, err)
+		}
+		fmt.Printf("Woke up notebook %s/%s\n", namespace, active.Name)
+	}
+	span.SetAttributes(attribute.String("notebook.name", active.Name))
+	if docPath != "" {
+		return workload.ExpandDocumentURL(documentURLTemplate(nsCfg), namespace, active.Name, docPath), nil
+	}
+	return workload.ExpandURL(urlTemplate(nsCfg), namespace, active.Name), nil
+}
+
+// activeMember returns the active notebook of the family of logical name
+// among list: the one with a ready pod, else a running one, else the newest.
+// Notebooks being deleted are left out.
+func activeMember(ctx context.Context, backend workload.Backend, namespace, name string, list []*workload.Workload) (*workload.Workload, error) {
+	type candidate struct {
+		w     *workload.Workload
+		ready bool
+	}
+	// name is a canonical name, or the name of one of the notebooks
+	families := map[string]bool{}
+	for _, w := range list {
+		id, canonical := Family(w)
+		if canonical == name {
+			families[id] = true
+		}
+	}
+	if len(families) == 0 {
+		for _, w := range list {
+			if w.Name == name {
+				id, _ := Family(w)
+				families[id] = true
+			}
+		}
+	}
+	var members []candidate
+	for _, w := range list {
+		if id, _ := Family(w); !families[id] || w.DeletionTimestamp != nil {
+			continue
+		}
+		c := candidate{w: w}
+		if !w.Stopped {
+			pod, err := backend.Pod(ctx, namespace, w.Name)
+			if err != nil {
+				return nil, err
+			}
+			c.ready = pod != nil && nbpods.IsPodReady(pod)
+		}
+		members = append(members, c)
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("%w: %s/%s", ErrNoNotebook, namespace, name)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		a, b := members[i], members[j]
+		if a.ready != b.ready {
+			return a.ready
+		}
+		if a.w.Stopped != b.w.Stopped {
+			return !a.w.Stopped
+		}
+		return b.w.CreationTimestamp.Before(&a.w.CreationTimestamp)
+	})
+	return members[0].w, nil
+}
@@ -0,0 +1,81 @@
+package switcher
+
+import (
+	"backend-handler/workload"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestActiveMember(t *testing.T) {
+	ctx := context.Background()
+	t0 := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	src := newWorkload("foo", "uid-foo")
+	member := func(name string, created time.Time, stopped, deleting bool) *workload.Workload {
+		w := newWorkload(name, "uid-"+name)
+		setFamily(w, src)
+		w.CreationTimestamp = metav1.Time{Time: created}
+		w.Stopped = stopped
+		if deleting {
+			w.DeletionTimestamp = &metav1.Time{Time: t0.Add(time.Hour)}
+		}
+		return w
+	}
+
+	tests := []struct {
+		name    string
+		list    []*workload.Workload
+		ready   []string
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "ready wins",
+			list:  []*workload.Workload{member("foo-cpu", t0, false, false), member("foo-gpu", t0.Add(time.Minute), false, false)},
+			ready: []string{"foo-cpu"},
+			want:  "foo-cpu",
+		},
+		{
+			name: "running before stopped",
+			list: []*workload.Workload{member("foo-cpu", t0.Add(time.Minute), true, false), member("foo-gpu", t0, false, false)},
+			want: "foo-gpu",
+		},
+		{
+			name: "newest",
+			list: []*workload.Workload{member("foo-cpu", t0, true, false), member("foo-gpu", t0.Add(time.Minute), true, false)},
+			want: "foo-gpu",
+		},
+		{
+			name:  "ready but being deleted",
+			list:  []*workload.Workload{member("foo-gpu", t0.Add(time.Minute), false, true), member("foo-cpu", t0, true, false)},
+			ready: []string{"foo-gpu"},
+			want:  "foo-cpu",
+		},
+		{
+			name:    "only one being deleted",
+			list:    []*workload.Workload{member("foo-gpu", t0, false, true)},
+			wantErr: ErrNoNotebook,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &fakeBackend{ready: map[string]bool{}}
+			for _, name := range tt.ready {
+				b.ready[name] = true
+			}
+			got, err := activeMember(ctx, b, "team", "foo", tt.list)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("activeMember = %v, %v, want %v", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got.Name != tt.want {
+				t.Fatalf("activeMember = %v, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package switcher
+
+import (
+	"backend-handler/api"
+	"backend-handler/tracing"
+	"backend-handler/workload"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Environment of the backend configuring the jupyterhub workload backend. The
+// token is sent to the URL, so neither comes from the namespace ConfigMap,
+// which the users of the namespace may edit.
+const (
+	EnvHubURL   = "JUPYTERHUB_API_URL"
+	EnvHubToken = "JUPYTERHUB_API_TOKEN"
+)
+
+// hub returns the JupyterHub client of the namespace.
+func (c *Config) hub() (*workload.JupyterHub, error) {
+	u := os.Getenv(EnvHubURL)
+	if u == "" {
+		return nil, fmt.Errorf("namespace %q uses the %s backend but %s is not set", c.Namespace, workload.KindJupyterHub, EnvHubURL)
+	}
+	return &workload.JupyterHub{
+		URL:    u,
+		Token:  os.Getenv(EnvHubToken),
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// switchHub restarts the Hub server req.Notebook with the KubeSpawner profile
+// of the requested GPU profile, or of CPU servers.
+func switchHub(ctx context.Context, cs kubernetes.Interface, nsCfg *Config, req api.MigrationRequest) (_, _ string, err error) {
+	ctx, span := tracer.Start(ctx, "switch JupyterHub server", trace.WithAttributes(
+		attribute.String("notebook.name", req.Notebook),
+		attribute.String("migration.direction", req.Direction),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	hub, err := nsCfg.hub()
+	if err != nil {
+		return "", "", err
+	}
+	target, timeouts := nsCfg.HubCPUProfile, nsCfg.cpuTimeouts()
+	if req.Direction == api.DirectionToGPU {
+		profile, err := nsCfg.Profile(req.Profile)
+		if err != nil {
+			return "", "", err
+		}
+		// Spawning servers count against the limit: hold its lock until started
+		if nsCfg.Policy.MaxGPUNotebooks > 0 {
+			lockCtx, cancel := context.WithTimeout(ctx, nsCfg.gpuTimeouts(profile).PodReady)
+			limit, err := lockGPULimit(lockCtx, cs, req.Namespace)
+			cancel()
+			if err != nil {
+				return "", "", err
+			}
+			defer limit.release()
+		}
+		if err := checkHubPolicy(ctx, hub, nsCfg, profile.Name, req.Notebook); err != nil {
+			return "", "", err
+		}
+		target, timeouts = profile.HubProfile, nsCfg.gpuTimeouts(profile)
+	}
+	span.SetAttributes(attribute.String("hub.profile", target))
+
+	lock, err := tryLock(ctx, cs, req.Namespace, "hub/"+req.Notebook, fmt.Sprintf("server %s of namespace %s", req.Notebook, req.Namespace))
+	if err != nil {
+		return "", "", err
+	}
+	defer lock.release()
+
+	current, err := hub.Server(ctx, req.Notebook)
+	if err != nil {
+		return "", "", fmt.Errorf("get server %s: %w", req.Notebook, err)
+	}
+	if current != nil && current.Ready && current.Profile() == target {
+		return req.Notebook, current.URL, nil
+	}
+
+	// Same bound as waiting for a notebook pod
+	waitCtx, cancel := context.WithTimeout(ctx, timeouts.PodReady)
+	defer cancel()
+
+	if current != nil {
+		reportProgress(ctx, "stopping server %s", req.Notebook)
+		if err := hub.Stop(waitCtx, req.Notebook); err != nil {
+			return "", "", err
+		}
+	}
+	reportProgress(ctx, "starting server %s with profile %q", req.Notebook, target)
+	s, err := hub.Start(waitCtx, req.Notebook, target)
+	if err != nil {
+		if current != nil {
+			return restoreHub(ctx, hub, req.Notebook, current.Profile(), timeouts.PodReady, err)
+		}
+		// The server exists (maybe still spawning): report it like a pod that did not become ready.
+		return req.Notebook, "", err
+	}
+	fmt.Printf("Hub server %s is ready with profile %q\n", req.Notebook, target)
+	return req.Notebook, s.URL, nil
+}
+
+// restoreHub restarts server name with its previous profile after starting
+// it with the new one failed with startErr, unless it is still spawning, so
+// that the user is not left without a server.
+func restoreHub(ctx context.Context, hub *workload.JupyterHub, name, previous string, timeout time.Duration, startErr error) (string, string, error) {
+	// The migration's deadline may be what failed the start
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+	if s, err := hub.Server(ctx, name); err != nil || s != nil {
+		return name, "", startErr
+	}
+	reportProgress(ctx, "starting server %s again with its previous profile %q", name, previous)
+	if _, err := hub.Start(ctx, name, previous); err != nil {
+		return "", "", fmt.Errorf("%w; restarting with the previous profile %q failed too: %v", startErr, previous, err)
+	}
+	fmt.Printf("Hub server %s restarted with its previous profile %q\n", name, previous)
+	return "", "", fmt.Errorf("%w; server restarted with its previous profile %q", startErr, previous)
+}
+
+// checkHubPolicy enforces the namespace policy, counting running servers
+// started with a GPU profile.
+func checkHubPolicy(ctx context.Context, hub *workload.JupyterHub, nsCfg *Config, profile, notebookName string) error {
+	pol := nsCfg.Policy
+	if err := pol.CheckProfile(nsCfg.Namespace, profile); err != nil {
+		return err
+	}
+	if pol.MaxGPUNotebooks == 0 {
+		return nil
+	}
+	servers, err := hub.Servers(ctx)
+	if err != nil {
+		return fmt.Errorf("list hub servers: %w", err)
+	}
+	gpuProfiles := map[string]bool{}
+	for _, p := range nsCfg.Profiles {
+		gpuProfiles[p.HubProfile] = true
+	}
+	running := 0
+	for _, s := range servers {
+		name := s.User
+		if s.Name != "" {
+			name += "/" + s.Name
+		}
+		if name != notebookName && gpuProfiles[s.Profile()] {
+			running++
+		}
+	}
+	return pol.CheckConcurrency(nsCfg.Namespace, running)
+}
@@ -0,0 +1,124 @@
+package switcher
+
+import (
+	"backend-handler/api"
+	"backend-handler/workload"
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func validateImageMap(rules []api.ImageRule) error {
+	for i, r := range rules {
+		if r.From == "" || r.To == "" {
+			return fmt.Errorf("rule %d: from and to are required", i)
+		}
+		switch r.Direction {
+		case "", api.DirectionToGPU, api.DirectionToCPU:
+		default:
+			return fmt.Errorf("rule %d: invalid direction %q", i, r.Direction)
+		}
+		if !r.Regex {
+			continue
+		}
+		if r.Direction == "" {
+			return fmt.Errorf("rule %d: regex rules need a direction", i)
+		}
+		if _, err := regexp.Compile(r.From); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// mapImage returns the image that replaces image when migrating in direction,
+// and whether a rule matched. The first matching rule wins. A regex rule
+// replaces what it matches, so an unanchored one keeps the rest of the image
+// (registry, tag).
+func mapImage(rules []api.ImageRule, direction, image string) (string, bool) {
+	for _, r := range rules {
+		if r.Direction != "" && r.Direction != direction {
+			continue
+		}
+		if r.Regex {
+			re := regexp.MustCompile(r.From) // validated by parseConfig
+			if re.MatchString(image) {
+				return re.ReplaceAllString(image, r.To), true
+			}
+			continue
+		}
+		from, to := r.From, r.To
+		if r.Direction == "" && direction == api.DirectionToCPU {
+			from, to = to, from
+		}
+		if image == from {
+			return to, true
+		}
+	}
+	return image, false
+}
+
+// mapImages applies the image map of nsCfg to every (init) container of w and
+// checks the new images against AllowedRegistries.
+func mapImages(w *workload.Workload, nsCfg *Config, direction string) error {
+	if len(nsCfg.ImageMap) == 0 {
+		return nil
+	}
+	spec := w.PodSpec()
+	for _, list := range [][]corev1.Container{spec.Containers, spec.InitContainers} {
+		for i := range list {
+			c := &list[i]
+			image, ok := mapImage(nsCfg.ImageMap, direction, c.Image)
+			if !ok {
+				continue
+			}
+			if !registryAllowed(nsCfg.AllowedRegistries, image) {
+				return fmt.Errorf("image %q mapped from %q is not in an allowed registry (%s)", image, c.Image, strings.Join(nsCfg.AllowedRegistries, ", "))
+			}
+			fmt.Printf("Container %s: image %s -> %s\n", c.Name, c.Image, image)
+			c.Image = image
+		}
+	}
+	return nil
+}
+
+// registryAllowed reports whether image comes from one of allowed, each a
+// registry host or repository prefix (e.g. "ghcr.io/acme"). Docker Hub
+// short names are normalised, so "jupyter/scipy" matches "docker.io/jupyter".
+func registryAllowed(allowed []string, image string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	ref := normalizeImage(image)
+	for _, a := range allowed {
+		prefix := strings.TrimSuffix(a, "/")
+		if !strings.Contains(prefix, "/") && !isRegistryHost(prefix) {
+			prefix = "docker.io/" + prefix
+		}
+		if strings.HasPrefix(ref, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeImage prefixes Docker Hub images with their registry, e.g.
+// "python:3" becomes "docker.io/library/python:3".
+func normalizeImage(image string) string {
+	first, rest, found := strings.Cut(image, "/")
+	switch {
+	case !found:
+		return "docker.io/library/" + image
+	case !isRegistryHost(first):
+		return "docker.io/" + first + "/" + rest
+	}
+	return image
+}
+
+// isRegistryHost reports whether the first component of an image reference is
+// a registry host rather than a Docker Hub namespace.
+func isRegistryHost(s string) bool {
+	return strings.ContainsAny(s, ".:") || s == "localhost"
+}
@@ -0,0 +1,59 @@
+package switcher
+
+import (
+	"backend-handler/api"
+	"testing"
+)
+
+func TestMapImage(t *testing.T) {
+	rules := []api.ImageRule{
+		{From: "jupyter-scipy:v1.8.0", To: "jupyter-pytorch-cuda:v1.8.0"},
+		{From: "^(.+)/jupyter-slim:(.+)$", To: "$1/jupyter-cuda:$2", Regex: true, Direction: api.DirectionToGPU},
+		{From: "-tf-cpu", To: "-tf-cuda", Regex: true, Direction: api.DirectionToGPU},
+		{From: "-tf-cuda", To: "-tf-cpu", Regex: true, Direction: api.DirectionToCPU},
+		{From: "base:1", To: "base-gpu:1", Direction: api.DirectionToGPU},
+	}
+	tests := []struct {
+		direction, image string
+		want             string
+		wantOK           bool
+	}{
+		{api.DirectionToGPU, "jupyter-scipy:v1.8.0", "jupyter-pytorch-cuda:v1.8.0", true},
+		{api.DirectionToCPU, "jupyter-pytorch-cuda:v1.8.0", "jupyter-scipy:v1.8.0", true},
+		{api.DirectionToGPU, "ghcr.io/acme/jupyter-slim:2024.1", "ghcr.io/acme/jupyter-cuda:2024.1", true},
+		// unanchored rules keep registry and tag
+		{api.DirectionToGPU, "registry.acme.io:5000/team/jupyter-tf-cpu:2.15", "registry.acme.io:5000/team/jupyter-tf-cuda:2.15", true},
+		{api.DirectionToCPU, "registry.acme.io:5000/team/jupyter-tf-cuda:2.15", "registry.acme.io:5000/team/jupyter-tf-cpu:2.15", true},
+		// directed rules only apply one way
+		{api.DirectionToCPU, "ghcr.io/acme/jupyter-cuda:2024.1", "ghcr.io/acme/jupyter-cuda:2024.1", false},
+		{api.DirectionToGPU, "base:1", "base-gpu:1", true},
+		{api.DirectionToCPU, "base-gpu:1", "base-gpu:1", false},
+		{api.DirectionToGPU, "jupyter-scipy:v1.9.0", "jupyter-scipy:v1.9.0", false},
+	}
+	for _, tt := range tests {
+		got, ok := mapImage(rules, tt.direction, tt.image)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("mapImage(%s, %q) = %q, %v, want %q, %v", tt.direction, tt.image, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestValidateImageMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    api.ImageRule
+		wantErr bool
+	}{
+		{name: "exact", rule: api.ImageRule{From: "a:1", To: "b:1"}},
+		{name: "regex", rule: api.ImageRule{From: "-cpu", To: "-cuda", Regex: true, Direction: api.DirectionToGPU}},
+		{name: "missing to", rule: api.ImageRule{From: "a:1"}, wantErr: true},
+		{name: "invalid direction", rule: api.ImageRule{From: "a:1", To: "b:1", Direction: "sideways"}, wantErr: true},
+		{name: "regex without direction", rule: api.ImageRule{From: "-cpu", To: "-cuda", Regex: true}, wantErr: true},
+		{name: "invalid regex", rule: api.ImageRule{From: "(", To: "x", Regex: true, Direction: api.DirectionToGPU}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateImageMap([]api.ImageRule{tt.rule}); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateImageMap = %v, want error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
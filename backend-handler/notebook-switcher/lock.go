@@ -0,0 +1,219 @@
+package switcher
+
+import (
+	"backend-handler/workload"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Migrations lock what they change with Leases in the notebook's namespace,
+// so that replicas of the backend, its entry points and the CLI do not
+// migrate a notebook family twice at once. A Lease is renewed while the
+// migration runs and expires if its process dies.
+const (
+	lockDuration = 2 * time.Minute
+	lockRenew    = 30 * time.Second
+	// LockAnnotation tells on a Lease what it locks.
+	LockAnnotation = "gpu-switcher/lock"
+)
+
+// lockHolder identifies this process in the Leases it holds.
+var lockHolder = func() string {
+	host, _ := os.Hostname()
+	return host + "-" + strings.ToLower(rand.Text()[:6])
+}()
+
+// LockedError is returned when another migration holds a lock.
+type LockedError struct {
+	What   string // e.g. "notebook team/foo"
+	Holder string
+	Since  time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked by another migration (%s since %s)", e.What, e.Holder, e.Since.Format(time.RFC3339))
+}
+
+// lock is a held Lease, renewed in the background until release.
+type lock struct {
+	cs              kubernetes.Interface
+	namespace, name string
+	holder          string
+	stop            chan struct{}
+	done            chan struct{}
+	released        sync.Once
+}
+
+// lockName returns the Lease name of the lock of key, e.g. "family/<id>".
+func lockName(key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("gpu-switcher-lock-%016x", h.Sum64())
+}
+
+// tryLock takes the Lease of key in namespace, or returns *LockedError if an
+// unexpired one is held. what names what is locked in errors.
+func tryLock(ctx context.Context, cs kubernetes.Interface, namespace, key, what string) (*lock, error) {
+	leases := cs.CoordinationV1().Leases(namespace)
+	l := &lock{cs: cs, namespace: namespace, name: lockName(key), holder: lockHolder + "/" + strings.ToLower(rand.Text()[:6])}
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(lockDuration / time.Second)
+	spec := coordinationv1.LeaseSpec{HolderIdentity: &l.holder, LeaseDurationSeconds: &seconds, AcquireTime: &now, RenewTime: &now}
+
+	_, err := leases.Create(ctx, &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: l.name, Namespace: namespace, Annotations: map[string]string{LockAnnotation: what}},
+		Spec:       spec,
+	}, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		var cur *coordinationv1.Lease
+		cur, err = leases.Get(ctx, l.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			// just released
+			return tryLock(ctx, cs, namespace, key, what)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get lock %s: %w", l.name, err)
+		}
+		if held(cur, now.Time) {
+			return nil, lockedError(cur, what)
+		}
+		// expired: take it over, unless another one just did
+		cur.Spec = spec
+		setAnnotation(cur, LockAnnotation, what)
+		if _, err = leases.Update(ctx, cur, metav1.UpdateOptions{}); apierrors.IsConflict(err) {
+			return nil, &LockedError{What: what, Holder: "unknown", Since: now.Time}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("take lock %s: %w", l.name, err)
+	}
+
+	l.stop, l.done = make(chan struct{}), make(chan struct{})
+	go l.renew()
+	return l, nil
+}
+
+// lockFamily locks the family of src, which a migration is about to change.
+func lockFamily(ctx context.Context, cs kubernetes.Interface, src *workload.Workload) (*lock, error) {
+	id, _ := Family(src)
+	return tryLock(ctx, cs, src.Namespace, "family/"+id, fmt.Sprintf("notebook %s/%s", src.Namespace, src.Name))
+}
+
+// lockGPULimit waits for the lock of the GPU notebook limit of namespace,
+// which serializes counting the GPU notebooks and creating one.
+func lockGPULimit(ctx context.Context, cs kubernetes.Interface, namespace string) (*lock, error) {
+	return waitLock(ctx, cs, namespace, "gpu-limit", "GPU notebook limit of namespace "+namespace)
+}
+
+// waitLock is tryLock retried until the lock is free or ctx is done.
+func waitLock(ctx context.Context, cs kubernetes.Interface, namespace, key, what string) (l *lock, err error) {
+	var locked error
+	err = wait.PollUntilContextCancel(ctx, 2*time.Second, true, func(ctx context.Context) (bool, error) {
+		l, err = tryLock(ctx, cs, namespace, key, what)
+		if errors.As(err, new(*LockedError)) {
+			locked = err
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil && locked != nil {
+		return nil, locked
+	}
+	return l, err
+}
+
+// held reports whether the Lease is held by someone at now.
+func held(l *coordinationv1.Lease, now time.Time) bool {
+	s := l.Spec
+	if s.HolderIdentity == nil || *s.HolderIdentity == "" || s.RenewTime == nil || s.LeaseDurationSeconds == nil {
+		return false
+	}
+	return now.Before(s.RenewTime.Add(time.Duration(*s.LeaseDurationSeconds) * time.Second))
+}
+
+func lockedError(l *coordinationv1.Lease, what string) *LockedError {
+	e := &LockedError{What: what, Holder: *l.Spec.HolderIdentity}
+	if l.Spec.AcquireTime != nil {
+		e.Since = l.Spec.AcquireTime.Time
+	}
+	return e
+}
+
+// renew keeps the Lease until release is called or it is lost.
+func (l *lock) renew() {
+	defer close(l.done)
+	ticker := time.NewTicker(lockRenew)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), lockRenew)
+		cur, err := l.current(ctx)
+		if err == nil {
+			now := metav1.NewMicroTime(time.Now())
+			cur.Spec.RenewTime = &now
+			_, err = l.cs.CoordinationV1().Leases(l.namespace).Update(ctx, cur, metav1.UpdateOptions{})
+		}
+		cancel()
+		if err != nil {
+			fmt.Printf("Could not renew lock %s/%s: %v\n", l.namespace, l.name, err)
+		}
+	}
+}
+
+// current returns the Lease if this lock still holds it.
+func (l *lock) current(ctx context.Context) (*coordinationv1.Lease, error) {
+	cur, err := l.cs.CoordinationV1().Leases(l.namespace).Get(ctx, l.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if cur.Spec.HolderIdentity == nil || *cur.Spec.HolderIdentity != l.holder {
+		return nil, fmt.Errorf("lock lost to %s", valueOf(cur.Spec.HolderIdentity))
+	}
+	return cur, nil
+}
+
+// release stops renewing and deletes the Lease, also when the migration's
+// context is done. Only its first call does.
+func (l *lock) release() {
+	l.released.Do(l.free)
+}
+
+func (l *lock) free() {
+	close(l.stop)
+	<-l.done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cur, err := l.current(ctx)
+	if err == nil {
+		err = l.cs.CoordinationV1().Leases(l.namespace).Delete(ctx, l.name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &cur.UID, ResourceVersion: &cur.ResourceVersion},
+		})
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		fmt.Printf("Could not release lock %s/%s: %v\n", l.namespace, l.name, err)
+	}
+}
+
+func valueOf(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
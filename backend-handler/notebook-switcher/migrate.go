@@ -0,0 +1,73 @@
+package switcher
+
+import (
+	"backend-handler/api"
+	"backend-handler/workload"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Migrate moves notebook req.Notebook in the direction of req and returns the
+// name and URL of the resulting notebook. It picks the namespace's workload
+// backend: clone-based backends go through SwitcherToGPU/SwitcherToCPU,
+// JupyterHub servers are restarted with the profile's KubeSpawner profile.
+//
+// As with SwitcherToGPU, a non-empty name is returned with an error when the
+// new notebook exists but a later step failed.
+func Migrate(ctx context.Context, req api.MigrationRequest) (newNotebook, url string, err error) {
+	_, cs, err := newClients()
+	if err != nil {
+		return "", "", err
+	}
+	nsCfg, err := LoadConfig(ctx, cs, req.Namespace)
+	if err != nil {
+		return "", "", fmt.Errorf("load switcher config: %w", err)
+	}
+	if nsCfg.WorkloadBackend == workload.KindJupyterHub {
+		newNotebook, url, err = switchHub(ctx, cs, nsCfg, req)
+		if url != "" && req.Path != "" {
+			url = workload.ExpandDocumentURL(strings.TrimRight(url, "/")+"/lab/tree/{path}", req.Namespace, newNotebook, req.Path)
+		}
+		return newNotebook, url, err
+	}
+
+	var podName string
+	if req.Direction == api.DirectionToGPU {
+		podName, err = SwitcherToGPU(ctx, req.Notebook, req.Namespace, req.Profile)
+	} else {
+		podName, err = SwitcherToCPU(ctx, req.Notebook, req.Namespace)
+	}
+	if podName == "" {
+		return "", "", err
+	}
+	newNotebook = NotebookOfPod(podName)
+	if req.Path != "" {
+		return newNotebook, workload.ExpandDocumentURL(documentURLTemplate(nsCfg), req.Namespace, newNotebook, req.Path), err
+	}
+	return newNotebook, workload.ExpandURL(urlTemplate(nsCfg), req.Namespace, newNotebook), err
+}
+
+func urlTemplate(nsCfg *Config) string {
+	if nsCfg.URLTemplate != "" {
+		return nsCfg.URLTemplate
+	}
+	return workload.DefaultURLTemplate
+}
+
+// documentURLTemplate returns the URL template of documents, by default the
+// JupyterLab file browser route under the notebook URL.
+func documentURLTemplate(nsCfg *Config) string {
+	if nsCfg.DocumentURLTemplate != "" {
+		return nsCfg.DocumentURLTemplate
+	}
+	return strings.TrimRight(urlTemplate(nsCfg), "/") + "/lab/tree/{path}"
+}
+
+// NotebookOfPod strips the StatefulSet ordinal from a notebook pod name.
+func NotebookOfPod(pod string) string {
+	if i := strings.LastIndex(pod, "-"); i > 0 {
+		return pod[:i]
+	}
+	return pod
+}
@@ -0,0 +1,215 @@
+package switcher
+
+import (
+	"backend-handler/api"
+	"backend-handler/workload"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PlacementAnnotation records, as JSON api.Placement, what the last migration
+// added to the notebook, so the next one can remove exactly that and nothing
+// the user set themselves.
+const PlacementAnnotation = "gpu-switcher/placement"
+
+// setPlacement removes the placement recorded on w and applies p instead. Env
+// variables go to the notebook container at index idx (-1 if unknown).
+func setPlacement(w *workload.Workload, idx int, p api.Placement) error {
+	if raw := w.GetAnnotations()[PlacementAnnotation]; raw != "" {
+		var old api.Placement
+		if err := json.Unmarshal([]byte(raw), &old); err != nil {
+			return fmt.Errorf("annotation %s: %w", PlacementAnnotation, err)
+		}
+		removePlacement(w, idx, old)
+	}
+	if p.IsZero() {
+		setAnnotation(w, PlacementAnnotation, "")
+		return nil
+	}
+	if len(p.Env) > 0 && idx < 0 {
+		return fmt.Errorf("cannot set env: notebook container unknown")
+	}
+	addPlacement(w, idx, p)
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	setAnnotation(w, PlacementAnnotation, string(raw))
+	return nil
+}
+
+func addPlacement(w *workload.Workload, idx int, p api.Placement) {
+	spec := w.PodSpec()
+	if idx >= 0 {
+		c := &spec.Containers[idx]
+		for _, e := range p.Env {
+			if i := slices.IndexFunc(c.Env, func(x corev1.EnvVar) bool { return x.Name == e.Name }); i >= 0 {
+				c.Env[i] = e
+			} else {
+				c.Env = append(c.Env, e)
+			}
+		}
+	}
+	for k, v := range p.NodeSelector {
+		if spec.NodeSelector == nil {
+			spec.NodeSelector = map[string]string{}
+		}
+		spec.NodeSelector[k] = v
+	}
+	for _, t := range p.Tolerations {
+		spec.Tolerations = addEqual(spec.Tolerations, t)
+	}
+	if p.Affinity == nil {
+		return
+	}
+	if spec.Affinity == nil {
+		spec.Affinity = &corev1.Affinity{}
+	}
+	a := spec.Affinity
+	if na := p.Affinity.NodeAffinity; na != nil {
+		if a.NodeAffinity == nil {
+			a.NodeAffinity = &corev1.NodeAffinity{}
+		}
+		if req := na.RequiredDuringSchedulingIgnoredDuringExecution; req != nil {
+			// Terms are ORed, so the profile's requirements must hold in each of them.
+			if a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+				a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+			}
+			sel := a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+			if len(sel.NodeSelectorTerms) == 0 {
+				sel.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+			}
+			for i := range sel.NodeSelectorTerms {
+				t := &sel.NodeSelectorTerms[i]
+				for _, pt := range req.NodeSelectorTerms {
+					for _, e := range pt.MatchExpressions {
+						t.MatchExpressions = addEqual(t.MatchExpressions, e)
+					}
+					for _, f := range pt.MatchFields {
+						t.MatchFields = addEqual(t.MatchFields, f)
+					}
+				}
+			}
+		}
+		for _, t := range na.PreferredDuringSchedulingIgnoredDuringExecution {
+			a.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = addEqual(a.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution, t)
+		}
+	}
+	if pa := p.Affinity.PodAffinity; pa != nil {
+		if a.PodAffinity == nil {
+			a.PodAffinity = &corev1.PodAffinity{}
+		}
+		for _, t := range pa.RequiredDuringSchedulingIgnoredDuringExecution {
+			a.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution = addEqual(a.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution, t)
+		}
+		for _, t := range pa.PreferredDuringSchedulingIgnoredDuringExecution {
+			a.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution = addEqual(a.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution, t)
+		}
+	}
+	if pa := p.Affinity.PodAntiAffinity; pa != nil {
+		if a.PodAntiAffinity == nil {
+			a.PodAntiAffinity = &corev1.PodAntiAffinity{}
+		}
+		for _, t := range pa.RequiredDuringSchedulingIgnoredDuringExecution {
+			a.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = addEqual(a.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, t)
+		}
+		for _, t := range pa.PreferredDuringSchedulingIgnoredDuringExecution {
+			a.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = addEqual(a.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution, t)
+		}
+	}
+}
+
+// removePlacement undoes addPlacement. Entries the user changed since (an env
+// variable or node selector with another value) are left alone.
+func removePlacement(w *workload.Workload, idx int, p api.Placement) {
+	spec := w.PodSpec()
+	if idx >= 0 {
+		c := &spec.Containers[idx]
+		c.Env = slices.DeleteFunc(c.Env, func(x corev1.EnvVar) bool { return slices.ContainsFunc(p.Env, equalTo(x)) })
+		c.Env = nilIfEmpty(c.Env)
+	}
+	for k, v := range p.NodeSelector {
+		if spec.NodeSelector[k] == v {
+			delete(spec.NodeSelector, k)
+		}
+	}
+	if len(spec.NodeSelector) == 0 {
+		spec.NodeSelector = nil
+	}
+	spec.Tolerations = removeEqual(spec.Tolerations, p.Tolerations)
+	a := spec.Affinity
+	if p.Affinity == nil || a == nil {
+		return
+	}
+	if na := p.Affinity.NodeAffinity; na != nil && a.NodeAffinity != nil {
+		if req, sel := na.RequiredDuringSchedulingIgnoredDuringExecution, a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution; req != nil && sel != nil {
+			var terms []corev1.NodeSelectorTerm
+			for _, t := range sel.NodeSelectorTerms {
+				for _, pt := range req.NodeSelectorTerms {
+					t.MatchExpressions = removeEqual(t.MatchExpressions, pt.MatchExpressions)
+					t.MatchFields = removeEqual(t.MatchFields, pt.MatchFields)
+				}
+				if len(t.MatchExpressions) > 0 || len(t.MatchFields) > 0 {
+					terms = append(terms, t)
+				}
+			}
+			sel.NodeSelectorTerms = terms
+			if len(terms) == 0 {
+				a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = nil
+			}
+		}
+		a.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = removeEqual(a.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution, na.PreferredDuringSchedulingIgnoredDuringExecution)
+		if reflect.DeepEqual(*a.NodeAffinity, corev1.NodeAffinity{}) {
+			a.NodeAffinity = nil
+		}
+	}
+	if pa := p.Affinity.PodAffinity; pa != nil && a.PodAffinity != nil {
+		a.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution = removeEqual(a.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution, pa.RequiredDuringSchedulingIgnoredDuringExecution)
+		a.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution = removeEqual(a.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution, pa.PreferredDuringSchedulingIgnoredDuringExecution)
+		if reflect.DeepEqual(*a.PodAffinity, corev1.PodAffinity{}) {
+			a.PodAffinity = nil
+		}
+	}
+	if pa := p.Affinity.PodAntiAffinity; pa != nil && a.PodAntiAffinity != nil {
+		a.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = removeEqual(a.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, pa.RequiredDuringSchedulingIgnoredDuringExecution)
+		a.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = removeEqual(a.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution, pa.PreferredDuringSchedulingIgnoredDuringExecution)
+		if reflect.DeepEqual(*a.PodAntiAffinity, corev1.PodAntiAffinity{}) {
+			a.PodAntiAffinity = nil
+		}
+	}
+	if reflect.DeepEqual(*a, corev1.Affinity{}) {
+		spec.Affinity = nil
+	}
+}
+
+func equalTo[T any](x T) func(T) bool {
+	return func(y T) bool { return reflect.DeepEqual(x, y) }
+}
+
+// addEqual appends v to s unless s already holds an equal element.
+func addEqual[T any](s []T, v T) []T {
+	if slices.ContainsFunc(s, equalTo(v)) {
+		return s
+	}
+	return append(s, v)
+}
+
+// removeEqual drops the elements of s equal to one of drop.
+func removeEqual[T any](s, drop []T) []T {
+	if len(drop) == 0 {
+		return s
+	}
+	s = slices.DeleteFunc(s, func(x T) bool { return slices.ContainsFunc(drop, equalTo(x)) })
+	return nilIfEmpty(s)
+}
+
+func nilIfEmpty[T any](s []T) []T {
+	if len(s) == 0 {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,507 @@
+package switcher
+
+import (
+	"backend-handler/api"
+	"backend-handler/policy"
+	"backend-handler/tracing"
+	"backend-handler/workload"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Preflight checks, without changing anything, whether migrating notebook of
+// namespace to GPU profile can be expected to succeed: the namespace policy,
+// ResourceQuota headroom, free GPUs on a node the new pod may run on, the
+// access modes of its volumes and the existence of its images. The new pod
+// is the GPU clone the migration would create. Checks that cannot be made
+// (permissions, private registries) are reported as api.CheckUnknown.
+//
+// Jupyter Hub servers are checked for policy, quota and capacity only. The
+// checks can be restricted to some of the api.Check* names.
+func Preflight(ctx context.Context, namespace, notebook, profileName string, only ...string) (_ *api.PreflightReport, err error) {
+	ctx, span := tracer.Start(ctx, "preflight", trace.WithAttributes(
+		attribute.String("notebook.name", notebook),
+		attribute.String("notebook.namespace", namespace),
+		attribute.String("gpu.profile", profileName),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	dc, cs, err := newClients()
+	if err != nil {
+		return nil, err
+	}
+	nsCfg, err := LoadConfig(ctx, cs, namespace)
+	if err != nil {
+		return nil, err
+	}
+	profile, err := nsCfg.Profile(profileName)
+	if err != nil {
+		return nil, err
+	}
+	p := &preflight{
+		cs:      cs,
+		profile: profile,
+		only:    only,
+		report:  &api.PreflightReport{Namespace: namespace, Notebook: notebook, Profile: profile.Name, ResourceKey: profile.ResourceKey},
+	}
+
+	if nsCfg.WorkloadBackend == workload.KindJupyterHub {
+		hub, err := nsCfg.hub()
+		if err != nil {
+			return nil, err
+		}
+		if p.want(api.CheckPolicy) {
+			p.policy(checkHubPolicy(ctx, hub, nsCfg, profile.Name, notebook))
+		}
+		p.resources(ctx, namespace, hubPodSpec(profile))
+		return p.done(span), nil
+	}
+
+	backend, err := nsCfg.Backend(dc, cs)
+	if err != nil {
+		return nil, err
+	}
+	src, err := backend.Get(ctx, namespace, notebook)
+	if err != nil {
+		return nil, fmt.Errorf("get notebook %q: %w", notebook, err)
+	}
+	if p.want(api.CheckPolicy) {
+		p.policy(checkPolicy(ctx, backend, nsCfg, profile.Name, notebook))
+	}
+
+	dst := src.DeepCopy()
+	if err := gpuMutation(src, nsCfg, profile)(dst); err != nil {
+		p.add(api.CheckSpec, api.CheckFailed, "%v", err)
+		return p.done(span), nil
+	}
+	p.add(api.CheckSpec, api.CheckPassed, "GPU clone of %s can be built", notebook)
+	spec := dst.PodSpec()
+	p.resources(ctx, namespace, spec)
+	if p.want(api.CheckVolumes) {
+		p.volumes(ctx, backend, src, spec)
+	}
+	if p.want(api.CheckImages) {
+		p.images(ctx, spec)
+	}
+	return p.done(span), nil
+}
+
+// resources makes the quota and capacity checks of a pod with spec; the
+// volumes check needs the nodes that fit it.
+func (p *preflight) resources(ctx context.Context, namespace string, spec *corev1.PodSpec) {
+	if p.want(api.CheckQuota) {
+		p.quota(ctx, namespace, spec)
+	}
+	if p.want(api.CheckCapacity) || p.want(api.CheckVolumes) {
+		p.capacity(ctx, spec)
+	}
+}
+
+// preflight collects the checks of one report.
+type preflight struct {
+	cs      kubernetes.Interface
+	profile Profile
+	only    []string
+	report  *api.PreflightReport
+
+	// Set by capacity: nodes were listed, the new pod fits these
+	nodesKnown bool
+	nodes      []corev1.Node
+	fitting    []string
+}
+
+// want reports whether check name is to be made.
+func (p *preflight) want(name string) bool {
+	return len(p.only) == 0 || slices.Contains(p.only, name)
+}
+
+func (p *preflight) add(name, result, format string, args ...any) {
+	if !p.want(name) {
+		return
+	}
+	p.report.Checks = append(p.report.Checks, api.PreflightCheck{Name: name, Result: result, Message: fmt.Sprintf(format, args...)})
+}
+
+func (p *preflight) done(span trace.Span) *api.PreflightReport {
+	p.report.Passed = true
+	for _, c := range p.report.Checks {
+		if c.Result == api.CheckFailed {
+			p.report.Passed = false
+		}
+	}
+	span.SetAttributes(attribute.Bool("preflight.passed", p.report.Passed))
+	return p.report
+}
+
+func (p *preflight) policy(err error) {
+	var denied *policy.DeniedError
+	switch {
+	case err == nil:
+		p.add(api.CheckPolicy, api.CheckPassed, "namespace policy allows profile %q", p.profile.Name)
+	case errors.As(err, &denied):
+		p.add(api.CheckPolicy, api.CheckFailed, "%v", err)
+	default:
+		p.add(api.CheckPolicy, api.CheckUnknown, "%v", err)
+	}
+}
+
+// quota checks that every ResourceQuota of the namespace leaves room for the
+// new pod. The old pod keeps counting until it is deleted, after the new one
+// is ready. Scoped quotas are not evaluated.
+func (p *preflight) quota(ctx context.Context, namespace string, spec *corev1.PodSpec) {
+	list, err := p.cs.CoreV1().ResourceQuotas(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		p.add(api.CheckQuota, api.CheckUnknown, "list resource quotas: %v", err)
+		return
+	}
+	usage := quotaUsage(spec)
+	var short []string
+	checked := 0
+	for _, q := range list.Items {
+		if len(q.Spec.Scopes) > 0 || q.Spec.ScopeSelector != nil {
+			continue
+		}
+		checked++
+		hard := q.Status.Hard
+		if hard == nil {
+			hard = q.Spec.Hard
+		}
+		for _, name := range sortedNames(hard) {
+			need, ok := usage[name]
+			if !ok {
+				continue
+			}
+			left := hard[name].DeepCopy()
+			left.Sub(q.Status.Used[name])
+			if need.Cmp(left) > 0 {
+				short = append(short, fmt.Sprintf("quota %s: %s needs %s, %s left", q.Name, name, need.String(), left.String()))
+			}
+		}
+	}
+	switch {
+	case len(short) > 0:
+		p.add(api.CheckQuota, api.CheckFailed, "%s", strings.Join(short, "; "))
+	case checked == 0:
+		p.add(api.CheckQuota, api.CheckPassed, "no resource quota applies")
+	default:
+		p.add(api.CheckQuota, api.CheckPassed, "%d resource quotas leave room for the new pod", checked)
+	}
+}
+
+// quotaUsage returns what a pod with spec adds to the quota resource names.
+func quotaUsage(spec *corev1.PodSpec) corev1.ResourceList {
+	requests, limits := podResources(spec)
+	usage := corev1.ResourceList{corev1.ResourcePods: resource.MustParse("1")}
+	for name, q := range requests {
+		usage["requests."+name] = q
+		switch name {
+		case corev1.ResourceCPU, corev1.ResourceMemory, corev1.ResourceEphemeralStorage:
+			usage[name] = q
+		}
+	}
+	for name, q := range limits {
+		usage["limits."+name] = q
+	}
+	return usage
+}
+
+// podResources sums the requests and limits of the containers of spec, or of
+// an init container if it asks for more. A limit without request counts as
+// request, like the API server defaults it.
+func podResources(spec *corev1.PodSpec) (requests, limits corev1.ResourceList) {
+	requests, limits = corev1.ResourceList{}, corev1.ResourceList{}
+	for _, c := range spec.Containers {
+		for name, q := range containerRequests(c) {
+			addQuantity(requests, name, q)
+		}
+		for name, q := range c.Resources.Limits {
+			addQuantity(limits, name, q)
+		}
+	}
+	for _, c := range spec.InitContainers {
+		for name, q := range containerRequests(c) {
+			if cur, ok := requests[name]; !ok || q.Cmp(cur) > 0 {
+				requests[name] = q.DeepCopy()
+			}
+		}
+		for name, q := range c.Resources.Limits {
+			if cur, ok := limits[name]; !ok || q.Cmp(cur) > 0 {
+				limits[name] = q.DeepCopy()
+			}
+		}
+	}
+	return requests, limits
+}
+
+func containerRequests(c corev1.Container) corev1.ResourceList {
+	out := corev1.ResourceList{}
+	for name, q := range c.Resources.Limits {
+		out[name] = q
+	}
+	for name, q := range c.Resources.Requests {
+		out[name] = q
+	}
+	return out
+}
+
+func addQuantity(list corev1.ResourceList, name corev1.ResourceName, q resource.Quantity) {
+	sum := list[name].DeepCopy()
+	sum.Add(q)
+	list[name] = sum
+}
+
+func sortedNames(list corev1.ResourceList) []corev1.ResourceName {
+	names := make([]corev1.ResourceName, 0, len(list))
+	for name := range list {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// capacity checks that a ready, schedulable node the new pod may run on
+// (node selector, required node affinity, taints) has the profile's GPUs
+// free: allocatable minus the requests of the pods running on it.
+func (p *preflight) capacity(ctx context.Context, spec *corev1.PodSpec) {
+	key := corev1.ResourceName(p.profile.ResourceKey)
+	nodes, err := p.cs.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		p.add(api.CheckCapacity, api.CheckUnknown, "list nodes: %v", err)
+		return
+	}
+	pods, err := p.cs.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "status.phase!=Succeeded,status.phase!=Failed"})
+	if err != nil {
+		p.add(api.CheckCapacity, api.CheckUnknown, "list pods: %v", err)
+		return
+	}
+	p.nodes = nodes.Items
+	used := map[string]int64{}
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == "" {
+			continue
+		}
+		requests, _ := podResources(&pod.Spec)
+		if q, ok := requests[key]; ok {
+			used[pod.Spec.NodeName] += q.Value()
+		}
+	}
+
+	need := int64(p.profile.Count)
+	var best string
+	var bestFree int64 = -1
+	offering := 0
+	for _, node := range nodes.Items {
+		alloc, ok := node.Status.Allocatable[key]
+		if !ok || alloc.IsZero() || !nodeReady(&node) || !schedulable(spec, &node) {
+			continue
+		}
+		offering++
+		free := alloc.Value() - used[node.Name]
+		if free > bestFree {
+			best, bestFree = node.Name, free
+		}
+		if free >= need {
+			p.fitting = append(p.fitting, node.Name)
+		}
+	}
+	p.nodesKnown = true
+	sort.Strings(p.fitting)
+	switch {
+	case len(p.fitting) > 0:
+		p.add(api.CheckCapacity, api.CheckPassed, "%d nodes have %d %s free, e.g. %s", len(p.fitting), need, key, p.fitting[0])
+	case offering == 0:
+		p.add(api.CheckCapacity, api.CheckFailed, "no ready node the notebook may run on offers %s", key)
+	default:
+		p.add(api.CheckCapacity, api.CheckFailed, "no node has %d %s free (at most %d, on %s)", need, key, bestFree, best)
+	}
+}
+
+func nodeReady(node *corev1.Node) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// schedulable reports whether a pod with spec may be scheduled on node
+// according to its node selector, required node affinity and tolerations.
+func schedulable(spec *corev1.PodSpec, node *corev1.Node) bool {
+	nodeLabels := labels.Set(node.Labels)
+	if !labels.SelectorFromSet(spec.NodeSelector).Matches(nodeLabels) {
+		return false
+	}
+	if a := spec.Affinity; a != nil && a.NodeAffinity != nil && a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		terms := a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+		if !slices.ContainsFunc(terms, func(t corev1.NodeSelectorTerm) bool { return termMatches(t, node) }) {
+			return false
+		}
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Effect == corev1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		if !slices.ContainsFunc(spec.Tolerations, func(t corev1.Toleration) bool { return t.ToleratesTaint(&taint) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// termMatches evaluates a node selector term; an empty term matches nothing.
+func termMatches(t corev1.NodeSelectorTerm, node *corev1.Node) bool {
+	if len(t.MatchExpressions) == 0 && len(t.MatchFields) == 0 {
+		return false
+	}
+	match := func(reqs []corev1.NodeSelectorRequirement, set labels.Set) bool {
+		for _, r := range reqs {
+			// In, NotIn, Exists, Gt and Lt are the lower-case selection operators
+			op := selection.Operator(strings.ToLower(string(r.Operator)))
+			if r.Operator == corev1.NodeSelectorOpDoesNotExist {
+				op = selection.DoesNotExist
+			}
+			req, err := labels.NewRequirement(r.Key, op, r.Values)
+			if err != nil || !req.Matches(set) {
+				return false
+			}
+		}
+		return true
+	}
+	return match(t.MatchExpressions, labels.Set(node.Labels)) &&
+		match(t.MatchFields, labels.Set{"metadata.name": node.Name})
+}
+
+// volumes checks that the new pod can mount the claims of the notebook while
+// the old pod still runs: ReadWriteOncePod claims never can, ReadWriteOnce
+// claims only on the node of the old pod, which must then fit the new pod.
+func (p *preflight) volumes(ctx context.Context, backend workload.Backend, src *workload.Workload, spec *corev1.PodSpec) {
+	oldNode := ""
+	if !src.Stopped {
+		pod, err := backend.Pod(ctx, src.Namespace, src.Name)
+		if err != nil {
+			p.add(api.CheckVolumes, api.CheckUnknown, "get pod of %s: %v", src.Name, err)
+			return
+		}
+		if pod != nil {
+			oldNode = pod.Spec.NodeName
+		}
+	}
+
+	var failed, unknown, ok []string
+	for _, v := range spec.Volumes {
+		if v.PersistentVolumeClaim == nil {
+			continue
+		}
+		claim := v.PersistentVolumeClaim.ClaimName
+		pvc, err := p.cs.CoreV1().PersistentVolumeClaims(src.Namespace).Get(ctx, claim, metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+			failed = append(failed, fmt.Sprintf("claim %s does not exist", claim))
+			continue
+		case err != nil:
+			unknown = append(unknown, fmt.Sprintf("get claim %s: %v", claim, err))
+			continue
+		case pvc.Status.Phase == corev1.ClaimLost:
+			failed = append(failed, fmt.Sprintf("claim %s lost its volume", claim))
+			continue
+		}
+		modes := pvc.Spec.AccessModes
+		switch {
+		case slices.Contains(modes, corev1.ReadWriteMany), slices.Contains(modes, corev1.ReadOnlyMany):
+			ok = append(ok, claim)
+		case slices.Contains(modes, corev1.ReadWriteOncePod):
+			failed = append(failed, fmt.Sprintf("claim %s is ReadWriteOncePod and cannot be mounted by the old and the new pod at once", claim))
+		case oldNode == "":
+			// not mounted right now
+			ok = append(ok, claim)
+		case !p.nodesKnown:
+			unknown = append(unknown, fmt.Sprintf("claim %s is ReadWriteOnce on node %s, whose free GPUs are unknown", claim, oldNode))
+		case !slices.Contains(p.fitting, oldNode):
+			failed = append(failed, fmt.Sprintf("claim %s is ReadWriteOnce and attached to node %s, which cannot run the new pod; use ReadWriteMany storage", claim, oldNode))
+		default:
+			ok = append(ok, claim)
+		}
+	}
+	switch {
+	case len(failed) > 0:
+		p.add(api.CheckVolumes, api.CheckFailed, "%s", strings.Join(failed, "; "))
+	case len(unknown) > 0:
+		p.add(api.CheckVolumes, api.CheckUnknown, "%s", strings.Join(unknown, "; "))
+	case len(ok) == 0:
+		p.add(api.CheckVolumes, api.CheckPassed, "no persistent volume claims")
+	default:
+		p.add(api.CheckVolumes, api.CheckPassed, "claims %s can be mounted by the new pod", strings.Join(ok, ", "))
+	}
+}
+
+// images checks that every image of the new pod is cached on a node or found
+// in its registry.
+func (p *preflight) images(ctx context.Context, spec *corev1.PodSpec) {
+	cached := map[string]bool{}
+	for _, node := range p.nodes {
+		for _, img := range node.Status.Images {
+			for _, name := range img.Names {
+				cached[normalizeImage(name)] = true
+			}
+		}
+	}
+	var images []string
+	for _, c := range append(slices.Clone(spec.InitContainers), spec.Containers...) {
+		if !slices.Contains(images, c.Image) {
+			images = append(images, c.Image)
+		}
+	}
+
+	var failed, unknown []string
+	for _, img := range images {
+		if cached[normalizeImage(img)] {
+			continue
+		}
+		found, err := imageExists(ctx, img)
+		switch {
+		case err != nil:
+			unknown = append(unknown, fmt.Sprintf("%s: %v", img, err))
+		case !found:
+			failed = append(failed, fmt.Sprintf("image %s not found", img))
+		}
+	}
+	switch {
+	case len(failed) > 0:
+		p.add(api.CheckImages, api.CheckFailed, "%s", strings.Join(failed, "; "))
+	case len(unknown) > 0:
+		p.add(api.CheckImages, api.CheckUnknown, "%s", strings.Join(unknown, "; "))
+	default:
+		p.add(api.CheckImages, api.CheckPassed, "%d images available", len(images))
+	}
+}
+
+// hubPodSpec approximates the pod of a Hub server started with profile: its
+// GPUs and placement; the KubeSpawner profile may set more.
+func hubPodSpec(profile Profile) *corev1.PodSpec {
+	qty := *resource.NewQuantity(int64(profile.Count), resource.DecimalSI)
+	gpus := corev1.ResourceList{corev1.ResourceName(profile.ResourceKey): qty}
+	return &corev1.PodSpec{
+		Containers:   []corev1.Container{{Resources: corev1.ResourceRequirements{Requests: gpus, Limits: gpus}}},
+		NodeSelector: profile.NodeSelector,
+		Tolerations:  profile.Tolerations,
+		Affinity:     profile.Affinity,
+	}
+}
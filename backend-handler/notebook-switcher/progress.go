@@ -0,0 +1,20 @@
+package switcher
+
+import (
+	"context"
+	"fmt"
+)
+
+type progressKey struct{}
+
+// WithProgress returns a context that makes SwitcherToGPU/SwitcherToCPU report
+// each step they start to fn, e.g. to show it to a user watching the migration.
+func WithProgress(ctx context.Context, fn func(step string)) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func reportProgress(ctx context.Context, format string, args ...any) {
+	if fn, ok := ctx.Value(progressKey{}).(func(string)); ok {
+		fn(fmt.Sprintf(format, args...))
+	}
+}
@@ -0,0 +1,138 @@
+package switcher
+
+import (
+	"backend-handler/tracing"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// errCredentials is returned by imageExists for registries that refuse
+// anonymous pulls; the backend does not use the pods' pull secrets.
+var errCredentials = errors.New("registry requires credentials")
+
+// manifestTypes are the manifest media types a registry may answer with.
+var manifestTypes = strings.Join([]string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}, ", ")
+
+var registryClient = &http.Client{Timeout: 10 * time.Second, Transport: tracing.WrapTransport(http.DefaultTransport)}
+
+// splitImage splits an image reference into registry host, repository and
+// tag or digest, e.g. "python:3" into "registry-1.docker.io",
+// "library/python" and "3".
+func splitImage(image string) (host, repo, ref string) {
+	host, repo, _ = strings.Cut(normalizeImage(image), "/")
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	if r, digest, ok := strings.Cut(repo, "@"); ok {
+		return host, r, digest
+	}
+	ref = "latest"
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo, ref = repo[:i], repo[i+1:]
+	}
+	return host, repo, ref
+}
+
+// imageExists asks the registry of image for its manifest (Docker Registry
+// HTTP API v2), with an anonymous token if the registry wants one.
+func imageExists(ctx context.Context, image string) (bool, error) {
+	host, repo, ref := splitImage(image)
+	u := "https://" + host + "/v2/" + repo + "/manifests/" + ref
+
+	resp, err := headManifest(ctx, u, "")
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		token, err := anonymousToken(ctx, resp.Header.Get("WWW-Authenticate"), repo)
+		if err != nil {
+			return false, err
+		}
+		if resp, err = headManifest(ctx, u, token); err != nil {
+			return false, err
+		}
+	}
+	switch {
+	case resp.StatusCode/100 == 2:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		// Docker Hub answers 401 for missing repositories too
+		return false, errCredentials
+	}
+	return false, fmt.Errorf("HEAD %s: unexpected status %s", u, resp.Status)
+}
+
+func headManifest(ctx context.Context, u, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", manifestTypes)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// anonymousToken gets a pull token for repo from the token service of a
+// challenge such as `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func anonymousToken(ctx context.Context, challenge, repo string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", errCredentials
+	}
+	attrs := map[string]string{}
+	for _, p := range strings.Split(params, ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok {
+			attrs[k] = strings.Trim(v, `"`)
+		}
+	}
+	if attrs["realm"] == "" {
+		return "", errCredentials
+	}
+	q := url.Values{"scope": {"repository:" + repo + ":pull"}}
+	if s := attrs["service"]; s != "" {
+		q.Set("service", s)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, attrs["realm"]+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", errCredentials
+	}
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("decode registry token: %w", err)
+	}
+	if tok.Token == "" {
+		tok.Token = tok.AccessToken
+	}
+	return tok.Token, nil
+}
@@ -0,0 +1,174 @@
+package switcher
+
+import (
+	"backend-handler/api"
+	nbpods "backend-handler/get-nbpods-name"
+	"backend-handler/workload"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// HistoryAnnotation holds the migration history of a notebook as a JSON array
+// of api.HistoryEntry. It is copied to every clone, so the newest Notebook
+// carries the history of its predecessors.
+const HistoryAnnotation = "gpu-switcher/history"
+
+// maxHistory bounds the number of entries kept in HistoryAnnotation.
+const maxHistory = 20
+
+// newClients builds the dynamic and typed clients from BuildConfig.
+func newClients() (dynamic.Interface, kubernetes.Interface, error) {
+	cfg, err := BuildConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("build kube config: %w", err)
+	}
+	dc, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dynamic client: %w", err)
+	}
+	cs, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("k8s clientset: %w", err)
+	}
+	return dc, cs, nil
+}
+
+// GetStatus returns the state of notebook name in namespace.
+func GetStatus(ctx context.Context, namespace, name string) (*api.NotebookStatus, error) {
+	dc, cs, err := newClients()
+	if err != nil {
+		return nil, err
+	}
+	nsCfg, err := LoadConfig(ctx, cs, namespace)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := nsCfg.Backend(dc, cs)
+	if err != nil {
+		return nil, err
+	}
+	nb, err := backend.Get(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &api.NotebookStatus{
+		Name:      name,
+		Namespace: namespace,
+		Mode:      api.ModeCPU,
+		Stopped:   nb.Stopped,
+		Created:   nb.GetCreationTimestamp().Time,
+	}
+	if HasGPUResources(nb, nsCfg.ResourceKeys()...) {
+		st.Mode = api.ModeGPU
+		st.Profile = nb.GetAnnotations()[ProfileAnnotation]
+	}
+	pod, err := backend.Pod(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if pod != nil {
+		st.PodName = pod.Name
+		st.PodPhase = string(pod.Status.Phase)
+		st.Ready = nbpods.IsPodReady(pod)
+	}
+	return st, nil
+}
+
+// GetHistory returns the migrations that led to notebook name, oldest first.
+func GetHistory(ctx context.Context, namespace, name string) ([]api.HistoryEntry, error) {
+	backend, _, err := namespaceBackend(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	nb, err := backend.Get(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return history(nb), nil
+}
+
+// namespaceBackend returns the workload backend and configuration of namespace.
+func namespaceBackend(ctx context.Context, namespace string) (workload.Backend, *Config, error) {
+	dc, cs, err := newClients()
+	if err != nil {
+		return nil, nil, err
+	}
+	nsCfg, err := LoadConfig(ctx, cs, namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	backend, err := nsCfg.Backend(dc, cs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return backend, nsCfg, nil
+}
+
+// GetConfig returns the switcher configuration (profiles and policy) of namespace.
+func GetConfig(ctx context.Context, namespace string) (*Config, error) {
+	_, cs, err := newClients()
+	if err != nil {
+		return nil, err
+	}
+	return LoadConfig(ctx, cs, namespace)
+}
+
+func history(obj metav1.Object) []api.HistoryEntry {
+	var h []api.HistoryEntry
+	if raw := obj.GetAnnotations()[HistoryAnnotation]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &h); err != nil {
+			fmt.Printf("ignoring malformed %s on %s: %v\n", HistoryAnnotation, obj.GetName(), err)
+			return nil
+		}
+	}
+	return h
+}
+
+// MigratedAt returns when the migration that led to obj ran, as recorded in
+// HistoryAnnotation. A notebook adopted by a migration is older than that.
+func MigratedAt(obj metav1.Object) (time.Time, bool) {
+	h := history(obj)
+	if len(h) == 0 || h[len(h)-1].To != obj.GetName() {
+		return time.Time{}, false
+	}
+	return h[len(h)-1].Time, true
+}
+
+// GPUSessionStart returns when the GPU session of obj started: the first of
+// the migrations to GPU that led to it without a migration to CPU in between,
+// as recorded in HistoryAnnotation. Switching between GPU profiles keeps the
+// session. It reports false for notebooks not created by a migration to GPU.
+func GPUSessionStart(obj metav1.Object) (time.Time, bool) {
+	h := history(obj)
+	if len(h) == 0 || h[len(h)-1].To != obj.GetName() {
+		return time.Time{}, false
+	}
+	i := len(h)
+	for i > 0 && h[i-1].Mode == api.ModeGPU {
+		i--
+	}
+	if i == len(h) {
+		return time.Time{}, false
+	}
+	return h[i].Time, true
+}
+
+// appendHistory adds e to the history annotation of obj, keeping the newest maxHistory entries.
+func appendHistory(obj metav1.Object, e api.HistoryEntry) {
+	h := append(history(obj), e)
+	if len(h) > maxHistory {
+		h = h[len(h)-maxHistory:]
+	}
+	raw, err := json.Marshal(h)
+	if err != nil {
+		return
+	}
+	setAnnotation(obj, HistoryAnnotation, string(raw))
+}
@@ -0,0 +1,60 @@
+package switcher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGPUSessionStart(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		history string
+		want    time.Time
+		wantOK  bool
+	}{
+		{name: "no history"},
+		{name: "to GPU", history: `[{"time":"2026-01-01T08:00:00Z","from":"nb","to":"nb-gpu","mode":"gpu"}]`, want: t0, wantOK: true},
+		{
+			name: "GPU to GPU keeps the session",
+			history: `[{"time":"2026-01-01T08:00:00Z","from":"nb","to":"nb-gpu","mode":"gpu"},
+				{"time":"2026-01-01T10:00:00Z","from":"nb-gpu","to":"nb-gpu","mode":"gpu","profile":"a100"}]`,
+			want: t0, wantOK: true,
+		},
+		{
+			name: "back from CPU starts a new session",
+			history: `[{"time":"2026-01-01T08:00:00Z","from":"nb","to":"nb-gpu","mode":"gpu"},
+				{"time":"2026-01-01T09:00:00Z","from":"nb-gpu","to":"nb","mode":"cpu"},
+				{"time":"2026-01-01T10:00:00Z","from":"nb","to":"nb-gpu","mode":"gpu"}]`,
+			want: t0.Add(2 * time.Hour), wantOK: true,
+		},
+		{name: "last migration to CPU", history: `[{"time":"2026-01-01T09:00:00Z","from":"nb","to":"nb-gpu","mode":"cpu"}]`},
+		{name: "history of another notebook", history: `[{"time":"2026-01-01T08:00:00Z","from":"nb","to":"other","mode":"gpu"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nb := newWorkload("nb-gpu", "uid")
+			if tt.history != "" {
+				nb.Annotations = map[string]string{HistoryAnnotation: tt.history}
+			}
+			got, ok := GPUSessionStart(nb)
+			if ok != tt.wantOK || !got.Equal(tt.want) {
+				t.Errorf("GPUSessionStart = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMigratedAt(t *testing.T) {
+	nb := newWorkload("nb-gpu", "uid")
+	if _, ok := MigratedAt(nb); ok {
+		t.Error("MigratedAt of a notebook without history reported a migration")
+	}
+	nb.Annotations = map[string]string{HistoryAnnotation: `[{"time":"2026-01-01T08:00:00Z","from":"nb","to":"nb-gpu","mode":"gpu"},
+		{"time":"2026-01-01T09:00:00Z","from":"nb-gpu","to":"nb","mode":"cpu"},
+		{"time":"2026-01-01T10:00:00Z","from":"nb","to":"nb-gpu","mode":"gpu"}]`}
+	want := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	if got, ok := MigratedAt(nb); !ok || !got.Equal(want) {
+		t.Errorf("MigratedAt = %v, %v, want %v", got, ok, want)
+	}
+}
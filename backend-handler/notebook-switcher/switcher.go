@@ -1,37 +1,72 @@
 package switcher
 
 import (
+	"backend-handler/api"
 	nbpods "backend-handler/get-nbpods-name"
+	"backend-handler/notebook"
+	"backend-handler/retry"
+	"backend-handler/tracing"
+	"backend-handler/workload"
 	"context"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-// Switcher clones a Kubeflow Notebook <podName> in <podNamespace> into <podName>-gpu,
-// and injects GPU resources. The GPU resource key is loaded from a ConfigMap
-// so you can switch types later without changing code.
+var tracer = otel.Tracer("backend-handler/notebook-switcher")
+
+const (
+	// ProfileAnnotation records the GPU profile a notebook was migrated to.
+	ProfileAnnotation = "gpu-switcher/profile"
+	// StoppedAnnotation is set by Kubeflow on Notebooks scaled down to zero.
+	StoppedAnnotation = workload.KubeflowStoppedAnnotation
+	// ManagedByAnnotation marks Notebooks created by the switcher; the admission
+	// webhook only lets such Notebooks carry GPU resources.
+	ManagedByAnnotation = "gpu-switcher/managed-by"
+	ManagedByValue      = "notebook-switcher"
+	// MigratingAnnotation marks the new notebook of a migration in progress
+	// with the time it started (RFC 3339); the family reconciler leaves its
+	// family alone.
+	MigratingAnnotation = "gpu-switcher/migrating-since"
+)
+
+// Switcher clones a notebook workload <podName> in <podNamespace> into <podName>-gpu,
+// and injects GPU resources. The GPU resource key and count come from the
+// requested profile of the namespace ConfigMap (see LoadConfig), so you can
+// switch types later without changing code.
 //   - ConfigMap name: "gpu-switcher-config" (in the same namespace)
-//   - Key: "gpuResourceKey"
-//   - Default if missing: "nvidia.com/gpu"
+//   - Profile "default": keys "gpuResourceKey" / "numGpuResource"
+//   - Default if missing: 1 "nvidia.com/gpu"
 //
-// GPU count is set to 1 by default (requests = limits = 1).
-func SwitcherToGPU(notebookName, notebookNamespace string) (string, error) {
-	apiCtx, apiCancel := context.WithTimeout(context.Background(), 1*time.Minute)
-	defer apiCancel()
-
-	cfg, err := buildConfig()
+// The workload is a Kubeflow Notebook unless the ConfigMap selects another
+// backend of package workload.
+//
+// The namespace policy is enforced before anything is created; a violation is
+// returned as *policy.DeniedError.
+//
+// Every step is recorded as a child span of ctx; cancellation of ctx aborts the switch.
+func SwitcherToGPU(ctx context.Context, notebookName, notebookNamespace, profileName string) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "SwitcherToGPU", trace.WithAttributes(
+		attribute.String("notebook.name", notebookName),
+		attribute.String("notebook.namespace", notebookNamespace),
+		attribute.String("gpu.profile", profileName),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	cfg, err := BuildConfig()
 	if err != nil {
 		return "", fmt.Errorf("build kube config: %w", err)
 	}
@@ -46,90 +81,109 @@ func SwitcherToGPU(notebookName, notebookNamespace string) (string, error) {
 		return "", fmt.Errorf("k8s clientset: %w", err)
 	}
 
-	// 1) Get GPU resource key from ConfigMap
-	gpuKey := "nvidia.com/gpu"
-	gpuNumstr := "1"
-	if cmKey01, cmKey02, err := loadGPUResourceKey(apiCtx, cs, notebookNamespace); err == nil && cmKey01 != "" && cmKey02 != "" {
-		gpuKey = cmKey01
-		gpuNumstr = cmKey02
+	// 1) Get GPU profile and policy from ConfigMap
+	nsCfg, err := loadConfigWithin(ctx, cs, notebookNamespace, DefaultGPUTimeouts.API)
+	if err != nil {
+		return "", err
+	}
+	profile, err := nsCfg.Profile(profileName)
+	if err != nil {
+		return "", err
 	}
-	gpuNum, err := strconv.Atoi(gpuNumstr)
-	fmt.Printf("gpuNum Type: %T", gpuNum)
+	timeouts := nsCfg.gpuTimeouts(profile)
+	apiCtx, apiCancel := context.WithTimeout(ctx, timeouts.API)
+	defer apiCancel()
+	backend, err := nsCfg.Backend(dc, cs)
 	if err != nil {
-		fmt.Printf("cannot convert from string to int: %v", err)
+		return "", err
 	}
+
 	// 2) Get source Notebook
-	gvr := schema.GroupVersionResource{Group: "kubeflow.org", Version: "v1", Resource: "notebooks"}
-	src, err := dc.Resource(gvr).Namespace(notebookNamespace).Get(apiCtx, notebookName, metav1.GetOptions{})
+	getCtx, getSpan := tracer.Start(apiCtx, "get source notebook")
+	src, err := backend.Get(getCtx, notebookNamespace, notebookName)
+	tracing.End(getSpan, err)
 	if err != nil {
 		return "", fmt.Errorf("get source notebook %q: %w", notebookName, err)
 	}
-
-	// 3) Build clone object
-	dst := src.DeepCopy()
-	dstName := setNameGPU(notebookName)
-	// dstName := notebookName + "-gpu"
-	if err := cleanupMetadata(dst, dstName); err != nil {
-		return "", fmt.Errorf("cleanup metadata: %w", err)
+	family, err := lockFamily(apiCtx, cs, src)
+	if err != nil {
+		return "", err
 	}
-	removeStatus(dst)
+	defer family.release()
 
-	// 4) Inject GPU (1 GPU) using key from ConfigMap
-	if err := ensureGPUResourcesWithKey(dst, gpuKey, 1); err != nil {
-		return "", fmt.Errorf("inject gpu resources: %w", err)
+	// The GPU notebooks counted by the policy change only once the clone
+	// exists: count and create under the lock of the namespace
+	var limit *lock
+	if nsCfg.Policy.MaxGPUNotebooks > 0 {
+		if limit, err = lockGPULimit(apiCtx, cs, notebookNamespace); err != nil {
+			return "", err
+		}
+		defer limit.release()
 	}
-
-	// Inject runtime class name
-	if err := ensureRuntimeClassName(dst, "nvidia"); err != nil {
-		return "", fmt.Errorf("inject runtime class name: %w", err)
+	if err := checkPolicy(apiCtx, backend, nsCfg, profile.Name, notebookName); err != nil {
+		return "", err
 	}
 
-	// 5) Create the new Notebook
-	if _, err := dc.Resource(gvr).Namespace(notebookNamespace).Create(apiCtx, dst, metav1.CreateOptions{}); err != nil {
-		return "", fmt.Errorf("create notebook %q and error: %w", dstName, err)
-	}
+	// 3) Build clone object
+	_, canonical := Family(src)
+	dstName := cloneName(canonical, api.ModeGPU)
+	toGPU := gpuMutation(src, nsCfg, profile)
 
-	// 6) Handle new notebook pod
-	// Create its own ctx which lasts 5 minutes for waiting
-	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Minute)
-	defer waitCancel()
-	NewNotebookPodName, err := nbpods.FindFirstPodNameByNotebookName(waitCtx, cs, dstName, notebookNamespace)
+	// 5) Create the new Notebook
+	reportProgress(ctx, "creating notebook %s", dstName)
+	createCtx, createSpan := tracer.Start(apiCtx, "create notebook", trace.WithAttributes(attribute.String("notebook.new_name", dstName)))
+	dstName, err = createTarget(createCtx, backend, src, dstName, canonical, api.ModeGPU, toGPU)
+	tracing.End(createSpan, err)
 	if err != nil {
-		fmt.Printf("%v", err)
+		return "", fmt.Errorf("create notebook %q and error: %w", dstName, err)
 	}
-	fmt.Printf("New notebook pod name: %v is created\n", NewNotebookPodName)
-
-	if err := nbpods.WaitPodReady(waitCtx, cs, notebookNamespace, NewNotebookPodName, 5*time.Minute); err != nil {
-		// return pod name and error
-		return NewNotebookPodName, err
+	if limit != nil {
+		limit.release()
 	}
-	fmt.Printf("New notebook pod %v is Ready now!\n", NewNotebookPodName)
 
-	// 7) Waits for 15 mintues before deleting old notebook pod
-	time.Sleep(15 * time.Second)
-	delCtx, delCancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer delCancel()
+	return handover(ctx, cfg, cs, backend, nsCfg, src, dstName, timeouts)
+}
 
-	// PropagationBackground for quick delete, immediate returns result, related resources when will be deleted in background
-	// PropagationForeground for normal delete, wil wait for successful deletion
-	policy := metav1.DeletePropagationForeground
-	if err := dc.Resource(gvr).Namespace(notebookNamespace).Delete(
-		delCtx,
-		notebookName,
-		metav1.DeleteOptions{PropagationPolicy: &policy},
-	); err != nil {
-		return NewNotebookPodName, fmt.Errorf("delete old notebook %q: %w", notebookName, err)
+// gpuMutation turns a clone of src into the GPU notebook of profile.
+func gpuMutation(src *workload.Workload, nsCfg *Config, profile Profile) workload.Mutation {
+	notebookName := src.Name
+	return func(dst *workload.Workload) error {
+		setAnnotation(dst, ManagedByAnnotation, ManagedByValue)
+		setFamily(dst, src)
+
+		// 4) Inject GPU resources of the profile into the notebook container only
+		idx, err := mainContainer(dst, nsCfg.NotebookContainer, notebookName)
+		if err != nil {
+			return err
+		}
+		setAnnotation(dst, ContainerAnnotation, dst.PodSpec().Containers[idx].Name)
+		ensureGPUResourcesWithKey(dst, idx, profile.ResourceKey, profile.Count)
+		setAnnotation(dst, ProfileAnnotation, profile.Name)
+		appendHistory(dst, api.HistoryEntry{Time: time.Now().UTC(), From: notebookName, To: dst.Name, Mode: api.ModeGPU, Profile: profile.Name})
+
+		// Inject runtime class name, replacing that of the previous profile
+		clearRuntimeClass(dst, nsCfg)
+		if profile.RuntimeClassName != "" {
+			dst.PodSpec().RuntimeClassName = &profile.RuntimeClassName
+		}
+		// Env and scheduling of the profile replace those of the previous mode
+		if err := setPlacement(dst, idx, profile.Placement); err != nil {
+			return err
+		}
+		return mapImages(dst, nsCfg, api.DirectionToGPU)
 	}
-	fmt.Printf("Requested deletion of old notebook %s/%s (background propagation)\n", notebookNamespace, notebookName)
-
-	return NewNotebookPodName, nil
 }
 
-func SwitcherToCPU(notebookName, notebookNamespace string) (string, error) {
-	apiCtx, apiCancel := context.WithTimeout(context.Background(), 1*time.Minute)
-	defer apiCancel()
+// SwitcherToCPU clones the Kubeflow Notebook into its CPU-only counterpart,
+// removes the GPU resources and deletes the old Notebook once the new pod is Ready.
+func SwitcherToCPU(ctx context.Context, notebookName, notebookNamespace string) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "SwitcherToCPU", trace.WithAttributes(
+		attribute.String("notebook.name", notebookName),
+		attribute.String("notebook.namespace", notebookNamespace),
+	))
+	defer func() { tracing.End(span, err) }()
 
-	cfg, err := buildConfig()
+	cfg, err := BuildConfig()
 	if err != nil {
 		return "", fmt.Errorf("build kube config: %w", err)
 	}
@@ -144,75 +198,208 @@ func SwitcherToCPU(notebookName, notebookNamespace string) (string, error) {
 		return "", fmt.Errorf("k8s clientset: %w", err)
 	}
 
-	// 1) Get GPU resource key from ConfigMap
-	gpuKey := "nvidia.com/gpu"
-	if cmKey01, cmKey02, err := loadGPUResourceKey(apiCtx, cs, notebookNamespace); err == nil && cmKey01 != "" && cmKey02 != "" {
-		gpuKey = cmKey01
+	// 1) Get GPU resource keys from ConfigMap
+	nsCfg, err := loadConfigWithin(ctx, cs, notebookNamespace, DefaultCPUTimeouts.API)
+	if err != nil {
+		return "", err
+	}
+	timeouts := nsCfg.cpuTimeouts()
+	apiCtx, apiCancel := context.WithTimeout(ctx, timeouts.API)
+	defer apiCancel()
+	backend, err := nsCfg.Backend(dc, cs)
+	if err != nil {
+		return "", err
 	}
 
 	// 2) Get source Notebook
-	gvr := schema.GroupVersionResource{Group: "kubeflow.org", Version: "v1", Resource: "notebooks"}
-	src, err := dc.Resource(gvr).Namespace(notebookNamespace).Get(apiCtx, notebookName, metav1.GetOptions{})
+	getCtx, getSpan := tracer.Start(apiCtx, "get source notebook")
+	src, err := backend.Get(getCtx, notebookNamespace, notebookName)
+	tracing.End(getSpan, err)
 	if err != nil {
 		return "", fmt.Errorf("get source notebook %q: %w", notebookName, err)
 	}
-
-	// 3) Build clone object
-	dst := src.DeepCopy()
-	dstName := setNameCPU(notebookName)
-	// dstName := notebookName + "-gpu"
-	if err := cleanupMetadata(dst, dstName); err != nil {
-		return "", fmt.Errorf("cleanup metadata: %w", err)
+	family, err := lockFamily(apiCtx, cs, src)
+	if err != nil {
+		return "", err
 	}
-	removeStatus(dst)
+	defer family.release()
 
-	// 4) Delete GPU resources from configuration using key from ConfigMap
-	if err := removeGPUResourcesWithKey(dst, gpuKey); err != nil {
-		return "", fmt.Errorf("remove gpu resources: %w", err)
+	// 3) Build clone object
+	_, canonical := Family(src)
+	dstName := cloneName(canonical, api.ModeCPU)
+	toCPU := func(dst *workload.Workload) error {
+		setAnnotation(dst, ManagedByAnnotation, ManagedByValue)
+		setFamily(dst, src)
+
+		// 4) Delete GPU resources of every profile from configuration. They are
+		// removed from every container, which also cleans up clones made when
+		// GPUs were injected into sidecars too.
+		idx, err := mainContainer(dst, nsCfg.NotebookContainer, notebookName)
+		if err != nil {
+			return err
+		}
+		setAnnotation(dst, ContainerAnnotation, dst.PodSpec().Containers[idx].Name)
+		for _, gpuKey := range nsCfg.ResourceKeys() {
+			removeGPUResourcesWithKey(dst, gpuKey)
+		}
+		clearRuntimeClass(dst, nsCfg)
+		setAnnotation(dst, ProfileAnnotation, "")
+		if err := setPlacement(dst, idx, nsCfg.CPUPlacement); err != nil {
+			return err
+		}
+		appendHistory(dst, api.HistoryEntry{Time: time.Now().UTC(), From: notebookName, To: dst.Name, Mode: api.ModeCPU})
+		return mapImages(dst, nsCfg, api.DirectionToCPU)
 	}
 
 	// 5) Create the new Notebook
-	if _, err := dc.Resource(gvr).Namespace(notebookNamespace).Create(apiCtx, dst, metav1.CreateOptions{}); err != nil {
+	reportProgress(ctx, "creating notebook %s", dstName)
+	createCtx, createSpan := tracer.Start(apiCtx, "create notebook", trace.WithAttributes(attribute.String("notebook.new_name", dstName)))
+	dstName, err = createTarget(createCtx, backend, src, dstName, canonical, api.ModeCPU, toCPU)
+	tracing.End(createSpan, err)
+	if err != nil {
 		return "", fmt.Errorf("create notebook %q and error: %w", dstName, err)
 	}
 
+	return handover(ctx, cfg, cs, backend, nsCfg, src, dstName, timeouts)
+}
+
+// handover runs the steps both directions share once the clone dstName of
+// src exists: it waits for the pod of the clone, carries the workspaces,
+// checkpoint and files over and deletes src. It returns the pod of the clone,
+// also with an error when the clone is kept. When src must be kept instead,
+// the clone is stopped, so that both do not hold resources.
+func handover(ctx context.Context, cfg *rest.Config, cs kubernetes.Interface, backend workload.Backend, nsCfg *Config, src *workload.Workload, dstName string, timeouts Timeouts) (string, error) {
+	notebookName, notebookNamespace := src.Name, src.Namespace
+	defer finishMigrating(ctx, backend, notebookNamespace, dstName)
+
 	// 6) Handle new notebook pod
-	// Create its own ctx which lasts 5 minutes for waiting
-	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	reportProgress(ctx, "waiting for the pod of %s", dstName)
+	// Create its own ctx bounding the wait for the pod
+	waitCtx, waitCancel := context.WithTimeout(ctx, timeouts.PodReady)
 	defer waitCancel()
-	NewNotebookPodName, err := nbpods.FindFirstPodNameByNotebookName(waitCtx, cs, dstName, notebookNamespace)
+	NewNotebookPodName, err := backend.FindPod(waitCtx, notebookNamespace, dstName)
 	if err != nil {
 		fmt.Printf("%v", err)
 	}
 	fmt.Printf("New notebook pod name: %v is created\n", NewNotebookPodName)
 
-	if err := nbpods.WaitPodReady(waitCtx, cs, notebookNamespace, NewNotebookPodName, 5*time.Minute); err != nil {
+	reportProgress(ctx, "waiting for pod %s to become ready", NewNotebookPodName)
+	if err := nbpods.WaitPodReady(waitCtx, cs, notebookNamespace, NewNotebookPodName, timeouts.PodReady); err != nil {
 		// return pod name and error
 		return NewNotebookPodName, err
 	}
 	fmt.Printf("New notebook pod %v is Ready now!\n", NewNotebookPodName)
 
-	// 7) Waits for 15 seconds before deleting old notebook pod
-	// time.Sleep(15 * time.Second)
-	delCtx, delCancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer delCancel()
+	// 7) Wait for the drain delay before touching the old notebook
+	if err := drain(ctx, timeouts.Drain); err != nil {
+		return NewNotebookPodName, err
+	}
+	// Restore the open tabs and layout; the switch goes on without them
+	reportProgress(ctx, "copying JupyterLab workspaces to %s", dstName)
+	if n, err := carryWorkspaces(ctx, notebookNamespace, notebookName, dstName); err != nil {
+		fmt.Printf("Could not copy JupyterLab workspaces of %s/%s: %v\n", notebookNamespace, notebookName, err)
+	} else {
+		fmt.Printf("Copied %d JupyterLab workspaces to %s/%s\n", n, notebookNamespace, dstName)
+	}
+
+	// Save the state of the old notebook; keep it if that fails
+	if nsCfg.Checkpoint != nil {
+		reportProgress(ctx, "checkpointing notebook %s", notebookName)
+		if err := checkpoint(ctx, cfg, cs, backend, nsCfg, src, NewNotebookPodName); err != nil {
+			return "", keepOld(ctx, backend, src, dstName, fmt.Errorf("checkpoint failed: %w", err))
+		}
+	}
+	if nsCfg.Transfer != nil {
+		reportProgress(ctx, "copying files from notebook %s", notebookName)
+		res, err := transfer(ctx, cfg, cs, backend, nsCfg, src, NewNotebookPodName, timeouts.Transfer)
+		if err != nil {
+			return "", keepOld(ctx, backend, src, dstName, fmt.Errorf("file transfer failed: %w", err))
+		}
+		reportProgress(ctx, "copied %d files (%d bytes), skipped %d over limits", res.Files, res.Bytes, len(res.Skipped))
+		fmt.Printf("Copied %d files (%d bytes) to %s, skipped %v\n", res.Files, res.Bytes, NewNotebookPodName, res.Skipped)
+	}
 
-	// PropagationBackground for quick delete, immediate returns result, related resources when will be deleted in background
-	// PropagationForeground for normal delete, wil wait for successful deletion
-	policy := metav1.DeletePropagationForeground
-	if err := dc.Resource(gvr).Namespace(notebookNamespace).Delete(
-		delCtx,
-		notebookName,
-		metav1.DeleteOptions{PropagationPolicy: &policy},
-	); err != nil {
-		return NewNotebookPodName, fmt.Errorf("delete old notebook %q: %w", notebookName, err)
+	if err := deleteOld(ctx, backend, notebookNamespace, notebookName, timeouts); err != nil {
+		return NewNotebookPodName, err
 	}
-	fmt.Printf("Requested deletion of old notebook %s/%s (background propagation)\n", notebookNamespace, notebookName)
 
 	return NewNotebookPodName, nil
 }
 
-func buildConfig() (*rest.Config, error) {
+// keepOld stops the clone dstName after cause made the migration keep src.
+// A later migration of the family adopts and starts the clone again.
+func keepOld(ctx context.Context, backend workload.Backend, src *workload.Workload, dstName string, cause error) error {
+	reportProgress(ctx, "stopping notebook %s, keeping %s", dstName, src.Name)
+	// The migration's context may be done already
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+	if err := backend.Stop(ctx, src.Namespace, dstName); err != nil {
+		return fmt.Errorf("%w, old notebook %q kept; stopping notebook %q failed too: %v", cause, src.Name, dstName, err)
+	}
+	return fmt.Errorf("%w, old notebook %q kept and notebook %q stopped", cause, src.Name, dstName)
+}
+
+// finishMigrating removes MigratingAnnotation from notebook name once its
+// migration is over, also when the migration's context is done.
+func finishMigrating(ctx context.Context, backend workload.Backend, namespace, name string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	_, err := backend.Patch(ctx, namespace, name, func(w *workload.Workload) error {
+		setAnnotation(w, MigratingAnnotation, "")
+		return nil
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		fmt.Printf("Could not clear the migration marker of %s/%s: %v\n", namespace, name, err)
+	}
+}
+
+// MigratingSince returns when the migration to w started, if one is in
+// progress or was interrupted.
+func MigratingSince(w *workload.Workload) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, w.GetAnnotations()[MigratingAnnotation])
+	return t, err == nil
+}
+
+// loadConfigWithin is LoadConfig bounded by d and retried on transient
+// errors; the namespace configuration sets the timeouts of the rest of the
+// migration.
+func loadConfigWithin(ctx context.Context, cs kubernetes.Interface, ns string, d time.Duration) (*Config, error) {
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	var nsCfg *Config
+	err := retry.Do(ctx, retry.DefaultBackoff, func() (err error) {
+		nsCfg, err = LoadConfig(ctx, cs, ns)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load switcher config: %w", err)
+	}
+	return nsCfg, nil
+}
+
+// BuildConfig returns the in-cluster (or kubeconfig) REST config with a
+// traced transport.
+func BuildConfig() (*rest.Config, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	// Every API request becomes a child span of the calling step
+	cfg.Wrap(tracing.WrapTransport)
+	return cfg, nil
+}
+
+// DiscoverNotebookVersion selects the Notebook API version served by the
+// cluster (see notebook.UseServedVersion); call it once at startup.
+func DiscoverNotebookVersion() (string, error) {
+	cfg, err := BuildConfig()
+	if err != nil {
+		return "", fmt.Errorf("build kube config: %w", err)
+	}
+	return notebook.UseServedVersion(cfg)
+}
+
+func loadConfig() (*rest.Config, error) {
 	// Prefer in-cluster when running inside a Pod
 	if cfg, err := rest.InClusterConfig(); err == nil {
 		return cfg, nil
@@ -225,199 +412,105 @@ func buildConfig() (*rest.Config, error) {
 	return clientcmd.BuildConfigFromFlags("", filepath.Join(home, ".kube", "config"))
 }
 
-func loadGPUResourceKey(ctx context.Context, cs kubernetes.Interface, ns string) (string, string, error) {
-	const (
-		cmName  = "gpu-switcher-config"
-		cmKey01 = "gpuResourceKey"
-		cmKey02 = "numGpuResource"
-	)
-	cm, err := cs.CoreV1().ConfigMaps(ns).Get(ctx, cmName, metav1.GetOptions{})
-	if err != nil {
-		return "", "", err
-	}
-	return cm.Data[cmKey01], cm.Data[cmKey02], nil
-}
-
-func cleanupMetadata(obj *unstructured.Unstructured, newName string) error {
-	obj.SetName(newName)
-	obj.SetResourceVersion("")
-	obj.SetUID("")
-	obj.SetGeneration(0)
-	obj.SetManagedFields(nil)
-
-	// scrub nested metadata
-	metaAny, ok := obj.Object["metadata"]
-	if !ok {
-		return nil
-	}
-	meta, ok := metaAny.(map[string]any)
-	if !ok {
-		return nil
-	}
-	delete(meta, "resourceVersion")
-	delete(meta, "uid")
-	delete(meta, "generation")
-	delete(meta, "creationTimestamp")
-	delete(meta, "managedFields")
-	delete(meta, "ownerReferences")
-
-	// align label app if present
-	if labelsAny, ok := meta["labels"]; ok {
-		if labels, ok := labelsAny.(map[string]any); ok {
-			if _, has := labels["app"]; has {
-				labels["app"] = newName
+// HasGPUResources reports whether any container of the workload requests or limits one of gpuKeys.
+func HasGPUResources(w *workload.Workload, gpuKeys ...string) bool {
+	for _, c := range w.PodSpec().Containers {
+		for _, gpuKey := range gpuKeys {
+			name := corev1.ResourceName(gpuKey)
+			if _, ok := c.Resources.Limits[name]; ok {
+				return true
+			}
+			if _, ok := c.Resources.Requests[name]; ok {
+				return true
 			}
 		}
 	}
-	return nil
+	return false
 }
 
-func removeStatus(obj *unstructured.Unstructured) {
-	delete(obj.Object, "status")
-}
+// checkPolicy enforces the namespace policy for moving notebookName to profile.
+func checkPolicy(ctx context.Context, backend workload.Backend, nsCfg *Config, profile, notebookName string) (err error) {
+	ctx, span := tracer.Start(ctx, "check namespace policy")
+	defer func() { tracing.End(span, err) }()
 
-func ensureGPUResourcesWithKey(obj *unstructured.Unstructured, gpuKey string, gpuCount int) error {
-	containers, found, err := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
-	if err != nil || !found || len(containers) == 0 {
-		return fmt.Errorf("containers not found in Notebook spec: %v", err)
+	pol := nsCfg.Policy
+	if err := pol.CheckProfile(nsCfg.Namespace, profile); err != nil {
+		return err
 	}
-	gpuStr := strconv.Itoa(gpuCount)
-
-	for i := range containers {
-		c, ok := containers[i].(map[string]any)
-		if !ok {
-			return fmt.Errorf("container[%d] has unexpected type", i)
-		}
-		resources, _ := c["resources"].(map[string]any)
-		if resources == nil {
-			resources = map[string]any{}
-		}
-		limits, _ := resources["limits"].(map[string]any)
-		if limits == nil {
-			limits = map[string]any{}
-		}
-		requests, _ := resources["requests"].(map[string]any)
-		if requests == nil {
-			requests = map[string]any{}
-		}
-
-		limits[gpuKey] = gpuStr
-		requests[gpuKey] = gpuStr
-
-		resources["limits"] = limits
-		resources["requests"] = requests
-		c["resources"] = resources
-		containers[i] = c
+	if pol.MaxGPUNotebooks == 0 {
+		return nil
 	}
-	return unstructured.SetNestedSlice(obj.Object, containers, "spec", "template", "spec", "containers")
-}
-
-// Remove GPU resources which has key = gpuKey from every conatiner in Notebook (unstructured).
-func removeGPUResourcesWithKey(obj *unstructured.Unstructured, gpuKey string) error {
-	containers, found, err := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
-	if err != nil || !found || len(containers) == 0 {
-		return fmt.Errorf("containers not found in Notebook spec: %v", err)
+	list, err := backend.List(ctx, nsCfg.Namespace)
+	if err != nil {
+		return fmt.Errorf("list notebooks: %w", err)
 	}
-
-	for i := range containers {
-		c, ok := containers[i].(map[string]any)
-		if !ok {
-			return fmt.Errorf("container[%d] has unexpected type", i)
-		}
-
-		resources, _ := c["resources"].(map[string]any)
-		if resources == nil {
-			// không có resources => không cần xoá
+	running := 0
+	keys := nsCfg.ResourceKeys()
+	for _, nb := range list {
+		if nb.GetName() == notebookName || nb.Stopped || nb.GetDeletionTimestamp() != nil {
 			continue
 		}
-
-		// Xoá trong limits
-		if limits, _ := resources["limits"].(map[string]any); limits != nil {
-			delete(limits, gpuKey)
-			if len(limits) == 0 {
-				delete(resources, "limits")
-			} else {
-				resources["limits"] = limits
-			}
+		if HasGPUResources(nb, keys...) {
+			running++
 		}
-
-		// Xoá trong requests
-		if requests, _ := resources["requests"].(map[string]any); requests != nil {
-			delete(requests, gpuKey)
-			if len(requests) == 0 {
-				delete(resources, "requests")
-			} else {
-				resources["requests"] = requests
-			}
-		}
-
-		// Nếu resources trống thì bỏ hẳn
-		if len(resources) == 0 {
-			delete(c, "resources")
-		} else {
-			c["resources"] = resources
-		}
-
-		containers[i] = c
 	}
-
-	return unstructured.SetNestedSlice(obj.Object, containers, "spec", "template", "spec", "containers")
+	return pol.CheckConcurrency(nsCfg.Namespace, running)
 }
 
-func ensureRuntimeClassName(obj *unstructured.Unstructured, className string) error {
-	// Prefer controller-style: spec.template.spec
-	if _, found, _ := unstructured.NestedMap(obj.Object, "spec", "template", "spec"); found {
-		return unstructured.SetNestedField(
-			obj.Object,
-			className,
-			"spec", "template", "spec", "runtimeClassName",
-		)
+// setAnnotation sets (or with an empty value removes) a metadata annotation.
+func setAnnotation(obj metav1.Object, key, value string) {
+	ann := obj.GetAnnotations()
+	if ann == nil {
+		ann = map[string]string{}
 	}
-
-	// Fallback to Pod-style: spec
-	if _, found, _ := unstructured.NestedSlice(obj.Object, "spec", "containers"); found {
-		return unstructured.SetNestedField(
-			obj.Object,
-			className,
-			"spec", "runtimeClassName",
-		)
+	if value == "" {
+		delete(ann, key)
+	} else {
+		ann[key] = value
 	}
-
-	return fmt.Errorf("could not locate Pod spec: neither spec.template.spec nor spec.containers present")
+	obj.SetAnnotations(ann)
 }
 
-func setNameCPU(s string) string {
-	i := strings.LastIndex(s, "-")
-	if i <= 0 { // if the name does not have '-' or the 1st character is '-'
-		s = s + "-cpu"
-		return s
+// ensureGPUResourcesWithKey sets limits and requests of gpuKey on container i.
+func ensureGPUResourcesWithKey(w *workload.Workload, i int, gpuKey string, gpuCount int) {
+	qty := *resource.NewQuantity(int64(gpuCount), resource.DecimalSI)
+	res := &w.PodSpec().Containers[i].Resources
+	if res.Limits == nil {
+		res.Limits = corev1.ResourceList{}
 	}
-	if s[i+1:] != "gpu" {
-		s = s + "-cpu"
-		return s
+	if res.Requests == nil {
+		res.Requests = corev1.ResourceList{}
 	}
-	if s[i+1:] == "gpu" {
-		s = s[:i]
-		s = s[:i] + "-cpu"
-		return s
-	}
-	return s
+	res.Limits[corev1.ResourceName(gpuKey)] = qty
+	res.Requests[corev1.ResourceName(gpuKey)] = qty
 }
 
-func setNameGPU(s string) string {
-	i := strings.LastIndex(s, "-")
-	if i <= 0 { // if the name does not have '-' or the 1st character is '-'
-		s = s + "-gpu"
-		return s
+// clearRuntimeClass removes the runtime class of w if a GPU profile set it.
+func clearRuntimeClass(w *workload.Workload, nsCfg *Config) {
+	spec := w.PodSpec()
+	if spec.RuntimeClassName == nil {
+		return
 	}
-	if s[i+1:] != "cpu" {
-		s = s + "-gpu"
-		return s
+	for _, p := range nsCfg.Profiles {
+		if p.RuntimeClassName != "" && p.RuntimeClassName == *spec.RuntimeClassName {
+			spec.RuntimeClassName = nil
+			return
+		}
 	}
-	if s[i+1:] == "cpu" {
-		s = s[:i]
-		s = s[:i] + "-gpu"
-		return s
+}
+
+// Remove GPU resources which has key = gpuKey from every conatiner in Notebook.
+func removeGPUResourcesWithKey(w *workload.Workload, gpuKey string) {
+	containers := w.PodSpec().Containers
+	for i := range containers {
+		res := &containers[i].Resources
+		delete(res.Limits, corev1.ResourceName(gpuKey))
+		delete(res.Requests, corev1.ResourceName(gpuKey))
+		if len(res.Limits) == 0 {
+			res.Limits = nil
+		}
+		if len(res.Requests) == 0 {
+			res.Requests = nil
+		}
 	}
-	return s
 }
@@ -0,0 +1,81 @@
+package switcher
+
+import (
+	"backend-handler/workload"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// maxRenames bounds the attempts to find a free name for a clone.
+const maxRenames = 5
+
+// createTarget creates the clone of src named name with mutate applied and
+// returns the name the clone got. A notebook of that name may already exist,
+// e.g. left over by a failed switch:
+//   - if it belongs to the family of src, it is adopted: reset to the clone
+//     of src, mutated and started
+//   - otherwise (another notebook, src itself when switching profiles, or a
+//     notebook being deleted) the clone is created under a name with a random
+//     suffix
+//
+// The clone is marked with MigratingAnnotation until the migration is over.
+// The path taken is reported as progress.
+func createTarget(ctx context.Context, backend workload.Backend, src *workload.Workload, name, canonical, mode string, mutate workload.Mutation) (string, error) {
+	mutate = markMigrating(mutate)
+	existing, err := backend.Get(ctx, src.Namespace, name)
+	switch {
+	case apierrors.IsNotFound(err):
+		_, err = backend.Clone(ctx, src, name, mutate)
+		return name, err
+	case err != nil:
+		return name, fmt.Errorf("check target %q: %w", name, err)
+	}
+
+	srcFamily, _ := Family(src)
+	if family, _ := Family(existing); family == srcFamily && existing.Name != src.Name && existing.DeletionTimestamp == nil {
+		reportProgress(ctx, "adopting existing notebook %s of the same family", name)
+		fmt.Printf("Target %s/%s exists in the family of %s, adopting it\n", src.Namespace, name, src.Name)
+		if _, err := backend.Patch(ctx, src.Namespace, name, workload.Reset(src), mutate); err != nil {
+			return name, fmt.Errorf("adopt notebook %q: %w", name, err)
+		}
+		if existing.Stopped {
+			if err := backend.Start(ctx, src.Namespace, name); err != nil {
+				return name, fmt.Errorf("start adopted notebook %q: %w", name, err)
+			}
+		}
+		return name, nil
+	}
+
+	for range maxRenames {
+		// rand.Text is upper case base32, names are DNS-1123 labels
+		alt := cloneName(canonical, strings.ToLower(rand.Text()[:5])+"-"+mode)
+		_, err := backend.Get(ctx, src.Namespace, alt)
+		if apierrors.IsNotFound(err) {
+			reportProgress(ctx, "name %s is taken, creating notebook %s instead", name, alt)
+			fmt.Printf("Target %s/%s is taken, creating %s instead\n", src.Namespace, name, alt)
+			_, err = backend.Clone(ctx, src, alt, mutate)
+			return alt, err
+		}
+		if err != nil {
+			return name, fmt.Errorf("check target %q: %w", alt, err)
+		}
+	}
+	return name, fmt.Errorf("no free name for the clone of %q after %d attempts", src.Name, maxRenames)
+}
+
+// markMigrating returns mutate that also sets MigratingAnnotation.
+func markMigrating(mutate workload.Mutation) workload.Mutation {
+	since := time.Now().UTC().Format(time.RFC3339)
+	return func(w *workload.Workload) error {
+		if err := mutate(w); err != nil {
+			return err
+		}
+		setAnnotation(w, MigratingAnnotation, since)
+		return nil
+	}
+}
@@ -0,0 +1,157 @@
+package switcher
+
+import (
+	"backend-handler/api"
+	"backend-handler/workload"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// fakeBackend keeps workloads of one namespace in memory. Only the methods
+// createTarget uses are implemented.
+type fakeBackend struct {
+	workload.Backend
+	workloads map[string]*workload.Workload
+	ready     map[string]bool
+}
+
+func (b *fakeBackend) Get(_ context.Context, _, name string) (*workload.Workload, error) {
+	w, ok := b.workloads[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "notebooks"}, name)
+	}
+	return w.DeepCopy(), nil
+}
+
+func (b *fakeBackend) Clone(_ context.Context, src *workload.Workload, name string, mutations ...workload.Mutation) (*workload.Workload, error) {
+	w := src.DeepCopy()
+	w.Name, w.UID = name, ""
+	for _, m := range mutations {
+		if err := m(w); err != nil {
+			return nil, err
+		}
+	}
+	b.workloads[name] = w
+	return w, nil
+}
+
+func (b *fakeBackend) Patch(_ context.Context, _, name string, mutations ...workload.Mutation) (*workload.Workload, error) {
+	w, ok := b.workloads[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "notebooks"}, name)
+	}
+	for _, m := range mutations {
+		if err := m(w); err != nil {
+			return nil, err
+		}
+	}
+	return w.DeepCopy(), nil
+}
+
+func (b *fakeBackend) Start(_ context.Context, _, name string) error {
+	b.workloads[name].Stopped = false
+	return nil
+}
+
+// Pod returns a ready pod for the workloads listed in ready, a pending one
+// for the other running workloads.
+func (b *fakeBackend) Pod(_ context.Context, _, name string) (*corev1.Pod, error) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name + "-0"}, Status: corev1.PodStatus{Phase: corev1.PodPending}}
+	if b.ready[name] {
+		pod.Status.Phase = corev1.PodRunning
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	}
+	return pod, nil
+}
+
+func newWorkload(name, uid string) *workload.Workload {
+	return &workload.Workload{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team", UID: types.UID(uid)},
+		Template:   corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: name}}}},
+	}
+}
+
+func TestCreateTargetNames(t *testing.T) {
+	ctx := context.Background()
+	noop := func(*workload.Workload) error { return nil }
+
+	tests := []struct {
+		name      string
+		canonical string
+		taken     string // by "other" notebook, a stopped member of the "family" of src, or one being "deleted"
+		wantAlt   bool
+	}{
+		{name: "free name", canonical: "Foo"},
+		{name: "taken by another notebook", canonical: "Foo", taken: "other", wantAlt: true},
+		{name: "long name taken", canonical: strings.Repeat("long-notebook-name-", 4), taken: "other", wantAlt: true},
+		{name: "taken by the family", canonical: "Foo", taken: "family"},
+		{name: "taken by the family, being deleted", canonical: "Foo", taken: "deleted", wantAlt: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := newWorkload(tt.canonical, "uid-src")
+			target := cloneName(tt.canonical, api.ModeGPU)
+			b := &fakeBackend{workloads: map[string]*workload.Workload{src.Name: src}}
+			if tt.taken != "" {
+				existing := newWorkload(target, "uid-other")
+				if tt.taken != "other" {
+					setFamily(existing, src)
+					existing.Stopped = true
+				}
+				if tt.taken == "deleted" {
+					existing.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+				}
+				b.workloads[target] = existing
+			}
+
+			for range 20 {
+				got, err := createTarget(ctx, b, src, target, tt.canonical, api.ModeGPU, noop)
+				if err != nil {
+					t.Fatalf("createTarget: %v", err)
+				}
+				if errs := validation.IsDNS1123Label(got); len(errs) > 0 {
+					t.Fatalf("createTarget returned %q: %s", got, strings.Join(errs, ", "))
+				}
+				if len(got) > maxNameLength {
+					t.Errorf("createTarget returned %q, longer than %d", got, maxNameLength)
+				}
+				if (got != target) != tt.wantAlt {
+					t.Fatalf("createTarget returned %q for target %q, want another name: %v", got, target, tt.wantAlt)
+				}
+				if !strings.HasSuffix(got, "-"+api.ModeGPU) {
+					t.Errorf("createTarget returned %q without mode suffix", got)
+				}
+				if _, ok := MigratingSince(b.workloads[got]); !ok {
+					t.Errorf("clone %q has no %s", got, MigratingAnnotation)
+				}
+				if tt.taken == "family" && b.workloads[got].Stopped {
+					t.Errorf("adopted notebook %q not started", got)
+				}
+				if !tt.wantAlt {
+					break
+				}
+				delete(b.workloads, got)
+			}
+		})
+	}
+}
+
+func TestCloneName(t *testing.T) {
+	for _, canonical := range []string{"foo", "Foo_Bar.baz", "-x-", "", strings.Repeat("a", 80), strings.Repeat("ab-", 30)} {
+		for _, mode := range []string{api.ModeGPU, api.ModeCPU, "k3x7q-" + api.ModeGPU} {
+			name := cloneName(canonical, mode)
+			if errs := validation.IsDNS1123Label(name); len(errs) > 0 || len(name) > maxNameLength {
+				t.Errorf("cloneName(%q, %q) = %q: %v", canonical, mode, name, errs)
+			}
+		}
+	}
+}
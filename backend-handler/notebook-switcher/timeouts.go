@@ -0,0 +1,124 @@
+package switcher
+
+import (
+	"backend-handler/api"
+	"backend-handler/tracing"
+	"backend-handler/workload"
+	"context"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Timeouts of migrations unless the namespace or the profile sets them; the
+// backend's flags override these defaults at startup.
+var (
+	DefaultGPUTimeouts = Timeouts{API: time.Minute, PodReady: 5 * time.Minute, Drain: 15 * time.Second, Delete: 30 * time.Second, Transfer: 10 * time.Minute}
+	DefaultCPUTimeouts = Timeouts{API: time.Minute, PodReady: 5 * time.Minute, Delete: 30 * time.Second, Transfer: 10 * time.Minute}
+)
+
+// Timeouts are the resolved api.Timeouts of one migration.
+type Timeouts struct {
+	API, PodReady, Drain, Delete, Transfer time.Duration
+	// AwaitDeletion waits until the old notebook is gone, see awaitDeletion.
+	AwaitDeletion bool
+}
+
+// with returns t overridden by the fields o sets.
+func (t Timeouts) with(o *api.Timeouts) Timeouts {
+	if o == nil {
+		return t
+	}
+	set := func(dst *time.Duration, d *api.Duration) {
+		if d != nil {
+			*dst = d.Duration
+		}
+	}
+	set(&t.API, o.API)
+	set(&t.PodReady, o.PodReady)
+	set(&t.Drain, o.Drain)
+	set(&t.Delete, o.Delete)
+	set(&t.Transfer, o.Transfer)
+	if o.AwaitDeletion != nil {
+		t.AwaitDeletion = *o.AwaitDeletion
+	}
+	return t
+}
+
+// gpuTimeouts returns the timeouts of a migration to profile p.
+func (c *Config) gpuTimeouts(p Profile) Timeouts {
+	return DefaultGPUTimeouts.with(c.Timeouts).with(p.Timeouts)
+}
+
+// cpuTimeouts returns the timeouts of a migration to CPU.
+func (c *Config) cpuTimeouts() Timeouts {
+	return DefaultCPUTimeouts.with(c.Timeouts)
+}
+
+// validateTimeouts rejects zero bounds; only the drain delay may be zero.
+func validateTimeouts(t *api.Timeouts) error {
+	if t == nil {
+		return nil
+	}
+	switch zero := func(d *api.Duration) bool { return d != nil && d.Duration == 0 }; {
+	case zero(t.API):
+		return fmt.Errorf("api: must be positive")
+	case zero(t.PodReady):
+		return fmt.Errorf("podReady: must be positive")
+	case zero(t.Delete):
+		return fmt.Errorf("delete: must be positive")
+	case zero(t.Transfer):
+		return fmt.Errorf("transfer: must be positive")
+	}
+	return nil
+}
+
+// drain waits d before the old notebook is touched, or until ctx is done.
+func drain(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	reportProgress(ctx, "waiting %v before deleting the old notebook", d)
+	_, span := tracer.Start(ctx, "drain delay")
+	defer span.End()
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+	return ctx.Err()
+}
+
+// deleteOld deletes the old notebook name within t.Delete. The deletion
+// propagates to the pod in the foreground; with t.AwaitDeletion it returns
+// only once the notebook, and with it its pod, is gone.
+func deleteOld(ctx context.Context, backend workload.Backend, namespace, name string, t Timeouts) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, t.Delete)
+	defer cancel()
+
+	reportProgress(ctx, "deleting old notebook %s", name)
+	ctx, span := tracer.Start(ctx, "delete old notebook")
+	defer func() { tracing.End(span, err) }()
+	if err := backend.Delete(ctx, namespace, name); err != nil {
+		return fmt.Errorf("delete old notebook %q: %w", name, err)
+	}
+	fmt.Printf("Requested deletion of old notebook %s/%s (foreground propagation)\n", namespace, name)
+	if !t.AwaitDeletion {
+		return nil
+	}
+
+	reportProgress(ctx, "waiting for old notebook %s to be deleted", name)
+	err = wait.PollUntilContextCancel(ctx, time.Second, true, func(ctx context.Context) (bool, error) {
+		_, err := backend.Get(ctx, namespace, name)
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		return fmt.Errorf("old notebook %q not deleted within %v: %w", name, t.Delete, err)
+	}
+	fmt.Printf("Old notebook %s/%s is deleted\n", namespace, name)
+	return nil
+}
@@ -0,0 +1,140 @@
+package switcher
+
+import (
+	nbpods "backend-handler/get-nbpods-name"
+	"backend-handler/tracing"
+	"backend-handler/workload"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// listScript prints "<size> <absolute path>" for every file and symlink under
+// its arguments; "~/" and relative paths are resolved against $HOME.
+const listScript = `cd "$HOME" 2>/dev/null
+for p in "$@"; do
+	case "$p" in
+	"~/"*) p="$HOME/${p#"~/"}" ;;
+	/*) ;;
+	*) p="$HOME/$p" ;;
+	esac
+	[ -e "$p" ] || continue
+	find "$p" -xdev \( -type f -o -type l \) -exec stat -c '%s %n' {} + 2>/dev/null
+done
+exit 0`
+
+// TransferResult sums up a transfer.
+type TransferResult struct {
+	Files int
+	Bytes int64 // tar stream size
+	// Skipped lists the files over the size limits.
+	Skipped []string
+}
+
+// transfer copies the namespace's transfer paths from the pod of src, the
+// old notebook, to newPod within timeout: files are listed and filtered by
+// the size limits in the old pod, then streamed as a tar archive into the
+// new one.
+func transfer(ctx context.Context, cfg *rest.Config, cs kubernetes.Interface, backend workload.Backend, nsCfg *Config, src *workload.Workload, newPod string, timeout time.Duration) (res TransferResult, err error) {
+	t := nsCfg.Transfer
+	if t == nil {
+		return res, nil
+	}
+	ctx, span := tracer.Start(ctx, "transfer files", trace.WithAttributes(
+		attribute.String("notebook.name", src.Name),
+		attribute.StringSlice("transfer.paths", t.Paths),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Int("transfer.files", res.Files), attribute.Int64("transfer.bytes", res.Bytes))
+		tracing.End(span, err)
+	}()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	pod, err := backend.Pod(ctx, src.Namespace, src.Name)
+	if err != nil {
+		return res, fmt.Errorf("get pod of %s: %w", src.Name, err)
+	}
+	if pod == nil {
+		fmt.Printf("Notebook %s/%s has no pod, nothing to transfer\n", src.Namespace, src.Name)
+		return res, nil
+	}
+	idx, err := mainContainer(src, nsCfg.NotebookContainer, src.Name)
+	if err != nil {
+		return res, err
+	}
+	container := src.PodSpec().Containers[idx].Name
+
+	var listing bytes.Buffer
+	cmd := append([]string{"sh", "-c", listScript, "sh"}, t.Paths...)
+	if err := nbpods.Exec(ctx, cfg, cs, src.Namespace, pod.Name, container, cmd, nil, &listing, nil); err != nil {
+		return res, fmt.Errorf("list transfer paths: %w", err)
+	}
+	var files []string
+	var total int64
+	sc := bufio.NewScanner(&listing)
+	for sc.Scan() {
+		sizeStr, name, ok := strings.Cut(sc.Text(), " ")
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if !ok || err != nil || !strings.HasPrefix(name, "/") {
+			continue
+		}
+		if size > t.MaxFileBytes || total+size > t.MaxBytes {
+			res.Skipped = append(res.Skipped, name)
+			continue
+		}
+		total += size
+		// tar -C / takes the names relative to the root
+		files = append(files, strings.TrimPrefix(name, "/"))
+	}
+	if err := sc.Err(); err != nil {
+		return res, fmt.Errorf("list transfer paths: %w", err)
+	}
+	if len(files) == 0 {
+		return res, nil
+	}
+
+	// old pod: tar cf - | new pod: tar xf -
+	pr, pw := io.Pipe()
+	list := strings.NewReader(strings.Join(files, "\n") + "\n")
+	sendErr := make(chan error, 1)
+	go func() {
+		err := nbpods.Exec(ctx, cfg, cs, src.Namespace, pod.Name, container, []string{"tar", "cf", "-", "-C", "/", "-T", "-"}, list, pw, nil)
+		pw.CloseWithError(err)
+		sendErr <- err
+	}()
+	in := &countingReader{r: pr}
+	err = nbpods.Exec(ctx, cfg, cs, src.Namespace, newPod, container, []string{"tar", "xf", "-", "-C", "/"}, in, nil, nil)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if sErr := <-sendErr; sErr != nil && err == nil {
+		err = sErr
+	}
+	res.Bytes = in.n.Load()
+	if err != nil {
+		return res, fmt.Errorf("copy files to %s: %w", newPod, err)
+	}
+	res.Files = len(files)
+	return res, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,159 @@
+package switcher
+
+import (
+	"backend-handler/tracing"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Environment of the backend locating the Jupyter servers of notebooks; the
+// idle reclaimer reads the same variables.
+const (
+	EnvJupyterURL   = "JUPYTER_URL_TEMPLATE"
+	EnvJupyterToken = "JUPYTER_TOKEN"
+)
+
+// DefaultJupyterURLTemplate reaches a Kubeflow notebook through the Service the
+// notebook controller creates (port 80 -> 8888) under its NB_PREFIX base URL.
+const DefaultJupyterURLTemplate = "http://{name}.{namespace}.svc.cluster.local/notebook/{namespace}/{name}"
+
+// jupyterServer is the REST API of the Jupyter server of one notebook.
+type jupyterServer struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+func newJupyterServer(namespace, name string) (*jupyterServer, error) {
+	tmpl := os.Getenv(EnvJupyterURL)
+	if tmpl == "" {
+		tmpl = DefaultJupyterURLTemplate
+	}
+	// The XSRF cookie is needed for PUT on servers without token auth
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	r := strings.NewReplacer("{name}", name, "{namespace}", namespace)
+	return &jupyterServer{
+		base:   strings.TrimRight(r.Replace(tmpl), "/"),
+		token:  os.Getenv(EnvJupyterToken),
+		client: &http.Client{Timeout: 30 * time.Second, Jar: jar, Transport: tracing.WrapTransport(http.DefaultTransport)},
+	}, nil
+}
+
+// workspaces is the answer of GET /lab/api/workspaces.
+type workspaces struct {
+	Workspaces struct {
+		Values []json.RawMessage `json:"values"`
+	} `json:"workspaces"`
+}
+
+// carryWorkspaces copies the JupyterLab workspaces (open documents, terminals
+// and panel layout) of notebook oldName to newName, whose server must be up.
+// It returns the number of workspaces copied.
+func carryWorkspaces(ctx context.Context, namespace, oldName, newName string) (n int, err error) {
+	ctx, span := tracer.Start(ctx, "carry workspaces", trace.WithAttributes(
+		attribute.String("notebook.name", oldName),
+		attribute.String("notebook.new_name", newName),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	oldSrv, err := newJupyterServer(namespace, oldName)
+	if err != nil {
+		return 0, err
+	}
+	newSrv, err := newJupyterServer(namespace, newName)
+	if err != nil {
+		return 0, err
+	}
+
+	var ws workspaces
+	if err := oldSrv.do(ctx, http.MethodGet, "/lab/api/workspaces", nil, &ws); err != nil {
+		return 0, err
+	}
+	if len(ws.Workspaces.Values) == 0 {
+		return 0, nil
+	}
+
+	// The new server may still be starting although its pod is Ready.
+	err = wait.PollUntilContextTimeout(ctx, 2*time.Second, time.Minute, true, func(ctx context.Context) (bool, error) {
+		return newSrv.xsrf(ctx) == nil, nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("jupyter server of %s not reachable: %w", newName, err)
+	}
+	for _, raw := range ws.Workspaces.Values {
+		var meta struct {
+			Metadata struct {
+				ID string `json:"id"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(raw, &meta); err != nil || meta.Metadata.ID == "" {
+			continue
+		}
+		if err := newSrv.do(ctx, http.MethodPut, "/lab/api/workspaces/"+url.PathEscape(meta.Metadata.ID), raw, nil); err != nil {
+			return n, fmt.Errorf("workspace %q: %w", meta.Metadata.ID, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// xsrf loads a page of the server, which sets the _xsrf cookie.
+func (j *jupyterServer) xsrf(ctx context.Context) error {
+	return j.do(ctx, http.MethodGet, "/lab", nil, nil)
+}
+
+func (j *jupyterServer) do(ctx context.Context, method, path string, in json.RawMessage, out any) error {
+	u := j.base + path
+	var body io.Reader
+	if in != nil {
+		body = bytes.NewReader(in)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if j.token != "" {
+		req.Header.Set("Authorization", "token "+j.token)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if method != http.MethodGet {
+		for _, c := range j.client.Jar.Cookies(req.URL) {
+			if c.Name == "_xsrf" {
+				req.Header.Set("X-XSRFToken", c.Value)
+			}
+		}
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: unexpected status %s", method, u, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode %s: %w", u, err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package notebook
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+)
+
+// Client reads and writes typed Notebooks through the dynamic client.
+type Client struct {
+	dc dynamic.Interface
+}
+
+// NewClient returns a Client using dc.
+func NewClient(dc dynamic.Interface) *Client {
+	return &Client{dc: dc}
+}
+
+// Get returns Notebook name in namespace.
+func (c *Client) Get(ctx context.Context, namespace, name string) (*Notebook, error) {
+	u, err := c.dc.Resource(GVR()).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return FromUnstructured(u)
+}
+
+// List returns the Notebooks of namespace ("" lists all namespaces).
+func (c *Client) List(ctx context.Context, namespace string) ([]*Notebook, error) {
+	list, err := c.dc.Resource(GVR()).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Notebook, 0, len(list.Items))
+	for i := range list.Items {
+		nb, err := FromUnstructured(&list.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, nb)
+	}
+	return out, nil
+}
+
+// Create creates nb and returns the stored object.
+func (c *Client) Create(ctx context.Context, nb *Notebook) (*Notebook, error) {
+	u, err := nb.ToUnstructured()
+	if err != nil {
+		return nil, err
+	}
+	created, err := c.dc.Resource(GVR()).Namespace(nb.Namespace).Create(ctx, u, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return FromUnstructured(created)
+}
+
+// Delete deletes Notebook name in namespace.
+func (c *Client) Delete(ctx context.Context, namespace, name string, opts metav1.DeleteOptions) error {
+	return c.dc.Resource(GVR()).Namespace(namespace).Delete(ctx, name, opts)
+}
+
+// Update writes nb back; nb must carry the resourceVersion it was read with.
+func (c *Client) Update(ctx context.Context, nb *Notebook) (*Notebook, error) {
+	u, err := nb.ToUnstructured()
+	if err != nil {
+		return nil, err
+	}
+	updated, err := c.dc.Resource(GVR()).Namespace(nb.Namespace).Update(ctx, u, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return FromUnstructured(updated)
+}
@@ -0,0 +1,96 @@
+// Package notebook models the Kubeflow Notebook custom resource with typed
+// structs. Objects are converted from and to unstructured only when they are
+// read from or written to the API server (see Client).
+package notebook
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Kind is the kind of the Notebook custom resource.
+const Kind = "Notebook"
+
+// Notebook is a Kubeflow Notebook. The layout is the same in v1, v1beta1 and v1alpha1.
+type Notebook struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   Spec    `json:"spec,omitempty"`
+	Status *Status `json:"status,omitempty"`
+}
+
+// Spec is the desired state of a Notebook: the template of its StatefulSet pod.
+type Spec struct {
+	Template corev1.PodTemplateSpec `json:"template,omitempty"`
+}
+
+// Status is the observed state of a Notebook, as reported by the controller.
+type Status struct {
+	Conditions     []Condition           `json:"conditions,omitempty"`
+	ReadyReplicas  int32                 `json:"readyReplicas,omitempty"`
+	ContainerState corev1.ContainerState `json:"containerState,omitempty"`
+}
+
+// Condition mirrors a condition of the notebook pod.
+type Condition struct {
+	Type          string      `json:"type"`
+	Status        string      `json:"status,omitempty"`
+	LastProbeTime metav1.Time `json:"lastProbeTime,omitempty"`
+	Reason        string      `json:"reason,omitempty"`
+	Message       string      `json:"message,omitempty"`
+}
+
+// PodSpec returns the pod spec of the Notebook template for in-place changes.
+func (nb *Notebook) PodSpec() *corev1.PodSpec {
+	return &nb.Spec.Template.Spec
+}
+
+// DeepCopy returns an independent copy of nb.
+func (nb *Notebook) DeepCopy() *Notebook {
+	out := &Notebook{TypeMeta: nb.TypeMeta}
+	nb.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	nb.Spec.Template.DeepCopyInto(&out.Spec.Template)
+	if nb.Status != nil {
+		st := *nb.Status
+		st.Conditions = append([]Condition(nil), nb.Status.Conditions...)
+		nb.Status.ContainerState.DeepCopyInto(&st.ContainerState)
+		out.Status = &st
+	}
+	return out
+}
+
+// FromUnstructured converts an object read through the dynamic client.
+func FromUnstructured(u *unstructured.Unstructured) (*Notebook, error) {
+	nb := &Notebook{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, nb); err != nil {
+		return nil, fmt.Errorf("decode notebook %s/%s: %w", u.GetNamespace(), u.GetName(), err)
+	}
+	return nb, nil
+}
+
+// ToUnstructured converts nb for the dynamic client, stamped with apiVersion
+// and kind of the served version.
+func (nb *Notebook) ToUnstructured() (*unstructured.Unstructured, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(nb)
+	if err != nil {
+		return nil, fmt.Errorf("encode notebook %s/%s: %w", nb.Namespace, nb.Name, err)
+	}
+	u := &unstructured.Unstructured{Object: obj}
+	u.SetAPIVersion(GVR().GroupVersion().String())
+	u.SetKind(Kind)
+	// Zero timestamps are encoded as null, which structural schemas reject.
+	for _, path := range [][]string{
+		{"metadata", "creationTimestamp"},
+		{"spec", "template", "metadata", "creationTimestamp"},
+	} {
+		if v, found, _ := unstructured.NestedFieldNoCopy(obj, path...); found && v == nil {
+			unstructured.RemoveNestedField(obj, path...)
+		}
+	}
+	return u, nil
+}
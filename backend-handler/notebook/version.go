@@ -0,0 +1,85 @@
+package notebook
+
+import (
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	Group    = "kubeflow.org"
+	Resource = "notebooks"
+)
+
+// SupportedVersions are the Notebook versions this package can read, in order of preference.
+var SupportedVersions = []string{"v1", "v1beta1", "v1alpha1"}
+
+var (
+	mu      sync.RWMutex
+	version = SupportedVersions[0]
+)
+
+// GVR returns the Notebook resource in the version selected by UseServedVersion
+// (v1 until then).
+func GVR() schema.GroupVersionResource {
+	mu.RLock()
+	defer mu.RUnlock()
+	return schema.GroupVersionResource{Group: Group, Version: version, Resource: Resource}
+}
+
+// ServedVersion asks the API server which Notebook versions it serves and
+// returns the preferred one among SupportedVersions.
+func ServedVersion(dc discovery.DiscoveryInterface) (string, error) {
+	groups, err := dc.ServerGroups()
+	if err != nil {
+		return "", fmt.Errorf("discover API groups: %w", err)
+	}
+	for _, g := range groups.Groups {
+		if g.Name != Group {
+			continue
+		}
+		served := map[string]bool{}
+		for _, v := range g.Versions {
+			served[v.Version] = true
+		}
+		if supported(g.PreferredVersion.Version) {
+			return g.PreferredVersion.Version, nil
+		}
+		for _, v := range SupportedVersions {
+			if served[v] {
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("%s is served in versions %v, none of which is supported (%v)", Group, g.Versions, SupportedVersions)
+	}
+	return "", fmt.Errorf("API group %s not found: is Kubeflow installed?", Group)
+}
+
+// UseServedVersion discovers the served Notebook version and makes GVR return it.
+// It is called once at startup.
+func UseServedVersion(cfg *rest.Config) (string, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return "", fmt.Errorf("discovery client: %w", err)
+	}
+	v, err := ServedVersion(dc)
+	if err != nil {
+		return "", err
+	}
+	mu.Lock()
+	version = v
+	mu.Unlock()
+	return v, nil
+}
+
+func supported(v string) bool {
+	for _, s := range SupportedVersions {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keys of the namespace policy in its ConfigMap form, the JSON object of the
+// namespace in the admins' "gpu-switcher-policy" ConfigMap. Missing keys (or
+// zero values) mean "no limit".
+const (
+	KeyMaxGPUNotebooks = "maxGpuNotebooks"       // e.g. "2"
+	KeyAllowedProfiles = "allowedProfiles"       // comma-separated, e.g. "default,a100"
+	KeyMaxGPUSession   = "maxGpuSessionDuration" // e.g. "8h"
+	KeyIdleTimeout     = "idleTimeout"           // e.g. "15m", shortens the reclaimer's timeout
+)
+
+// Policy limits the GPU usage of one namespace.
+type Policy struct {
+	// MaxGPUNotebooks is the maximum number of running GPU notebooks; 0 is unlimited.
+	MaxGPUNotebooks int
+	// AllowedProfiles lists the GPU profiles that may be requested; empty allows all.
+	AllowedProfiles []string
+	// MaxGPUSession is how long a notebook may stay on GPU without interruption; 0 is unlimited.
+	MaxGPUSession time.Duration
+	// IdleTimeout shortens the idle reclaimer's timeout; 0, or a longer one,
+	// keeps the reclaimer's.
+	IdleTimeout time.Duration
+}
+
+// DeniedError is returned when a migration to GPU violates the namespace policy.
+type DeniedError struct {
+	Namespace string
+	Reason    string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("GPU request denied by policy of namespace %q: %s", e.Namespace, e.Reason)
+}
+
+// Parse reads the policy from its ConfigMap form.
+func Parse(data map[string]string) (Policy, error) {
+	var p Policy
+	if v := strings.TrimSpace(data[KeyMaxGPUNotebooks]); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("%s: invalid count %q", KeyMaxGPUNotebooks, v)
+		}
+		p.MaxGPUNotebooks = n
+	}
+	for _, name := range strings.Split(data[KeyAllowedProfiles], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			p.AllowedProfiles = append(p.AllowedProfiles, name)
+		}
+	}
+	var err error
+	if p.MaxGPUSession, err = parseDuration(data, KeyMaxGPUSession); err != nil {
+		return p, err
+	}
+	if p.IdleTimeout, err = parseDuration(data, KeyIdleTimeout); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+func parseDuration(data map[string]string, key string) (time.Duration, error) {
+	v := strings.TrimSpace(data[key])
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s: invalid duration %q", key, v)
+	}
+	return d, nil
+}
+
+// CheckProfile denies profiles not in AllowedProfiles.
+func (p Policy) CheckProfile(namespace, profile string) error {
+	if len(p.AllowedProfiles) == 0 {
+		return nil
+	}
+	for _, allowed := range p.AllowedProfiles {
+		if allowed == profile {
+			return nil
+		}
+	}
+	return &DeniedError{
+		Namespace: namespace,
+		Reason:    fmt.Sprintf("profile %q is not allowed (allowed: %s)", profile, strings.Join(p.AllowedProfiles, ", ")),
+	}
+}
+
+// CheckConcurrency denies a new GPU notebook when running GPU notebooks already
+// reach MaxGPUNotebooks.
+func (p Policy) CheckConcurrency(namespace string, running int) error {
+	if p.MaxGPUNotebooks == 0 || running < p.MaxGPUNotebooks {
+		return nil
+	}
+	return &DeniedError{
+		Namespace: namespace,
+		Reason:    fmt.Sprintf("%d of %d GPU notebooks already running; release one first", running, p.MaxGPUNotebooks),
+	}
+}
+
+// SessionExceeded reports whether a GPU session started at start has outlived MaxGPUSession.
+func (p Policy) SessionExceeded(start, now time.Time) bool {
+	return p.MaxGPUSession > 0 && now.Sub(start) >= p.MaxGPUSession
+}
+
+// Data renders the policy as ConfigMap data, omitting unlimited values.
+func (p Policy) Data() map[string]string {
+	data := map[string]string{}
+	if p.MaxGPUNotebooks > 0 {
+		data[KeyMaxGPUNotebooks] = strconv.Itoa(p.MaxGPUNotebooks)
+	}
+	if len(p.AllowedProfiles) > 0 {
+		data[KeyAllowedProfiles] = strings.Join(p.AllowedProfiles, ",")
+	}
+	if p.MaxGPUSession > 0 {
+		data[KeyMaxGPUSession] = p.MaxGPUSession.String()
+	}
+	if p.IdleTimeout > 0 {
+		data[KeyIdleTimeout] = p.IdleTimeout.String()
+	}
+	return data
+}
+
+// MarshalJSON encodes the policy in its ConfigMap form.
+func (p Policy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.Data())
+}
+
+// UnmarshalJSON decodes the ConfigMap form written by MarshalJSON.
+func (p *Policy) UnmarshalJSON(b []byte) error {
+	var data map[string]string
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	parsed, err := Parse(data)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
@@ -0,0 +1,116 @@
+package policy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    Policy
+		wantErr bool
+	}{
+		{name: "empty", data: map[string]string{}},
+		{
+			name: "all keys",
+			data: map[string]string{KeyMaxGPUNotebooks: " 2 ", KeyAllowedProfiles: "default, a100,,", KeyMaxGPUSession: "8h", KeyIdleTimeout: "15m"},
+			want: Policy{MaxGPUNotebooks: 2, AllowedProfiles: []string{"default", "a100"}, MaxGPUSession: 8 * time.Hour, IdleTimeout: 15 * time.Minute},
+		},
+		{name: "invalid count", data: map[string]string{KeyMaxGPUNotebooks: "two"}, wantErr: true},
+		{name: "negative count", data: map[string]string{KeyMaxGPUNotebooks: "-1"}, wantErr: true},
+		{name: "invalid session", data: map[string]string{KeyMaxGPUSession: "8 hours"}, wantErr: true},
+		{name: "negative idle timeout", data: map[string]string{KeyIdleTimeout: "-5m"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse error = %v, want error: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckProfile(t *testing.T) {
+	tests := []struct {
+		allowed    []string
+		profile    string
+		wantDenied bool
+	}{
+		{profile: "a100"},
+		{allowed: []string{"default", "a100"}, profile: "a100"},
+		{allowed: []string{"default"}, profile: "a100", wantDenied: true},
+		{allowed: []string{"default"}, profile: "", wantDenied: true},
+	}
+	for _, tt := range tests {
+		err := Policy{AllowedProfiles: tt.allowed}.CheckProfile("team", tt.profile)
+		var denied *DeniedError
+		if errors.As(err, &denied) != tt.wantDenied || (err != nil && !tt.wantDenied) {
+			t.Errorf("CheckProfile(%q) with %v = %v, want denied: %v", tt.profile, tt.allowed, err, tt.wantDenied)
+		}
+		if denied != nil && denied.Namespace != "team" {
+			t.Errorf("denied namespace %q, want team", denied.Namespace)
+		}
+	}
+}
+
+func TestCheckConcurrency(t *testing.T) {
+	tests := []struct {
+		max, running int
+		wantDenied   bool
+	}{
+		{max: 0, running: 10},
+		{max: 2, running: 0},
+		{max: 2, running: 1},
+		{max: 2, running: 2, wantDenied: true},
+		{max: 2, running: 3, wantDenied: true},
+	}
+	for _, tt := range tests {
+		err := Policy{MaxGPUNotebooks: tt.max}.CheckConcurrency("team", tt.running)
+		var denied *DeniedError
+		if errors.As(err, &denied) != tt.wantDenied || (err != nil && !tt.wantDenied) {
+			t.Errorf("CheckConcurrency(%d) with max %d = %v, want denied: %v", tt.running, tt.max, err, tt.wantDenied)
+		}
+	}
+}
+
+func TestSessionExceeded(t *testing.T) {
+	start := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		max  time.Duration
+		now  time.Time
+		want bool
+	}{
+		{max: 0, now: start.Add(1000 * time.Hour)},
+		{max: 8 * time.Hour, now: start.Add(7 * time.Hour)},
+		{max: 8 * time.Hour, now: start.Add(8 * time.Hour), want: true},
+		{max: 8 * time.Hour, now: start.Add(9 * time.Hour), want: true},
+	}
+	for _, tt := range tests {
+		if got := (Policy{MaxGPUSession: tt.max}).SessionExceeded(start, tt.now); got != tt.want {
+			t.Errorf("SessionExceeded after %v with max %v = %v, want %v", tt.now.Sub(start), tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	p := Policy{MaxGPUNotebooks: 1, AllowedProfiles: []string{"default"}, MaxGPUSession: 4 * time.Hour}
+	b, err := p.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Policy
+	if err := got.UnmarshalJSON(b); err != nil {
+		t.Fatalf("UnmarshalJSON(%s): %v", b, err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("round trip = %+v, want %+v", got, p)
+	}
+}
@@ -0,0 +1,84 @@
+// Package retry retries Kubernetes API calls that failed for a transient
+// reason: throttling, timeouts, server errors, dropped connections and
+// conflicts. Callers whose operation reads the object before writing it
+// (e.g. workload.Backend.Patch) thus retry conflicts with a fresh read.
+package retry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// DefaultBackoff makes up to 5 attempts over about 3 seconds; every delay is
+// randomly stretched by up to half so that replicas do not retry in step.
+var DefaultBackoff = wait.Backoff{
+	Duration: 200 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.5,
+	Steps:    5,
+	Cap:      5 * time.Second,
+}
+
+// Retryable reports whether err is worth another attempt. Errors such as
+// Forbidden, Invalid, NotFound or AlreadyExists are not.
+func Retryable(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case apierrors.IsConflict(err),
+		apierrors.IsTooManyRequests(err),
+		apierrors.IsServerTimeout(err),
+		apierrors.IsTimeout(err),
+		apierrors.IsInternalError(err),
+		apierrors.IsServiceUnavailable(err),
+		apierrors.IsUnexpectedServerError(err):
+		return true
+	case utilnet.IsConnectionReset(err), utilnet.IsConnectionRefused(err), utilnet.IsProbableEOF(err):
+		return true
+	}
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		return status.Status().Code >= 500
+	}
+	// client-side timeouts; those of the caller's ctx are handled by Do
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// Do calls op until it succeeds, fails with an error that is not Retryable,
+// backoff.Steps attempts are made or ctx is done, and returns op's last
+// error. A delay the server asks for (Retry-After) is honoured when longer
+// than the backoff. Retries are recorded as events of the span of ctx.
+func Do(ctx context.Context, backoff wait.Backoff, op func() error) error {
+	attempts := backoff.Steps // Step counts down
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if !Retryable(err) || attempt >= attempts || ctx.Err() != nil {
+			return err
+		}
+		delay := backoff.Step()
+		if s, ok := apierrors.SuggestsClientDelay(err); ok && time.Duration(s)*time.Second > delay {
+			delay = time.Duration(s) * time.Second
+		}
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.Int("retry.attempt", attempt),
+			attribute.String("retry.delay", delay.String()),
+			attribute.String("error", err.Error()),
+		))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var gr = schema.GroupResource{Group: "kubeflow.org", Resource: "notebooks"}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"conflict", apierrors.NewConflict(gr, "nb", errors.New("modified")), true},
+		{"wrapped conflict", fmt.Errorf("patch: %w", apierrors.NewConflict(gr, "nb", errors.New("modified"))), true},
+		{"too many requests", apierrors.NewTooManyRequests("slow down", 1), true},
+		{"server timeout", apierrors.NewServerTimeout(gr, "get", 1), true},
+		{"timeout", apierrors.NewTimeoutError("timed out", 1), true},
+		{"internal", apierrors.NewInternalError(errors.New("boom")), true},
+		{"service unavailable", apierrors.NewServiceUnavailable("down"), true},
+		{"bad gateway", apierrors.NewGenericServerResponse(502, "get", gr, "nb", "", 0, false), true},
+		{"connection reset", &net.OpError{Op: "read", Err: syscall.ECONNRESET}, true},
+		{"connection refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{"EOF", io.ErrUnexpectedEOF, true},
+		{"client timeout", &net.DNSError{Err: "i/o timeout", IsTimeout: true}, true},
+		{"forbidden", apierrors.NewForbidden(gr, "nb", errors.New("no")), false},
+		{"not found", apierrors.NewNotFound(gr, "nb"), false},
+		{"already exists", apierrors.NewAlreadyExists(gr, "nb"), false},
+		{"invalid", apierrors.NewInvalid(schema.GroupKind{Kind: "Notebook"}, "nb", nil), false},
+		{"bad request", apierrors.NewBadRequest("bad"), false},
+		{"other", errors.New("something else"), false},
+	}
+	for _, tt := range tests {
+		if got := Retryable(tt.err); got != tt.want {
+			t.Errorf("Retryable(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	fast := DefaultBackoff
+	fast.Duration, fast.Cap = time.Millisecond, 10*time.Millisecond
+	transient := apierrors.NewServiceUnavailable("down")
+	permanent := apierrors.NewForbidden(gr, "nb", errors.New("no"))
+
+	tests := []struct {
+		name      string
+		fails     int // attempts failing before success; -1 always
+		err       error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "transient then success", fails: 2, err: transient, wantCalls: 3},
+		{name: "gives up after Steps", fails: -1, err: transient, wantCalls: DefaultBackoff.Steps, wantErr: transient},
+		{name: "not retryable", fails: -1, err: permanent, wantCalls: 1, wantErr: permanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := Do(context.Background(), fast, func() error {
+				calls++
+				if tt.fails < 0 || calls <= tt.fails {
+					return tt.err
+				}
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("Do = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// A Retry-After longer than the backoff is waited for, up to the end of ctx.
+func TestDoRetryAfter(t *testing.T) {
+	fast := DefaultBackoff
+	fast.Duration = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	start := time.Now()
+	err := Do(ctx, fast, func() error {
+		calls++
+		return apierrors.NewTooManyRequests("slow down", 5)
+	})
+	if !apierrors.IsTooManyRequests(err) || calls != 1 {
+		t.Errorf("Do = %v after %d calls, want TooManyRequests after 1", err, calls)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Do returned after %v, past the end of ctx", d)
+	}
+}
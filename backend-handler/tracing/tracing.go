@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is reported as service.name unless OTEL_SERVICE_NAME overrides it.
+const ServiceName = "backend-handler"
+
+// Init installs the global TracerProvider that exports spans over OTLP/HTTP.
+// endpoint is a full URL such as "http://otel-collector:4318". When endpoint is
+// empty, the standard OTEL_EXPORTER_OTLP_(TRACES_)ENDPOINT variables are used;
+// when none of them is set the global no-op provider is kept, so every span
+// created in this program costs (almost) nothing.
+//
+// The returned shutdown function flushes pending spans and is always non-nil.
+func Init(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	// Propagate W3C trace context so a traceparent header sent by the
+	// front-end links its span with ours.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var opts []otlptracehttp.Option
+	switch {
+	case endpoint != "":
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+	case os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "", os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "":
+		// the exporter reads these variables itself
+	default:
+		return noop, nil
+	}
+
+	exp, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return noop, fmt.Errorf("otlp exporter: %w", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", ServiceName)),
+		resource.WithFromEnv(), // OTEL_SERVICE_NAME / OTEL_RESOURCE_ATTRIBUTES win
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return noop, fmt.Errorf("trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// WrapTransport instruments a Kubernetes client transport so that every API
+// request shows up as a child span ("k8s GET /api/v1/namespaces/...").
+// Use it with rest.Config.Wrap.
+func WrapTransport(rt http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(rt,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "k8s " + r.Method + " " + r.URL.Path
+		}),
+	)
+}
+
+// Handler wraps an HTTP handler with a server span named operation.
+func Handler(h http.Handler, operation string) http.Handler {
+	return otelhttp.NewHandler(h, operation)
+}
+
+// End records err (if any) on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,212 @@
+package workload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// KindJupyterHub selects JupyterHub: notebooks are Hub user servers, migrated
+// by restarting them with another KubeSpawner profile instead of being cloned.
+const KindJupyterHub = "jupyterhub"
+
+// JupyterHub migrates user servers through the Hub REST API. Notebook names
+// are "<user>" for the default server or "<user>/<server>" for named servers.
+type JupyterHub struct {
+	// URL is the Hub API root, e.g. "http://hub.jhub.svc:8081/hub/api".
+	URL string
+	// Token is a Hub API token allowed to read users and start/stop their servers.
+	Token  string
+	Client *http.Client
+	// PollInterval defaults to one second.
+	PollInterval time.Duration
+}
+
+// HubServer is a user server as returned by the Hub API.
+type HubServer struct {
+	// User owns the server; Name is empty for the default server.
+	User    string `json:"-"`
+	Name    string `json:"name"`
+	Ready   bool   `json:"ready"`
+	Pending string `json:"pending"` // "spawn", "stop" or empty
+	// URL is the path of the server, e.g. "/user/alice/".
+	URL         string         `json:"url"`
+	UserOptions map[string]any `json:"user_options"`
+}
+
+// Profile returns the KubeSpawner profile slug the server was started with.
+func (s *HubServer) Profile() string {
+	p, _ := s.UserOptions["profile"].(string)
+	return p
+}
+
+type hubUser struct {
+	Name    string                `json:"name"`
+	Servers map[string]*HubServer `json:"servers"`
+}
+
+// HubError is a non-2xx answer of the Hub.
+type HubError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *HubError) Error() string {
+	return fmt.Sprintf("jupyterhub: %d %s", e.StatusCode, e.Message)
+}
+
+func splitHubName(name string) (user, server string) {
+	user, server, _ = strings.Cut(name, "/")
+	return user, server
+}
+
+func serverPath(user, server string) string {
+	if server == "" {
+		return "/users/" + url.PathEscape(user) + "/server"
+	}
+	return "/users/" + url.PathEscape(user) + "/servers/" + url.PathEscape(server)
+}
+
+// Server returns the server of notebook name, or nil if it is not running.
+func (h *JupyterHub) Server(ctx context.Context, name string) (*HubServer, error) {
+	user, server := splitHubName(name)
+	var u hubUser
+	if err := h.do(ctx, http.MethodGet, "/users/"+url.PathEscape(user), nil, &u); err != nil {
+		return nil, err
+	}
+	s := u.Servers[server]
+	if s != nil {
+		s.User = user
+	}
+	return s, nil
+}
+
+// Servers returns every active server of the Hub.
+func (h *JupyterHub) Servers(ctx context.Context) ([]*HubServer, error) {
+	var users []hubUser
+	if err := h.do(ctx, http.MethodGet, "/users?state=active", nil, &users); err != nil {
+		return nil, err
+	}
+	var out []*HubServer
+	for _, u := range users {
+		for _, s := range u.Servers {
+			s.User = u.Name
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// Stop stops the server of notebook name and waits until it is gone.
+func (h *JupyterHub) Stop(ctx context.Context, name string) error {
+	user, server := splitHubName(name)
+	err := h.do(ctx, http.MethodDelete, serverPath(user, server), nil, nil)
+	if he, ok := err.(*HubError); ok && he.StatusCode == http.StatusNotFound {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("stop server %s: %w", name, err)
+	}
+	return h.poll(ctx, func() (bool, error) {
+		s, err := h.Server(ctx, name)
+		return s == nil, err
+	})
+}
+
+// Start starts the server of notebook name with KubeSpawner profile (empty:
+// the Hub's default) and waits until it is ready.
+func (h *JupyterHub) Start(ctx context.Context, name, profile string) (*HubServer, error) {
+	user, server := splitHubName(name)
+	options := map[string]any{}
+	if profile != "" {
+		options["profile"] = profile
+	}
+	if err := h.do(ctx, http.MethodPost, serverPath(user, server), options, nil); err != nil {
+		return nil, fmt.Errorf("start server %s: %w", name, err)
+	}
+	var ready *HubServer
+	err := h.poll(ctx, func() (bool, error) {
+		s, err := h.Server(ctx, name)
+		if err != nil {
+			return false, err
+		}
+		if s == nil {
+			return false, fmt.Errorf("server %s stopped while starting", name)
+		}
+		ready = s
+		return s.Ready, nil
+	})
+	return ready, err
+}
+
+func (h *JupyterHub) poll(ctx context.Context, done func() (bool, error)) error {
+	interval := h.PollInterval
+	if interval == 0 {
+		interval = time.Second
+	}
+	for {
+		ok, err := done()
+		if err != nil || ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (h *JupyterHub) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(h.URL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if h.Token != "" {
+		req.Header.Set("Authorization", "token "+h.Token)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		msg := strings.TrimSpace(string(raw))
+		if json.Unmarshal(raw, &e) == nil && e.Message != "" {
+			msg = e.Message
+		}
+		return &HubError{StatusCode: resp.StatusCode, Message: msg}
+	}
+	if out == nil || len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
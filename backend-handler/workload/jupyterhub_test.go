@@ -0,0 +1,227 @@
+package workload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHub is an in-memory Hub REST API. Started servers become ready after
+// readyAfter polls of their user, or vanish then if failSpawn is set.
+type fakeHub struct {
+	mu         sync.Mutex
+	token      string
+	users      map[string]map[string]*HubServer
+	polls      map[string]int
+	readyAfter int
+	failSpawn  bool
+	started    []map[string]any
+}
+
+func newFakeHub(t *testing.T) (*fakeHub, *JupyterHub) {
+	f := &fakeHub{token: "secret", users: map[string]map[string]*HubServer{}, polls: map[string]int{}, readyAfter: 2}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /hub/api/users", f.listUsers)
+	mux.HandleFunc("GET /hub/api/users/{name}", f.getUser)
+	mux.HandleFunc("POST /hub/api/users/{name}/server", f.start)
+	mux.HandleFunc("DELETE /hub/api/users/{name}/server", f.stop)
+	mux.HandleFunc("POST /hub/api/users/{name}/servers/{server}", f.start)
+	mux.HandleFunc("DELETE /hub/api/users/{name}/servers/{server}", f.stop)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token "+f.token {
+			writeHubJSON(w, http.StatusForbidden, map[string]string{"message": "Forbidden"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return f, &JupyterHub{URL: srv.URL + "/hub/api/", Token: f.token, Client: srv.Client(), PollInterval: time.Millisecond}
+}
+
+func writeHubJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeHub) getUser(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := r.PathValue("name")
+	servers, ok := f.users[name]
+	if !ok {
+		writeHubJSON(w, http.StatusNotFound, map[string]string{"message": "No such user"})
+		return
+	}
+	f.polls[name]++
+	for key, s := range servers {
+		if s.Pending == "spawn" && f.polls[name] >= f.readyAfter {
+			if f.failSpawn {
+				delete(servers, key)
+				continue
+			}
+			s.Ready, s.Pending = true, ""
+		}
+	}
+	writeHubJSON(w, http.StatusOK, map[string]any{"name": name, "servers": servers})
+}
+
+func (f *fakeHub) listUsers(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []map[string]any
+	for name, servers := range f.users {
+		if len(servers) > 0 {
+			out = append(out, map[string]any{"name": name, "servers": servers})
+		}
+	}
+	writeHubJSON(w, http.StatusOK, out)
+}
+
+func (f *fakeHub) start(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name, server := r.PathValue("name"), r.PathValue("server")
+	var options map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+		writeHubJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	if f.users[name] == nil {
+		f.users[name] = map[string]*HubServer{}
+	}
+	if _, running := f.users[name][server]; running {
+		writeHubJSON(w, http.StatusBadRequest, map[string]string{"message": name + " is already running"})
+		return
+	}
+	f.started = append(f.started, options)
+	f.polls[name] = 0
+	f.users[name][server] = &HubServer{Name: server, Pending: "spawn", URL: "/user/" + name + "/", UserOptions: options}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (f *fakeHub) stop(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	servers, ok := f.users[r.PathValue("name")]
+	if !ok {
+		writeHubJSON(w, http.StatusNotFound, map[string]string{"message": "No such user"})
+		return
+	}
+	delete(servers, r.PathValue("server"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestJupyterHubStartStop(t *testing.T) {
+	f, hub := newFakeHub(t)
+	ctx := context.Background()
+
+	s, err := hub.Start(ctx, "alice", "a100")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if !s.Ready || s.URL != "/user/alice/" || s.Profile() != "a100" || s.User != "alice" {
+		t.Errorf("Start returned %+v", s)
+	}
+	if len(f.started) != 1 || f.started[0]["profile"] != "a100" {
+		t.Errorf("Hub got user options %v, want profile a100", f.started)
+	}
+
+	got, err := hub.Server(ctx, "alice")
+	if err != nil || got == nil || got.Profile() != "a100" {
+		t.Fatalf("Server = %+v, %v", got, err)
+	}
+	servers, err := hub.Servers(ctx)
+	if err != nil || len(servers) != 1 || servers[0].User != "alice" {
+		t.Fatalf("Servers = %+v, %v", servers, err)
+	}
+
+	if err := hub.Stop(ctx, "alice"); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if got, err := hub.Server(ctx, "alice"); err != nil || got != nil {
+		t.Errorf("Server after Stop = %+v, %v, want none", got, err)
+	}
+	// stopping a stopped server succeeds
+	if err := hub.Stop(ctx, "alice"); err != nil {
+		t.Errorf("Stop of a stopped server: %v", err)
+	}
+}
+
+func TestJupyterHubNamedServer(t *testing.T) {
+	f, hub := newFakeHub(t)
+	ctx := context.Background()
+
+	if _, err := hub.Start(ctx, "bob/train", ""); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if len(f.started[0]) != 0 {
+		t.Errorf("Start without profile sent options %v", f.started[0])
+	}
+	if s, err := hub.Server(ctx, "bob/train"); err != nil || s == nil || s.Name != "train" {
+		t.Errorf("Server(bob/train) = %+v, %v", s, err)
+	}
+	if s, err := hub.Server(ctx, "bob"); err != nil || s != nil {
+		t.Errorf("Server(bob) = %+v, %v, want no default server", s, err)
+	}
+	if err := hub.Stop(ctx, "bob/train"); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+}
+
+func TestJupyterHubErrors(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("forbidden", func(t *testing.T) {
+		_, hub := newFakeHub(t)
+		hub.Token = "wrong"
+		_, err := hub.Server(ctx, "alice")
+		var he *HubError
+		if !errors.As(err, &he) || he.StatusCode != http.StatusForbidden || he.Message != "Forbidden" {
+			t.Errorf("Server with a wrong token: %v, want HubError 403", err)
+		}
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		_, hub := newFakeHub(t)
+		var he *HubError
+		if _, err := hub.Server(ctx, "nobody"); !errors.As(err, &he) || he.StatusCode != http.StatusNotFound {
+			t.Errorf("Server of an unknown user: %v, want HubError 404", err)
+		}
+	})
+
+	t.Run("already running", func(t *testing.T) {
+		_, hub := newFakeHub(t)
+		if _, err := hub.Start(ctx, "alice", "a100"); err != nil {
+			t.Fatal(err)
+		}
+		_, err := hub.Start(ctx, "alice", "t4")
+		if err == nil || !strings.Contains(err.Error(), "already running") {
+			t.Errorf("Start of a running server: %v", err)
+		}
+	})
+
+	t.Run("spawn fails", func(t *testing.T) {
+		f, hub := newFakeHub(t)
+		f.failSpawn = true
+		if _, err := hub.Start(ctx, "alice", "a100"); err == nil || !strings.Contains(err.Error(), "stopped while starting") {
+			t.Errorf("Start of a failing spawn: %v", err)
+		}
+	})
+
+	t.Run("never ready", func(t *testing.T) {
+		f, hub := newFakeHub(t)
+		f.readyAfter = 1 << 30
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		if _, err := hub.Start(ctx, "alice", "a100"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Start of a server that never gets ready: %v", err)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package workload
+
+import (
+	nbpods "backend-handler/get-nbpods-name"
+	"backend-handler/notebook"
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// KubeflowStoppedAnnotation is set by Kubeflow on Notebooks scaled down to zero.
+const KubeflowStoppedAnnotation = "kubeflow-resource-stopped"
+
+// Kubeflow runs notebooks as Kubeflow Notebook custom resources.
+type Kubeflow struct {
+	nbs  *notebook.Client
+	cs   kubernetes.Interface
+	opts Options
+}
+
+// NewKubeflow returns the Kubeflow Notebook backend.
+func NewKubeflow(dc dynamic.Interface, cs kubernetes.Interface, opts Options) *Kubeflow {
+	return &Kubeflow{nbs: notebook.NewClient(dc), cs: cs, opts: opts}
+}
+
+func (k *Kubeflow) Kind() string { return KindKubeflow }
+
+func fromNotebook(nb *notebook.Notebook) *Workload {
+	_, stopped := nb.Annotations[KubeflowStoppedAnnotation]
+	return &Workload{ObjectMeta: nb.ObjectMeta, Template: nb.Spec.Template, Stopped: stopped, obj: nb}
+}
+
+// toNotebook writes the metadata and template of w into a copy of its Notebook.
+func toNotebook(w *Workload) *notebook.Notebook {
+	nb := &notebook.Notebook{}
+	if src, ok := w.obj.(*notebook.Notebook); ok {
+		nb = src.DeepCopy()
+	}
+	nb.ObjectMeta = w.ObjectMeta
+	nb.Spec.Template = w.Template
+	return nb
+}
+
+func (k *Kubeflow) Get(ctx context.Context, namespace, name string) (*Workload, error) {
+	nb, err := k.nbs.Get(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return fromNotebook(nb), nil
+}
+
+func (k *Kubeflow) List(ctx context.Context, namespace string) ([]*Workload, error) {
+	list, err := k.nbs.List(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Workload, 0, len(list))
+	for _, nb := range list {
+		out = append(out, fromNotebook(nb))
+	}
+	return out, nil
+}
+
+func (k *Kubeflow) Clone(ctx context.Context, src *Workload, newName string, mutations ...Mutation) (*Workload, error) {
+	w := src.DeepCopy()
+	cloneMeta(w, newName)
+	if err := apply(w, mutations); err != nil {
+		return nil, err
+	}
+	nb := toNotebook(w)
+	nb.Status = nil
+	created, err := k.nbs.Create(ctx, nb)
+	if err != nil {
+		return nil, err
+	}
+	return fromNotebook(created), nil
+}
+
+func (k *Kubeflow) Patch(ctx context.Context, namespace, name string, mutations ...Mutation) (*Workload, error) {
+	w, err := k.Get(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := apply(w, mutations); err != nil {
+		return nil, err
+	}
+	updated, err := k.nbs.Update(ctx, toNotebook(w))
+	if err != nil {
+		return nil, err
+	}
+	return fromNotebook(updated), nil
+}
+
+func (k *Kubeflow) FindPod(ctx context.Context, namespace, name string) (string, error) {
+	return nbpods.FindFirstPodNameByNotebookName(ctx, k.cs, name, namespace)
+}
+
+func (k *Kubeflow) Pod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
+	return nbpods.GetNotebookPod(ctx, k.cs, name, namespace)
+}
+
+// Stop sets the annotation the Kubeflow controller scales Notebooks down on.
+func (k *Kubeflow) Stop(ctx context.Context, namespace, name string) error {
+	_, err := k.Patch(ctx, namespace, name, func(w *Workload) error {
+		if w.Annotations == nil {
+			w.Annotations = map[string]string{}
+		}
+		w.Annotations[KubeflowStoppedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		return nil
+	})
+	return err
+}
+
+func (k *Kubeflow) Start(ctx context.Context, namespace, name string) error {
+	_, err := k.Patch(ctx, namespace, name, func(w *Workload) error {
+		delete(w.Annotations, KubeflowStoppedAnnotation)
+		return nil
+	})
+	return err
+}
+
+func (k *Kubeflow) Delete(ctx context.Context, namespace, name string) error {
+	// PropagationForeground waits for the StatefulSet and pod to be deleted
+	policy := metav1.DeletePropagationForeground
+	return k.nbs.Delete(ctx, namespace, name, metav1.DeleteOptions{PropagationPolicy: &policy})
+}
+
+func (k *Kubeflow) URL(namespace, name string) string {
+	return ExpandURL(k.opts.URLTemplate, namespace, name)
+}
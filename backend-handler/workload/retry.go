@@ -0,0 +1,96 @@
+package workload
+
+import (
+	"backend-handler/retry"
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// WithRetry returns b with every API call retried on transient errors (see
+// package retry); FindPod already waits through them. Patch, Stop and Start
+// read the workload on every attempt, so conflicts are retried against its
+// current version.
+func WithRetry(b Backend, backoff wait.Backoff) Backend {
+	return &retrying{Backend: b, backoff: backoff}
+}
+
+type retrying struct {
+	Backend
+	backoff wait.Backoff
+}
+
+func (r *retrying) Get(ctx context.Context, namespace, name string) (w *Workload, err error) {
+	err = retry.Do(ctx, r.backoff, func() error {
+		w, err = r.Backend.Get(ctx, namespace, name)
+		return err
+	})
+	return w, err
+}
+
+func (r *retrying) List(ctx context.Context, namespace string) (list []*Workload, err error) {
+	err = retry.Do(ctx, r.backoff, func() error {
+		list, err = r.Backend.List(ctx, namespace)
+		return err
+	})
+	return list, err
+}
+
+// Clone retries the creation. An attempt that timed out may still have
+// created the workload, so AlreadyExists after a failed attempt returns it.
+func (r *retrying) Clone(ctx context.Context, src *Workload, newName string, mutations ...Mutation) (w *Workload, err error) {
+	failed := false
+	err = retry.Do(ctx, r.backoff, func() error {
+		w, err = r.Backend.Clone(ctx, src, newName, mutations...)
+		if failed && apierrors.IsAlreadyExists(err) {
+			w, err = r.Backend.Get(ctx, src.Namespace, newName)
+		}
+		failed = err != nil
+		return err
+	})
+	return w, err
+}
+
+func (r *retrying) Patch(ctx context.Context, namespace, name string, mutations ...Mutation) (w *Workload, err error) {
+	err = retry.Do(ctx, r.backoff, func() error {
+		w, err = r.Backend.Patch(ctx, namespace, name, mutations...)
+		return err
+	})
+	return w, err
+}
+
+func (r *retrying) Pod(ctx context.Context, namespace, name string) (pod *corev1.Pod, err error) {
+	err = retry.Do(ctx, r.backoff, func() error {
+		pod, err = r.Backend.Pod(ctx, namespace, name)
+		return err
+	})
+	return pod, err
+}
+
+func (r *retrying) Stop(ctx context.Context, namespace, name string) error {
+	return retry.Do(ctx, r.backoff, func() error {
+		return r.Backend.Stop(ctx, namespace, name)
+	})
+}
+
+func (r *retrying) Start(ctx context.Context, namespace, name string) error {
+	return retry.Do(ctx, r.backoff, func() error {
+		return r.Backend.Start(ctx, namespace, name)
+	})
+}
+
+// Delete retries the deletion. NotFound after a failed attempt means that
+// attempt went through.
+func (r *retrying) Delete(ctx context.Context, namespace, name string) error {
+	failed := false
+	return retry.Do(ctx, r.backoff, func() error {
+		err := r.Backend.Delete(ctx, namespace, name)
+		if failed && apierrors.IsNotFound(err) {
+			return nil
+		}
+		failed = err != nil
+		return err
+	})
+}
@@ -0,0 +1,159 @@
+package workload
+
+import (
+	nbpods "backend-handler/get-nbpods-name"
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// StatefulSetLabel marks the StatefulSets the StatefulSet backend lists (e.g.
+// for idle reclaim and policy counting); Get and Clone work on any StatefulSet.
+const StatefulSetLabel = "gpu-switcher/notebook"
+
+// StatefulSet runs notebooks as plain single-replica StatefulSets.
+//
+// Clones keep the volumeClaimTemplates, which yield new PVCs for the new name:
+// mount the notebook data from an existing PVC through the pod template's
+// volumes so it survives the migration.
+type StatefulSet struct {
+	cs   kubernetes.Interface
+	opts Options
+}
+
+// NewStatefulSet returns the StatefulSet backend.
+func NewStatefulSet(cs kubernetes.Interface, opts Options) *StatefulSet {
+	return &StatefulSet{cs: cs, opts: opts}
+}
+
+func (s *StatefulSet) Kind() string { return KindStatefulSet }
+
+func fromStatefulSet(sts *appsv1.StatefulSet) *Workload {
+	stopped := sts.Spec.Replicas != nil && *sts.Spec.Replicas == 0
+	return &Workload{ObjectMeta: sts.ObjectMeta, Template: sts.Spec.Template, Stopped: stopped, obj: sts}
+}
+
+func (s *StatefulSet) Get(ctx context.Context, namespace, name string) (*Workload, error) {
+	sts, err := s.cs.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return fromStatefulSet(sts), nil
+}
+
+func (s *StatefulSet) List(ctx context.Context, namespace string) ([]*Workload, error) {
+	list, err := s.cs.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{LabelSelector: StatefulSetLabel + "=true"})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Workload, 0, len(list.Items))
+	for i := range list.Items {
+		out = append(out, fromStatefulSet(&list.Items[i]))
+	}
+	return out, nil
+}
+
+func (s *StatefulSet) Clone(ctx context.Context, src *Workload, newName string, mutations ...Mutation) (*Workload, error) {
+	orig, ok := src.obj.(*appsv1.StatefulSet)
+	if !ok {
+		return nil, fmt.Errorf("workload %s/%s was not read as a StatefulSet", src.Namespace, src.Name)
+	}
+	w := src.DeepCopy()
+	cloneMeta(w, newName)
+	if err := apply(w, mutations); err != nil {
+		return nil, err
+	}
+
+	sts := orig.DeepCopy()
+	sts.ObjectMeta = w.ObjectMeta
+	sts.Spec.Template = w.Template
+	sts.Status = appsv1.StatefulSetStatus{}
+	// The selector must match the (renamed) template labels and not the pods
+	// of the source StatefulSet.
+	if sts.Spec.Selector != nil {
+		renameLabels(sts.Spec.Selector.MatchLabels, src.Name, newName)
+	}
+	created, err := s.cs.AppsV1().StatefulSets(w.Namespace).Create(ctx, sts, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return fromStatefulSet(created), nil
+}
+
+func (s *StatefulSet) Patch(ctx context.Context, namespace, name string, mutations ...Mutation) (*Workload, error) {
+	sts, err := s.cs.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	w := fromStatefulSet(sts)
+	if err := apply(w, mutations); err != nil {
+		return nil, err
+	}
+	sts.ObjectMeta = w.ObjectMeta
+	sts.Spec.Template = w.Template
+	updated, err := s.cs.AppsV1().StatefulSets(namespace).Update(ctx, sts, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return fromStatefulSet(updated), nil
+}
+
+// selector returns the pod label selector of StatefulSet name.
+func (s *StatefulSet) selector(ctx context.Context, namespace, name string) (string, error) {
+	sts, err := s.cs.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if sts.Spec.Selector == nil {
+		return "", fmt.Errorf("statefulset %s/%s has no selector", namespace, name)
+	}
+	return metav1.FormatLabelSelector(sts.Spec.Selector), nil
+}
+
+func (s *StatefulSet) FindPod(ctx context.Context, namespace, name string) (string, error) {
+	ls, err := s.selector(ctx, namespace, name)
+	if err != nil {
+		return "", err
+	}
+	return nbpods.FindFirstPodName(ctx, s.cs, namespace, ls)
+}
+
+func (s *StatefulSet) Pod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
+	ls, err := s.selector(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return nbpods.GetFirstPod(ctx, s.cs, namespace, ls)
+}
+
+// Stop scales the StatefulSet to zero replicas.
+func (s *StatefulSet) Stop(ctx context.Context, namespace, name string) error {
+	return s.scale(ctx, namespace, name, 0)
+}
+
+func (s *StatefulSet) Start(ctx context.Context, namespace, name string) error {
+	return s.scale(ctx, namespace, name, 1)
+}
+
+func (s *StatefulSet) scale(ctx context.Context, namespace, name string, replicas int32) error {
+	scale, err := s.cs.AppsV1().StatefulSets(namespace).GetScale(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	scale.Spec.Replicas = replicas
+	_, err = s.cs.AppsV1().StatefulSets(namespace).UpdateScale(ctx, name, scale, metav1.UpdateOptions{})
+	return err
+}
+
+func (s *StatefulSet) Delete(ctx context.Context, namespace, name string) error {
+	policy := metav1.DeletePropagationForeground
+	return s.cs.AppsV1().StatefulSets(namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &policy})
+}
+
+func (s *StatefulSet) URL(namespace, name string) string {
+	return ExpandURL(s.opts.URLTemplate, namespace, name)
+}
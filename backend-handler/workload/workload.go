@@ -0,0 +1,176 @@
+// Package workload abstracts the Kubernetes resource that runs a notebook, so
+// the switcher can migrate Kubeflow Notebooks as well as plain StatefulSets.
+// JupyterHub servers are restarted with another profile instead (see JupyterHub).
+package workload
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Backend kinds, selected per namespace with the "workloadBackend" key of the
+// switcher ConfigMap. See also KindJupyterHub.
+const (
+	KindKubeflow    = "kubeflow"
+	KindStatefulSet = "statefulset"
+)
+
+// DefaultURLTemplate is the notebook URL of the Kubeflow central dashboard.
+const DefaultURLTemplate = "/notebook/{namespace}/{name}/"
+
+// Workload is the part of a notebook workload the switcher reads and changes:
+// its metadata and pod template. The rest of the object is kept by the backend.
+type Workload struct {
+	metav1.ObjectMeta
+	Template corev1.PodTemplateSpec
+	// Stopped is true when the workload is scaled down to zero.
+	Stopped bool
+
+	// obj is the backend's own object the Workload was read from.
+	obj any
+}
+
+// DeepCopy returns a copy of w that can be changed without affecting w.
+func (w *Workload) DeepCopy() *Workload {
+	out := &Workload{Stopped: w.Stopped, obj: w.obj}
+	w.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	w.Template.DeepCopyInto(&out.Template)
+	return out
+}
+
+// PodSpec returns the pod spec of the template for in-place changes.
+func (w *Workload) PodSpec() *corev1.PodSpec {
+	return &w.Template.Spec
+}
+
+// Mutation changes a workload being cloned or patched.
+type Mutation func(w *Workload) error
+
+// Backend reads, clones and removes notebook workloads of one kind.
+type Backend interface {
+	// Kind returns one of the Kind* constants.
+	Kind() string
+	// Get returns workload name of namespace.
+	Get(ctx context.Context, namespace, name string) (*Workload, error)
+	// List returns the notebook workloads of namespace ("" lists all namespaces).
+	List(ctx context.Context, namespace string) ([]*Workload, error)
+	// Clone creates a copy of src named newName with mutations applied.
+	Clone(ctx context.Context, src *Workload, newName string, mutations ...Mutation) (*Workload, error)
+	// Patch applies mutations to workload name in place.
+	Patch(ctx context.Context, namespace, name string, mutations ...Mutation) (*Workload, error)
+	// FindPod waits until workload name has a pod and returns its name; ctx bounds the wait.
+	FindPod(ctx context.Context, namespace, name string) (string, error)
+	// Pod returns the current pod of workload name, or nil if it has none.
+	Pod(ctx context.Context, namespace, name string) (*corev1.Pod, error)
+	// Stop scales workload name down to zero without deleting it.
+	Stop(ctx context.Context, namespace, name string) error
+	// Start scales a stopped workload name back up.
+	Start(ctx context.Context, namespace, name string) error
+	// Delete removes workload name and waits for its dependents (foreground).
+	Delete(ctx context.Context, namespace, name string) error
+	// URL returns the path users open the notebook at.
+	URL(namespace, name string) string
+}
+
+// Options configure New.
+type Options struct {
+	// URLTemplate overrides DefaultURLTemplate; {namespace} and {name} are substituted.
+	URLTemplate string
+}
+
+// New returns the backend of kind ("" selects KindKubeflow).
+func New(kind string, dc dynamic.Interface, cs kubernetes.Interface, opts Options) (Backend, error) {
+	if opts.URLTemplate == "" {
+		opts.URLTemplate = DefaultURLTemplate
+	}
+	switch kind {
+	case "", KindKubeflow:
+		return NewKubeflow(dc, cs, opts), nil
+	case KindStatefulSet:
+		return NewStatefulSet(cs, opts), nil
+	case KindJupyterHub:
+		return nil, fmt.Errorf("%s notebooks are restarted through the Hub API, not cloned", KindJupyterHub)
+	}
+	return nil, fmt.Errorf("unknown workload backend %q (want %s or %s)", kind, KindKubeflow, KindStatefulSet)
+}
+
+// ExpandURL substitutes {namespace} and {name} (path-escaped) in template.
+func ExpandURL(template, namespace, name string) string {
+	return strings.NewReplacer(
+		"{namespace}", url.PathEscape(namespace),
+		"{name}", url.PathEscape(name),
+	).Replace(template)
+}
+
+// ExpandDocumentURL is ExpandURL that also substitutes {path}, a document
+// path relative to the server root, escaping each of its segments.
+func ExpandDocumentURL(template, namespace, name, docPath string) string {
+	var segs []string
+	for _, s := range strings.Split(docPath, "/") {
+		// ".." could leave the notebook's base path
+		if s != "" && s != "." && s != ".." {
+			segs = append(segs, url.PathEscape(s))
+		}
+	}
+	return strings.ReplaceAll(ExpandURL(template, namespace, name), "{path}", strings.Join(segs, "/"))
+}
+
+// cloneMeta prepares w, a copy of a live workload, to be created as newName:
+// server-populated metadata is dropped, labels, annotations and finalizers are kept.
+func cloneMeta(w *Workload, newName string) {
+	oldName := w.Name
+	w.ObjectMeta = metav1.ObjectMeta{
+		Name:        newName,
+		Namespace:   w.Namespace,
+		Labels:      w.Labels,
+		Annotations: w.Annotations,
+		Finalizers:  w.Finalizers,
+	}
+	// align label app if present
+	if _, has := w.Labels["app"]; has {
+		w.Labels["app"] = newName
+	}
+	renameLabels(w.Template.Labels, oldName, newName)
+}
+
+// Reset returns a mutation that turns an existing workload back into a clone
+// of src, as Clone would have created it under the workload's name: the pod
+// template, labels and annotations are copied from src.
+func Reset(src *Workload) Mutation {
+	return func(w *Workload) error {
+		tmp := src.DeepCopy()
+		w.Template = tmp.Template
+		w.Labels, w.Annotations = tmp.Labels, tmp.Annotations
+		if _, has := w.Labels["app"]; has {
+			w.Labels["app"] = w.Name
+		}
+		renameLabels(w.Template.Labels, src.Name, w.Name)
+		return nil
+	}
+}
+
+// renameLabels replaces label values equal to oldName, which tie pods to
+// their workload, with newName.
+func renameLabels(labels map[string]string, oldName, newName string) {
+	for k, v := range labels {
+		if v == oldName {
+			labels[k] = newName
+		}
+	}
+}
+
+func apply(w *Workload, mutations []Mutation) error {
+	for _, m := range mutations {
+		if err := m(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
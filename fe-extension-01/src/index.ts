@@ -148,6 +148,53 @@ function enableConnect(connect: HTMLButtonElement, status: HTMLDivElement, data:
 
 const apiUrl = new URL('/jupyter/abe/messages', window.location.origin).toString();
 
+const migrationsUrl = new URL('/jupyter/abe/migrations/', window.location.origin).toString();
+
+// Queue status of a switch waiting for free GPUs
+interface QueueStatus {
+  position: number;
+  pool: string;
+  reason?: string;
+  eta?: string;
+}
+
+// Switch as returned by GET /migrations/{id}
+interface Migration {
+  id: string;
+  state: string;
+  step?: string;
+  url?: string;
+  error?: string;
+  version: number;
+  queue?: QueueStatus;
+}
+
+function queueText(q: QueueStatus): string {
+  let text = `Waiting for a free GPU (${q.pool}): position ${q.position} in the queue`;
+  if (q.eta) {
+    text += `, expected to start around ${new Date(q.eta).toLocaleTimeString()}`;
+  }
+  return q.reason ? `${text}. ${q.reason}` : `${text}.`;
+}
+
+// Long-poll a switch the server answered with 202 until it is done,
+// showing its queue position meanwhile
+async function watchMigration(id: string, version: number, status: HTMLDivElement, signal: AbortSignal): Promise<Migration> {
+  for (;;) {
+    const res = await fetch(`${migrationsUrl}${encodeURIComponent(id)}?watch=${version}`, { signal });
+    if (!res.ok) {
+      const txt = await res.text().catch(() => '');
+      throw new Error(`HTTP ${res.status}: ${txt || res.statusText}`);
+    }
+    const m: Migration = await res.json();
+    if (m.state === 'Succeeded' || m.state === 'Failed' || m.state === 'Cancelled') {
+      return m;
+    }
+    status.textContent = m.queue ? queueText(m.queue) : m.step || 'Switching…';
+    version = m.version;
+  }
+}
+
 async function waitAndConnect(title: string, payload: Record<string, unknown>) {
   if (state.inFlight) return; // simple guard to avoid duplicate requests
   state.inFlight = true;
@@ -167,10 +214,32 @@ async function waitAndConnect(title: string, payload: Record<string, unknown>) {
 
     if (!res.ok) {
       const txt = await res.text().catch(() => '');
+      // Denials (e.g. namespace GPU policy) come with a readable reason
+      let reason = '';
+      try {
+        reason = String(JSON.parse(txt)?.error ?? '');
+      } catch {
+        // not JSON
+      }
+      if (reason) {
+        (status as HTMLDivElement).textContent = reason;
+        return;
+      }
       throw new Error(`HTTP ${res.status}: ${txt || res.statusText}`);
     }
 
-    const data: BackendResponse = await res.json();
+    let data: BackendResponse = await res.json();
+    if (res.status === 202 && typeof data.migrationID === 'string') {
+      // Queued: follow the switch until it is done
+      const queue = data.queue as QueueStatus | undefined;
+      (status as HTMLDivElement).textContent = queue ? queueText(queue) : 'Switching…';
+      const m = await watchMigration(data.migrationID, Number(data.version ?? 0), status as HTMLDivElement, ctrl.signal);
+      if (!m.url) {
+        (status as HTMLDivElement).textContent = m.error || `Switch ${m.state.toLowerCase()}.`;
+        return;
+      }
+      data = { newURL: m.url };
+    }
     enableConnect(connect, status as HTMLDivElement, data);
   } catch (err: any) {
     console.error('Error waiting for link:', err);
@@ -186,6 +255,12 @@ async function waitAndConnect(title: string, payload: Record<string, unknown>) {
   }
 }
 
+// Path of the document in the main area, so the new notebook opens it again
+function currentDocumentPath(app: JupyterFrontEnd): string | undefined {
+  const path = (app.shell.currentWidget as any)?.context?.path;
+  return typeof path === 'string' && path ? path : undefined;
+}
+
 const KISHU_COMMIT_CMD = 'kishu:commit';
 async function commitBeforeProceed(app: JupyterFrontEnd<JupyterFrontEnd.IShell, "desktop" | "mobile">) {
   if (app.commands.hasCommand(KISHU_COMMIT_CMD)) {
@@ -227,7 +302,8 @@ function resetGpuIdleTimer(app: JupyterFrontEnd<JupyterFrontEnd.IShell, "desktop
         const payload = {
           NotifyGPUReleased: 'true', // keep string if backend expects it
           PodName: state.PodName,
-          PodNamespace: state.PodNamespace
+          PodNamespace: state.PodNamespace,
+          DocumentPath: currentDocumentPath(app)
         };
         void waitAndConnect('Switching to CPU-only notebook', payload);
         state.usingGPU = false; // optimistic
@@ -277,7 +353,8 @@ const plugin: JupyterFrontEndPlugin<void> = {
               const payload = {
                 NotifyGPUNeeded: 'true',
                 PodName: state.PodName,
-                PodNamespace: state.PodNamespace
+                PodNamespace: state.PodNamespace,
+                DocumentPath: currentDocumentPath(app)
               };
               console.log('apiUrl:', apiUrl)
               void waitAndConnect('Switching to GPU notebook', payload);